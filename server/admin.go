@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+)
+
+// 管理者の権限
+//
+// - adminRoleViewer: ユーザーやログイン履歴の参照のみ
+// - adminRoleOperator: 参照に加えて、アカウントの無効化や認証器の削除などの操作ができる
+const (
+	adminRoleViewer   = "viewer"
+	adminRoleOperator = "operator"
+)
+
+// echo.Context に認証済みの管理者と、監査ログに残す追加情報を保存するときのキー
+const (
+	adminContextKey      = "admin"
+	adminAuditContextKey = "admin_audit_detail"
+)
+
+type Admin struct {
+	ID        string    `json:"id" bun:"id,pk"`
+	Name      string    `json:"name" bun:"name"`
+	Role      string    `json:"role" bun:"role"`
+	TokenHash string    `json:"-" bun:"token_hash"`
+	CreatedAt time.Time `json:"created_at" bun:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" bun:"updated_at"`
+}
+
+type AdminAuditLog struct {
+	ID                 string                 `json:"id" bun:"id,pk"`
+	AdminID            string                 `json:"admin_id" bun:"admin_id"`
+	Action             string                 `json:"action" bun:"action"`
+	TargetUserID       string                 `json:"target_user_id,omitempty" bun:"target_user_id,nullzero"`
+	TargetCredentialID string                 `json:"target_credential_id,omitempty" bun:"target_credential_id,nullzero"`
+	StatusCode         int                    `json:"status_code" bun:"status_code"`
+	Detail             map[string]interface{} `json:"detail,omitempty" bun:"detail,type:jsonb,nullzero"`
+	IP                 string                 `json:"ip" bun:"ip"`
+	CreatedAt          time.Time              `json:"created_at" bun:"created_at"`
+}
+
+// 管理者APIのトークンやOIDCクライアントのシークレットはハッシュ化して保存しているので、照合する際も同じ方法でハッシュ化する。
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 管理者APIの認証。
+// ユーザー向けのログインセッションとは別に、 Authorization ヘッダーのBearerトークンで管理者を特定する。
+func adminAuth(db *bun.DB) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			token, ok := strings.CutPrefix(ctx.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if !ok || token == "" {
+				return ctx.JSON(http.StatusUnauthorized, nil)
+			}
+
+			var admin Admin
+			err := db.NewSelect().
+				Model(&admin).
+				Column("*").
+				Where("token_hash = ?", hashToken(token)).
+				Scan(ctx.Request().Context())
+			if err != nil {
+				if !errors.Is(err, sql.ErrNoRows) {
+					ctx.Logger().Errorf("Failed to find admin: %v\n", err)
+					return ctx.JSON(http.StatusInternalServerError, nil)
+				}
+				ctx.Logger().Warnf("Invalid admin token from %s\n", ctx.RealIP())
+				return ctx.JSON(http.StatusUnauthorized, nil)
+			}
+
+			ctx.Set(adminContextKey, &admin)
+			return next(ctx)
+		}
+	}
+}
+
+// 指定した権限のいずれかを持つ管理者のみ許可する。
+func requireAdminRole(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			admin, ok := ctx.Get(adminContextKey).(*Admin)
+			if !ok {
+				return ctx.JSON(http.StatusUnauthorized, nil)
+			}
+
+			for _, role := range roles {
+				if admin.Role == role {
+					return next(ctx)
+				}
+			}
+
+			return ctx.JSON(http.StatusForbidden, nil)
+		}
+	}
+}
+
+// 管理者APIへのリクエストをすべて admin_audit_logs に記録する。
+// 権限不足で拒否されたリクエストも記録したいので、 requireAdminRole より外側で使用する。
+func auditAdminAction(db *bun.DB) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			handlerErr := next(ctx)
+
+			admin, ok := ctx.Get(adminContextKey).(*Admin)
+			if !ok {
+				return handlerErr
+			}
+
+			status := ctx.Response().Status
+			var httpErr *echo.HTTPError
+			if errors.As(handlerErr, &httpErr) {
+				status = httpErr.Code
+			}
+
+			targetUserID := ctx.Param("id")
+			if targetUserID == "" {
+				targetUserID = ctx.Param("user_id")
+			}
+			detail, _ := ctx.Get(adminAuditContextKey).(map[string]interface{})
+
+			log := &AdminAuditLog{
+				AdminID:            admin.ID,
+				Action:             ctx.Request().Method + " " + ctx.Path(),
+				TargetUserID:       uuidOrEmpty(targetUserID),
+				TargetCredentialID: uuidOrEmpty(ctx.Param("public_key_id")),
+				StatusCode:         status,
+				Detail:             detail,
+				IP:                 ctx.RealIP(),
+			}
+			// レスポンスは返し終わっているので、リクエストのキャンセルに影響されないようにする
+			_, err := db.NewInsert().
+				Model(log).
+				Column("admin_id", "action", "target_user_id", "target_credential_id", "status_code", "detail", "ip").
+				Exec(context.WithoutCancel(ctx.Request().Context()))
+			if err != nil {
+				ctx.Logger().Errorf("Failed to insert admin audit log: %v\n", err)
+			}
+
+			return handlerErr
+		}
+	}
+}
+
+// 監査ログに残す追加情報(無効化の理由など)を設定する。
+func setAdminAuditDetail(ctx echo.Context, detail map[string]interface{}) {
+	ctx.Set(adminAuditContextKey, detail)
+}
+
+func adminSearchUsers(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		q, err := parseUserListQuery(ctx)
+		if err != nil {
+			ctx.Logger().Errorf("Invalid query: %v\n", err)
+			return ctx.JSON(http.StatusBadRequest, err.Error())
+		}
+		q.Search = ctx.QueryParam("q")
+		q.Status = ctx.QueryParam("status")
+		q.TenantID = ctx.QueryParam("tenant_id")
+
+		res, err := listUsers(ctx.Request().Context(), db, q)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to list users: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		return ctx.JSON(http.StatusOK, res)
+	}
+}
+
+func adminGetUser(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user, err := findUserByID(ctx.Request().Context(), db, ctx.Param("id"))
+		if err != nil {
+			ctx.Logger().Errorf("Failed to find user: %v\n", err)
+			return ctx.JSON(http.StatusNotFound, nil)
+		}
+
+		return ctx.JSON(http.StatusOK, newUserResponse(user, visibilityAdmin))
+	}
+}
+
+type adminUpdateUserStatusRequest struct {
+	Reason string `json:"reason"`
+}
+
+// アカウントの状態を変更する。有効化以外の場合は、既存のログインセッションもすべて削除する。
+func adminUpdateUserStatus(db *bun.DB, sessions *sessionStore, status string) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		userID := ctx.Param("id")
+
+		var req adminUpdateUserStatusRequest
+		if err := ctx.Bind(&req); err != nil {
+			ctx.Logger().Errorf("Failed to process request: %v\n", err)
+			return ctx.JSON(http.StatusBadRequest, nil)
+		}
+		setAdminAuditDetail(ctx, map[string]interface{}{"status": status, "reason": req.Reason})
+
+		query := db.NewUpdate().
+			Model((*User)(nil)).
+			Set("status = ?", status).
+			Set("status_reason = NULLIF(?, '')", req.Reason).
+			Set("status_changed_at = NOW()").
+			Set("updated_at = NOW()").
+			Where("id = ?", userID)
+		if status == userStatusActive {
+			// 有効化する場合は、ログイン失敗によるロックも解除する
+			query = query.
+				Set("locked_until = NULL").
+				Set("failed_login_count = 0").
+				Set("last_failed_login_at = NULL")
+		}
+
+		res, err := query.Exec(ctx.Request().Context())
+		if err != nil {
+			ctx.Logger().Errorf("Failed to update user status: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ctx.JSON(http.StatusNotFound, nil)
+		}
+
+		if status != userStatusActive {
+			if _, err := sessions.DeleteUserLoginSessions(ctx.Request().Context(), userID); err != nil {
+				ctx.Logger().Errorf("Failed to delete login sessions: %v\n", err)
+				return ctx.JSON(http.StatusInternalServerError, nil)
+			}
+			if _, err := revokeUserRefreshTokens(ctx.Request().Context(), db, userID, ""); err != nil {
+				ctx.Logger().Errorf("Failed to revoke refresh tokens: %v\n", err)
+				return ctx.JSON(http.StatusInternalServerError, nil)
+			}
+		}
+
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
+
+func adminRevokePublicKey(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		userID := ctx.Param("user_id")
+		publicKeyID := ctx.Param("public_key_id")
+
+		reason := "revoked by admin " + ctx.Get(adminContextKey).(*Admin).Name
+		deleted, err := removePublicKey(ctx.Request().Context(), db, userID, publicKeyID, reason)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to delete webauthn credential: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		if deleted == nil {
+			return ctx.JSON(http.StatusNotFound, nil)
+		}
+
+		recordAuthEvent(ctx, db, (&AuthEvent{
+			UserID:    userID,
+			EventType: authEventCredentialDelete,
+			Result:    authEventSuccess,
+			Reason:    reason,
+		}).withCredential(deleted))
+
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
+
+type adminDisablePublicKeyRequest struct {
+	Reason string `json:"reason"`
+}
+
+// 認証器を削除せずに無効化、または有効化する。
+func adminSetPublicKeyDisabled(db *bun.DB, disabled bool) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var req adminDisablePublicKeyRequest
+		if err := ctx.Bind(&req); err != nil {
+			ctx.Logger().Errorf("Failed to process request: %v\n", err)
+			return ctx.JSON(http.StatusBadRequest, nil)
+		}
+		setAdminAuditDetail(ctx, map[string]interface{}{"disabled": disabled, "reason": req.Reason})
+
+		cred, err := updatePublicKeyDisabled(ctx, db, ctx.Param("user_id"), ctx.Param("public_key_id"), disabled, req.Reason)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to update webauthn credential: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		if cred == nil {
+			return ctx.JSON(http.StatusNotFound, nil)
+		}
+
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
+
+type adminForceLogoutResponse struct {
+	RevokedSessions int `json:"revoked_sessions"`
+	// トークンモードでログインしたクライアントのうち、リフレッシュトークンを失効させた数
+	RevokedTokenFamilies int `json:"revoked_token_families"`
+}
+
+func adminForceLogout(db *bun.DB, sessions *sessionStore) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		n, err := sessions.DeleteUserLoginSessions(ctx.Request().Context(), ctx.Param("id"))
+		if err != nil {
+			ctx.Logger().Errorf("Failed to delete login sessions: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		families, err := revokeUserRefreshTokens(ctx.Request().Context(), db, ctx.Param("id"), "")
+		if err != nil {
+			ctx.Logger().Errorf("Failed to revoke refresh tokens: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		setAdminAuditDetail(ctx, map[string]interface{}{"revoked_sessions": n, "revoked_token_families": families})
+
+		return ctx.JSON(http.StatusOK, adminForceLogoutResponse{RevokedSessions: n, RevokedTokenFamilies: families})
+	}
+}
+
+// ユーザーの監査ログを取得する。 login_history はログインのイベントのみに絞り込む。
+func adminListAuthEvents(db *bun.DB, eventTypes ...string) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		q, err := parseAuthEventQuery(ctx, ctx.Param("id"))
+		if err != nil {
+			ctx.Logger().Errorf("Invalid query: %v\n", err)
+			return ctx.JSON(http.StatusBadRequest, err.Error())
+		}
+		if len(eventTypes) > 0 {
+			q.EventTypes = eventTypes
+		}
+
+		res, err := listAuthEvents(ctx.Request().Context(), db, q)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to select auth events: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		return ctx.JSON(http.StatusOK, res)
+	}
+}
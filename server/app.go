@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daikideal/go-passkey-demo/db"
+	"github.com/daikideal/go-passkey-demo/passkey"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/uptrace/bun"
+)
+
+// サーバー本体。
+//
+// DBやRedisへの接続、テナント、ルーティングなどを App が持ち、ハンドラーには必要なものを引数で渡す。
+// 接続をグローバル変数にしないことで、他のバイナリに組み込んだり、テストで複数のサーバーを起動したりできるようにする。
+
+type appConfig struct {
+	// 待ち受けるアドレス
+	Addr string
+	// メトリクスを公開するアドレス。公開のアドレスとは分けて、内部のネットワークからだけ取得できるようにする
+	MetricsAddr string
+	// PostgreSQLの接続先
+	DatabaseDSN string
+	// セッションストア(Redis)の接続先
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	// トレースに記録するサービス名
+	ServiceName string
+	// CORSやCSRF対策で、テナントのオリジンに加えて許可するオリジン
+	AllowedOrigins []string
+	// X-Forwarded-For でクライアントのIPアドレスを渡すリバースプロキシのアドレス(CIDR)。
+	// 空の場合は、接続元のIPアドレスをクライアントのIPアドレスとする。
+	TrustedProxies []string
+	// Cookieの作成と読み込みは、属性や名前の付け方をそろえるためにすべてこれを通す。
+	// 本番環境(APP_ENV=production)では、Secure 属性を付けて名前に __Host- プレフィックスを付ける。
+	Cookies passkey.CookieFactory
+	// Host ヘッダーに一致するテナントがない場合のテナント
+	DefaultTenant  string
+	TenantCacheTTL time.Duration
+
+	OIDC       oidcConfig
+	RateLimits rateLimitConfig
+	Cleanup    cleanupConfig
+
+	CleanupInterval         time.Duration
+	WebhookDispatchInterval time.Duration
+
+	StartupRetryAttempts int
+	StartupRetryInterval time.Duration
+	ShutdownDrainDelay   time.Duration
+	ShutdownTimeout      time.Duration
+}
+
+// 環境変数から設定を読み込む。解釈できない値がある場合はエラーを返す。
+func loadAppConfig() (appConfig, error) {
+	env := &envReader{}
+	oidc := loadOIDCConfig(env)
+	cfg := appConfig{
+		Addr:                    getEnv("LISTEN_ADDR", ":8080"),
+		MetricsAddr:             getEnv("METRICS_LISTEN_ADDR", ":9100"),
+		DatabaseDSN:             db.DSN(),
+		RedisAddr:               getEnv("REDIS_ADDR", "redis:6379"),
+		RedisPassword:           getEnv("REDIS_PASSWORD", ""),
+		RedisDB:                 env.getInt("REDIS_DB", 0),
+		ServiceName:             getEnv("OTEL_SERVICE_NAME", "go-passkey-demo"),
+		AllowedOrigins:          strings.Split(getEnv("ALLOWED_ORIGINS", "http://localhost:5173"), ","),
+		TrustedProxies:          strings.FieldsFunc(getEnv("TRUSTED_PROXIES", ""), func(r rune) bool { return r == ',' }),
+		Cookies:                 passkey.CookieFactory{Production: getEnv("APP_ENV", "development") == "production"},
+		DefaultTenant:           getEnv("DEFAULT_TENANT", defaultTenantID),
+		TenantCacheTTL:          env.getDuration("TENANT_CACHE_TTL", time.Minute),
+		OIDC:                    oidc,
+		RateLimits:              loadRateLimitConfig(env),
+		Cleanup:                 loadCleanupConfig(env, oidc),
+		CleanupInterval:         env.getDuration("CLEANUP_INTERVAL", time.Hour),
+		WebhookDispatchInterval: env.getDuration("WEBHOOK_DISPATCH_INTERVAL", 5*time.Second),
+		StartupRetryAttempts:    env.getInt("STARTUP_RETRY_ATTEMPTS", 10),
+		StartupRetryInterval:    env.getDuration("STARTUP_RETRY_INTERVAL", time.Second),
+		ShutdownDrainDelay:      env.getDuration("SHUTDOWN_DRAIN_DELAY", 0),
+		ShutdownTimeout:         env.getDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+	}
+
+	return cfg, env.err()
+}
+
+type App struct {
+	cfg    appConfig
+	logger *slogLogger
+
+	db       *bun.DB
+	redis    *redis.Client
+	sessions *sessionStore
+	tenants  *tenantRegistry
+	// アクセストークンの検証に使う公開鍵
+	signingKeys *signingKeyCache
+	passkeys    *passkey.EchoHandler
+	metrics     *metrics
+	// メトリクスだけを公開するサーバー
+	metricsServer *http.Server
+	checks        []dependencyCheck
+	clientIP      echo.IPExtractor
+	echo          *echo.Echo
+
+	// 停止処理を始めたら、 /readyz は 503 を返す
+	draining atomic.Bool
+	// バックグラウンドのジョブ
+	jobs     sync.WaitGroup
+	stopJobs context.CancelFunc
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// 設定から App を作成する。DBやRedisには、最初に使う時に接続する。
+func newApp(cfg appConfig, logger *slogLogger) (*App, error) {
+	database, err := db.Open(cfg.DatabaseDSN)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.RedisAddr,
+		Password: cfg.RedisPassword,
+		DB:       cfg.RedisDB,
+	})
+
+	app := &App{
+		cfg:         cfg,
+		logger:      logger,
+		db:          database,
+		redis:       client,
+		sessions:    newSessionStore(client),
+		tenants:     newTenantRegistry(database, cfg.TenantCacheTTL, logger),
+		signingKeys: newSigningKeyCache(database, cfg.OIDC.KeyRetention, cfg.OIDC.KeyCacheTTL),
+		checks:      newDependencyChecks(database, client),
+		stopJobs:    func() {},
+	}
+
+	// トレーシングとメトリクス
+	app.metrics = newMetrics(client)
+	database.AddQueryHook(dbTracingHook{})
+	database.AddQueryHook(dbMetricsHook{metrics: app.metrics})
+	if err := instrumentSessionStore(client); err != nil {
+		return nil, errors.Join(err, app.Close())
+	}
+	client.AddHook(sessionStoreMetricsHook{metrics: app.metrics})
+
+	app.clientIP, err = newIPExtractor(cfg.TrustedProxies)
+	if err != nil {
+		return nil, errors.Join(err, app.Close())
+	}
+
+	app.passkeys, err = newPasskeyHandler(database, app.sessions, cfg.OIDC, cfg.Cookies, logger)
+	if err != nil {
+		return nil, errors.Join(err, app.Close())
+	}
+
+	app.echo = app.newRouter()
+	app.metricsServer = newMetricsServer(cfg.MetricsAddr, app.metrics.registry)
+
+	return app, nil
+}
+
+// テストなどで、サーバーを起動せずにリクエストを処理できるようにする。
+func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	app.echo.ServeHTTP(w, r)
+}
+
+// 依存先に接続できるまで待ってから、バックグラウンドのジョブとサーバーを起動する。
+// ctx がキャンセルされると、処理中のリクエストを待ってから停止し、接続を閉じる。
+func (app *App) Run(ctx context.Context) error {
+	// PostgresとRedisに接続できるまで待つ。コンテナの起動順に依存しないようにするため。
+	if err := waitForDependencies(ctx, app.logger, app.checks, app.cfg.StartupRetryAttempts, app.cfg.StartupRetryInterval); err != nil {
+		return errors.Join(err, app.Close())
+	}
+	// RPOrigins と関連オリジンが矛盾しているテナントがある場合や、テナントを読み込めない場合は起動しない
+	if err := app.tenants.validate(ctx); err != nil {
+		return errors.Join(err, app.Close())
+	}
+
+	app.startJobs()
+
+	serveErr := make(chan error, 2)
+	go func() {
+		serveErr <- app.echo.Start(app.cfg.Addr)
+	}()
+	go func() {
+		if err := app.metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- fmt.Errorf("Failed to start metrics server: %w", err)
+		}
+	}()
+
+	var err error
+	select {
+	case err = <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+	case <-ctx.Done():
+		app.logger.Info("Shutting down server")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), app.cfg.ShutdownTimeout)
+	defer cancel()
+
+	return errors.Join(err, app.Shutdown(shutdownCtx))
+}
+
+func (app *App) startJobs() {
+	ctx, cancel := context.WithCancel(context.Background())
+	app.stopJobs = cancel
+
+	// 放置されたユーザーや保持期間を過ぎた監査ログなどを定期的に削除する
+	startCleanupJobs(ctx, &app.jobs, app.logger, app.db, newCleanupJobs(app.cfg.Cleanup), app.cfg.CleanupInterval)
+
+	// 送信キューに追加されたWebhookを送信する
+	startWebhookDispatcher(ctx, &app.jobs, app.logger, app.db, app.cfg.WebhookDispatchInterval)
+}
+
+// /readyz を 503 にしてから新しい接続の受け付けを止め、処理中のリクエストとバックグラウンドのジョブが終わるのを待って接続を閉じる。
+func (app *App) Shutdown(ctx context.Context) error {
+	app.draining.Store(true)
+	// ロードバランサーが /readyz の失敗に気付いて、新しいリクエストを送らなくなるまで待つ
+	select {
+	case <-ctx.Done():
+	case <-time.After(app.cfg.ShutdownDrainDelay):
+	}
+
+	var errs []error
+	if err := app.echo.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("Failed to shutdown server: %w", err))
+	}
+	if err := app.metricsServer.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("Failed to shutdown metrics server: %w", err))
+	}
+	app.stopJobs()
+	if err := waitGroupWithContext(ctx, &app.jobs); err != nil {
+		errs = append(errs, fmt.Errorf("Failed to wait for background jobs: %w", err))
+	}
+	if err := app.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// DBとRedisの接続を閉じる。何度呼んでもよい。
+func (app *App) Close() error {
+	app.closeOnce.Do(func() {
+		var errs []error
+		if err := app.db.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("Failed to close database: %w", err))
+		}
+		if err := app.redis.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("Failed to close session store: %w", err))
+		}
+		app.closeErr = errors.Join(errs...)
+	})
+
+	return app.closeErr
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daikideal/go-passkey-demo/passkey"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+)
+
+// 認証や認証器の操作に関するイベントの種類。登録・認証と認証器の操作は passkey パッケージのイベントをそのまま記録する。
+const (
+	authEventRegistration      = string(passkey.EventRegistration)
+	authEventLogin             = string(passkey.EventLogin)
+	authEventCredentialDelete  = string(passkey.EventCredentialDelete)
+	authEventCredentialDisable = string(passkey.EventCredentialDisable)
+	authEventCredentialEnable  = string(passkey.EventCredentialEnable)
+	authEventAccountLock       = "account.lock"
+	authEventTokenReuse        = "token.reuse"
+	authEventSessionRevoke     = "session.revoke"
+)
+
+// イベントの結果
+const (
+	authEventSuccess = "success"
+	authEventFailure = "failure"
+)
+
+const (
+	defaultAuthEventLimit = 50
+	maxAuthEventLimit     = 200
+)
+
+// auth_events テーブルに追記のみで保存する監査ログ。
+// ユーザーや認証器が特定できない失敗(セッション切れなど)の場合は、UserID や CredentialID は空になる。
+type AuthEvent struct {
+	bun.BaseModel `bun:"table:auth_events,alias:ae"`
+
+	ID           string    `json:"id" bun:"id,pk"`
+	UserID       string    `json:"user_id,omitempty" bun:"user_id,nullzero"`
+	CredentialID string    `json:"credential_id,omitempty" bun:"credential_id,nullzero"`
+	EventType    string    `json:"event_type" bun:"event_type"`
+	Result       string    `json:"result" bun:"result"`
+	Reason       string    `json:"reason,omitempty" bun:"reason,nullzero"`
+	IP           string    `json:"ip" bun:"ip"`
+	UserAgent    string    `json:"user_agent" bun:"user_agent"`
+	AAGUID       string    `json:"aaguid,omitempty" bun:"aaguid,nullzero"`
+	CreatedAt    time.Time `json:"created_at" bun:"created_at"`
+}
+
+// 認証器の情報をイベントに設定する。
+func (ev *AuthEvent) withCredential(cred *WebauthnCredentials) *AuthEvent {
+	if cred == nil {
+		return ev
+	}
+
+	return ev.withCredentialInfo(cred.ID, cred.Authenticator.AAGUID)
+}
+
+// passkey パッケージの認証器の情報をイベントに設定する。
+func (ev *AuthEvent) withPasskeyCredential(cred *passkey.Credential) *AuthEvent {
+	if cred == nil {
+		return ev
+	}
+
+	return ev.withCredentialInfo(cred.ID, cred.Authenticator.AAGUID)
+}
+
+func (ev *AuthEvent) withCredentialInfo(id string, aaguid []byte) *AuthEvent {
+	ev.CredentialID = id
+	if v, err := uuid.FromBytes(aaguid); err == nil {
+		ev.AAGUID = v.String()
+	}
+
+	return ev
+}
+
+// 監査ログを記録する。
+// 記録に失敗しても本来の処理は成功させたいので、エラーはログに出力するだけにする。
+func recordAuthEvent(ctx echo.Context, db bun.IDB, ev *AuthEvent) {
+	ev.IP = ctx.RealIP()
+	ev.UserAgent = ctx.Request().UserAgent()
+
+	// 認証器の登録・認証の失敗理由を、メトリクスに記録できるようにする
+	if ev.Result == authEventFailure && (ev.EventType == authEventRegistration || ev.EventType == authEventLogin) {
+		ctx.Set(ceremonyFailureReasonContextKey, ceremonyFailureReason(ev.Reason))
+	}
+
+	if err := insertAuthEvent(ctx.Request().Context(), db, ev); err != nil {
+		ctx.Logger().Errorf("Failed to insert auth event: %v\n", err)
+	}
+}
+
+// UUIDの列に保存する値を返す。
+// リクエストのパスから受け取ったIDなどがUUIDでない場合は、保存に失敗しないように空(NULL)にする。
+func uuidOrEmpty(v string) string {
+	id, err := uuid.Parse(v)
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
+
+// IPアドレスなどを設定したイベントを保存する。
+func insertAuthEvent(ctx context.Context, db bun.IDB, ev *AuthEvent) error {
+	ev.UserID = uuidOrEmpty(ev.UserID)
+	ev.CredentialID = uuidOrEmpty(ev.CredentialID)
+
+	// レスポンスを返した後にリクエストがキャンセルされても記録できるようにする
+	_, err := db.NewInsert().
+		Model(ev).
+		Column("user_id", "credential_id", "event_type", "result", "reason", "ip", "user_agent", "aaguid").
+		Exec(context.WithoutCancel(ctx))
+	return err
+}
+
+type authEventQuery struct {
+	UserID     string
+	EventTypes []string
+	Limit      int
+	// 前のページの最後のイベント。これより古いイベントを取得する。
+	Before *authEventCursor
+}
+
+type authEventCursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        string    `json:"id"`
+}
+
+func (c *authEventCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeAuthEventCursor(v string) (*authEventCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	var cursor authEventCursor
+	if err := json.Unmarshal(b, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	return &cursor, nil
+}
+
+func parseAuthEventQuery(ctx echo.Context, userID string) (*authEventQuery, error) {
+	q := &authEventQuery{UserID: userID, Limit: defaultAuthEventLimit}
+
+	if v := ctx.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAuthEventLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxAuthEventLimit)
+		}
+		q.Limit = limit
+	}
+
+	if v := ctx.QueryParam("type"); v != "" {
+		q.EventTypes = strings.Split(v, ",")
+	}
+
+	if v := ctx.QueryParam("cursor"); v != "" {
+		cursor, err := decodeAuthEventCursor(v)
+		if err != nil {
+			return nil, err
+		}
+		q.Before = cursor
+	}
+
+	return q, nil
+}
+
+type listAuthEventsResponse struct {
+	Events     []AuthEvent `json:"events"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// ユーザーの監査ログを新しい順に取得する。
+func listAuthEvents(ctx context.Context, db bun.IDB, q *authEventQuery) (*listAuthEventsResponse, error) {
+	events := []AuthEvent{}
+	query := db.NewSelect().
+		Model(&events).
+		Column("*").
+		Where("ae.user_id = ?", q.UserID).
+		OrderExpr("ae.created_at DESC, ae.id DESC").
+		// 次のページがあるかどうかを判定するために1件多く取得する
+		Limit(q.Limit + 1)
+	if len(q.EventTypes) > 0 {
+		query = query.Where("ae.event_type IN (?)", bun.In(q.EventTypes))
+	}
+	if q.Before != nil {
+		query = query.Where("(ae.created_at, ae.id) < (?, ?)", q.Before.CreatedAt, q.Before.ID)
+	}
+
+	if err := query.Scan(ctx); err != nil {
+		return nil, err
+	}
+
+	res := &listAuthEventsResponse{Events: events}
+	if len(events) > q.Limit {
+		res.Events = events[:q.Limit]
+		last := res.Events[q.Limit-1]
+		res.NextCursor = (&authEventCursor{CreatedAt: last.CreatedAt, ID: last.ID}).encode()
+	}
+
+	return res, nil
+}
+
+// 保持期間を過ぎた監査ログを削除し、削除した件数を返す。
+func pruneAuthEvents(ctx context.Context, db bun.IDB, before time.Time) (int64, error) {
+	res, err := db.NewDelete().
+		Model((*AuthEvent)(nil)).
+		Where("created_at < ?", before).
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func listUserAuthEvents(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		q, err := parseAuthEventQuery(ctx, ctx.Param("id"))
+		if err != nil {
+			ctx.Logger().Errorf("Invalid query: %v\n", err)
+			return ctx.JSON(http.StatusBadRequest, err.Error())
+		}
+
+		res, err := listAuthEvents(ctx.Request().Context(), db, q)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to select auth events: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		return ctx.JSON(http.StatusOK, res)
+	}
+}
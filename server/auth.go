@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/daikideal/go-passkey-demo/passkey"
+	"github.com/labstack/echo/v4"
+)
+
+// ログインセッションのIDを保存するCookieの名前
+const loginSessionCookieName = "session"
+
+// 最後にアクセスした日時を更新する間隔。リクエストのたびにRedisに書き込まないようにする。
+const loginSessionTouchInterval = time.Minute
+
+// loginSessionAuth が取得したログインセッションと、そのID(Cookieの値)
+const (
+	loginSessionContextKey   = "login_session"
+	loginSessionIDContextKey = "login_session_id"
+)
+
+// CookieのログインセッションをRedisから取得し、リクエストのログインセッションとして設定する。
+// accessTokenAuth の後に実行する。
+func loginSessionAuth(sessions *sessionStore, cookies passkey.CookieFactory) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			// トークンモードのクライアントは、アクセストークンの情報を使う
+			if _, ok := ctx.Get(accessTokenContextKey).(*accessTokenClaims); ok {
+				return next(ctx)
+			}
+
+			cookie, err := cookies.Get(ctx.Request(), loginSessionCookieName)
+			if err != nil {
+				return next(ctx)
+			}
+
+			session, err := sessions.GetLoginSession(ctx.Request().Context(), cookie.Value)
+			if err != nil {
+				return next(ctx)
+			}
+			// パスのプレフィックスでテナントを分けている場合は同じCookieが送られるので、ログインしたテナント以外では使えないようにする
+			if tenant, ok := tenantFromContext(ctx); session.TenantID != "" && (!ok || session.TenantID != tenant.ID) {
+				return next(ctx)
+			}
+
+			if time.Since(session.LastSeenAt) > loginSessionTouchInterval {
+				session.LastSeenAt = time.Now()
+				session.IP = ctx.RealIP()
+				session.UserAgent = ctx.Request().UserAgent()
+				if err := sessions.TouchLoginSession(ctx.Request().Context(), cookie.Value, session); err != nil {
+					ctx.Logger().Errorf("Failed to touch login session: %v\n", err)
+				}
+			}
+
+			ctx.Set(loginSessionContextKey, session)
+			ctx.Set(loginSessionIDContextKey, cookie.Value)
+			return next(ctx)
+		}
+	}
+}
+
+// リクエストのログインセッションを取得する。
+// トークンモードでログインしたクライアントの場合は、アクセストークンの情報を返す。
+// ログインしていない場合は false を返す。
+func currentLoginSession(ctx echo.Context) (*LoginSession, bool) {
+	if claims, ok := ctx.Get(accessTokenContextKey).(*accessTokenClaims); ok {
+		return claims.loginSession(), true
+	}
+
+	session, ok := ctx.Get(loginSessionContextKey).(*LoginSession)
+	return session, ok
+}
+
+// リクエストしたユーザーのIDを、ログインセッションから取得する。
+// ログインしていない場合は false を返す。
+func currentUserID(ctx echo.Context) (string, bool) {
+	session, ok := currentLoginSession(ctx)
+	if !ok {
+		return "", false
+	}
+
+	return session.UserID, true
+}
+
+// 閲覧者と、閲覧対象のユーザーの関係から、レスポンスに含める情報の範囲を決める。
+func resolveVisibility(ctx echo.Context, subjectUserID string) visibility {
+	if userID, ok := currentUserID(ctx); ok && userID == subjectUserID {
+		return visibilitySelf
+	}
+
+	return visibilityPublic
+}
+
+// パスパラメータで指定されたユーザー本人としてログインしている場合のみ許可する。
+func requireSelf(param string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			userID, ok := currentUserID(ctx)
+			if !ok {
+				return ctx.JSON(http.StatusUnauthorized, nil)
+			}
+			if userID != ctx.Param(param) {
+				return ctx.JSON(http.StatusForbidden, nil)
+			}
+
+			return next(ctx)
+		}
+	}
+}
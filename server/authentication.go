@@ -1,78 +1,96 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"net/http"
+	"time"
 
-	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/daikideal/go-passkey-demo/passkey"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
 )
 
-func beginLogin(w *webauthn.WebAuthn) echo.HandlerFunc {
-	return func(ctx echo.Context) error {
-		options, session, err := w.BeginDiscoverableLogin()
-		if err != nil {
-			ctx.Logger().Errorf("Failed to begin login: %v\n", err)
-			return ctx.JSON(http.StatusInternalServerError, "Failed to begin login")
+type finishLoginResponse struct {
+	UserID string `json:"user_id"`
+	// トークンモードの場合のみ返す
+	*tokenResponse
+}
+
+// passkey パッケージで認証に成功した後に、ログイン状態を作成する(passkey.EchoConfig.OnLogin)。
+// トークンモードの場合はトークンを発行し、そうでない場合はCookieのログインセッションを開始する。
+func completeLogin(db *bun.DB, sessions *sessionStore, oidc oidcConfig, cookies passkey.CookieFactory) func(echo.Context, *passkey.Login) error {
+	return func(ctx echo.Context, login *passkey.Login) error {
+		userID := login.User.UserID()
+
+		// トークンモードの場合は、ログインセッションの代わりにトークンを発行する
+		if ctx.QueryParam("mode") == "token" {
+			tokens, err := issueLoginTokens(ctx.Request().Context(), db, oidc, login.Scope, userID, login.UserVerified)
+			if err != nil {
+				ctx.Logger().Errorf("Failed to issue tokens: %v\n", err)
+				return ctx.JSON(http.StatusInternalServerError, nil)
+			}
+			ctx.Response().Header().Set("Cache-Control", "no-store")
+
+			return ctx.JSON(http.StatusOK, finishLoginResponse{UserID: userID, tokenResponse: tokens})
 		}
 
-		sessionId, err := CreateSession(ctx.Request().Context(), session)
+		// ログイン状態を保持するセッションを開始
+		loginSession := &LoginSession{
+			UserID:       userID,
+			TenantID:     login.Scope,
+			UserVerified: login.UserVerified,
+			IP:           ctx.RealIP(),
+			UserAgent:    ctx.Request().UserAgent(),
+		}
+		if login.Credential != nil {
+			loginSession.CredentialID = login.Credential.ID
+		}
+		loginSessionID, err := sessions.CreateLoginSession(ctx.Request().Context(), loginSession)
 		if err != nil {
-			ctx.Logger().Errorf("Failed to start session: %v\n", err)
+			ctx.Logger().Errorf("Failed to start login session: %v\n", err)
 			return ctx.JSON(http.StatusInternalServerError, nil)
 		}
-		ctx.SetCookie(&http.Cookie{
-			Name:  "authentication",
-			Value: sessionId,
-			Path:  "/",
-		})
+		ctx.SetCookie(cookies.New(loginSessionCookieName, loginSessionID, loginSessionDuration))
 
-		return ctx.JSON(http.StatusOK, options)
+		return ctx.JSON(http.StatusOK, finishLoginResponse{UserID: userID})
 	}
 }
 
-type finishLoginResponse struct {
-	UserID string `json:"user_id"`
-}
-
-func finishLogin(w *webauthn.WebAuthn) echo.HandlerFunc {
-	return func(ctx echo.Context) error {
-		cookie, err := ctx.Cookie("authentication")
+// ログインに成功した認証器の署名カウンタとフラグを保存する。
+//
+// 署名カウンタが増えていない場合、go-webauthn は CloneWarning を立てる。
+// 認証器が複製されている可能性があるので、同じトランザクションでWebhookの送信キューに追加する。
+// CloneWarning は一度立つと保存したまま残るので、Webhookは立ったときに一度だけ送る。
+func updateCredentialAfterLogin(ctx context.Context, db bun.IDB, stored *WebauthnCredentials, credential *webauthn.Credential) error {
+	return db.RunInTx(ctx, nil, func(c context.Context, tx bun.Tx) error {
+		// 同時にログインした場合に二重に送らないように、保存されているフラグを行ロックして取得する
+		var current WebauthnCredentials
+		err := tx.NewSelect().
+			Model(&current).
+			Column("authenticator").
+			Where("id = ?", stored.ID).
+			For("UPDATE").
+			Scan(c)
 		if err != nil {
-			ctx.Logger().Errorf("Cookie is not set: %v\n", err)
-			return ctx.JSON(http.StatusBadRequest, nil)
-		}
-		session, err := GetSession(ctx.Request().Context(), cookie.Value)
-
-		var userID string
-		// ValidateDiscoverableLogin にて、どのようにログインするユーザーを特定するかを定義する関数。
-		//
-		// userHandle は User インターフェース実装されている WebAuthnId() のこと。
-		// 今回はプライマリIDであるUUIDをバイト列に変換したものを返しているので、 userHandle を string に変換して User をクエリすればユーザーを特定できる。
-		// rawID が何なのかわかっておらず、いまいちどうやって使えばいいかわからない。
-		handler := func(rawID, userHandle []byte) (webauthn.User, error) {
-			userID = string(userHandle)
-			user, err := findUserByID(ctx.Request().Context(), userID)
-			if err != nil {
-				ctx.Logger().Errorf("Failed to find user: %v\n", err)
-				return nil, fmt.Errorf("Failed to find user")
-			}
-
-			return user, nil
+			return err
 		}
 
-		res, err := protocol.ParseCredentialRequestResponse(ctx.Request())
+		stored.Authenticator = credential.Authenticator
+		stored.Flags = credential.Flags
+		stored.UpdatedAt = time.Now()
+		_, err = tx.NewUpdate().
+			Model(stored).
+			Column("authenticator", "flags", "updated_at").
+			WherePK().
+			Exec(c)
 		if err != nil {
-			ctx.Logger().Errorf("Failed to parse credential request response: %v\n", err)
-			return ctx.JSON(http.StatusBadRequest, "Failed to parse credential request response")
+			return err
 		}
 
-		if _, err = w.ValidateDiscoverableLogin(handler, *session, res); err != nil {
-			ctx.Logger().Errorf("Failed to validate discoverable login: %v\n", err)
-			return ctx.JSON(http.StatusBadRequest, "Failed to validate discoverable login")
+		if !credential.Authenticator.CloneWarning || current.Authenticator.CloneWarning {
+			return nil
 		}
-
-		return ctx.JSON(http.StatusOK, finishLoginResponse{UserID: userID})
-	}
+		return enqueueWebhookEvent(c, tx, webhookEventPasskeyCloneWarning, newWebhookPasskeyData(stored, "signature counter did not increase"))
+	})
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 環境変数から設定値を取得する。設定されていない場合はデフォルト値を返す。
+func getEnv(key, defaultValue string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+// 環境変数から、文字列以外の設定値を読み込む。
+//
+// 設定されていない場合はデフォルト値を使う。設定されているが解釈できない場合は、
+// 誤った設定のまま気付かずに動かないように、すべてのエラーを記録しておき err で返す。
+type envReader struct {
+	errs []error
+}
+
+func (r *envReader) fail(key, value string, err error) {
+	r.errs = append(r.errs, fmt.Errorf("Invalid %s=%q: %w", key, value, err))
+}
+
+// 読み込み中に見つかった、解釈できない設定値のエラー
+func (r *envReader) err() error {
+	return errors.Join(r.errs...)
+}
+
+// 環境変数から時間を取得する。 time.ParseDuration で解釈する。
+func (r *envReader) getDuration(key string, defaultValue time.Duration) time.Duration {
+	v := getEnv(key, "")
+	if v == "" {
+		return defaultValue
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		r.fail(key, v, err)
+		return defaultValue
+	}
+	return d
+}
+
+// 環境変数から整数を取得する。
+func (r *envReader) getInt(key string, defaultValue int) int {
+	v := getEnv(key, "")
+	if v == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		r.fail(key, v, err)
+		return defaultValue
+	}
+	return n
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/daikideal/go-passkey-demo/passkey"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// CSRF対策。
+//
+// フロントエンドは別オリジンから credentials: "include" でAPIを呼び出しているので、
+// Cookieで認証しているリクエストのうち、状態を変更するもの(GET・HEAD・OPTIONS以外)を対象に以下を確認する。
+//
+//   - Sec-Fetch-Site と Origin ヘッダーで、許可したオリジン以外からのリクエストを拒否する
+//   - Cookieとヘッダーで同じトークンを送ってもらう(ダブルサブミット)
+//
+// Cookieを送っていないリクエスト(トークンモードや管理者APIのBearerトークン、OAuthのクライアント)は、
+// 攻撃者がブラウザのCookieを悪用できないので対象外にする。
+
+const (
+	csrfCookieName  = "_csrf"
+	csrfHeaderName  = "X-CSRF-Token"
+	csrfContextKey  = "csrf"
+	csrfTokenLength = 32
+)
+
+// リクエストに、認証に使うCookieが含まれているかどうか。
+func hasCredentialCookie(ctx echo.Context, cookies passkey.CookieFactory) bool {
+	for _, name := range []string{loginSessionCookieName, passkey.RegistrationCookieName, passkey.AuthenticationCookieName} {
+		if _, err := cookies.Get(ctx.Request(), name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// CSRF対策の対象外にするリクエストか。安全なメソッドのリクエストは、トークンを発行するために対象に含める。
+func skipCSRF(cookies passkey.CookieFactory) middleware.Skipper {
+	return func(ctx echo.Context) bool {
+		return !isSafeMethod(ctx.Request().Method) && !hasCredentialCookie(ctx, cookies)
+	}
+}
+
+// 状態を変更するリクエストが、許可したオリジンから送られたものか確認する。
+//
+// Sec-Fetch-Site が cross-site の場合は拒否する。ポート違いのフロントエンドは same-site になる。
+// Origin ヘッダーがある場合は、許可したオリジンかリクエストのテナントのオリジン、API自身のオリジンであることを確認する。
+func checkRequestOrigin(allowedOrigins []string, cookies passkey.CookieFactory) echo.MiddlewareFunc {
+	skip := skipCSRF(cookies)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if isSafeMethod(ctx.Request().Method) || skip(ctx) {
+				return next(ctx)
+			}
+
+			if ctx.Request().Header.Get("Sec-Fetch-Site") == "cross-site" {
+				ctx.Logger().Warnf("Rejected cross-site request: %s %s\n", ctx.Request().Method, ctx.Request().URL.Path)
+				return ctx.JSON(http.StatusForbidden, "Cross-site request is not allowed")
+			}
+
+			if origin := ctx.Request().Header.Get(echo.HeaderOrigin); origin != "" {
+				self := (&url.URL{Scheme: ctx.Scheme(), Host: ctx.Request().Host}).String()
+				if origin != self && !slices.Contains(allowedOrigins, origin) && !tenantAllowsOrigin(ctx, origin) {
+					ctx.Logger().Warnf("Rejected request from origin %s: %s %s\n", origin, ctx.Request().Method, ctx.Request().URL.Path)
+					return ctx.JSON(http.StatusForbidden, "Origin is not allowed")
+				}
+			}
+
+			return next(ctx)
+		}
+	}
+}
+
+// リクエストのテナントのオリジンかどうか。ヘルスチェックなど、テナントを特定しないリクエストの場合は false を返す。
+func tenantAllowsOrigin(ctx echo.Context, origin string) bool {
+	tenant, ok := tenantFromContext(ctx)
+	if !ok {
+		return false
+	}
+	return slices.Contains(tenant.origins(), origin)
+}
+
+// ダブルサブミットのCSRFトークンを確認する。
+// トークンは GET /csrf で取得し、 X-CSRF-Token ヘッダーで送ってもらう。
+func csrfProtection(cookies passkey.CookieFactory) echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper:        skipCSRF(cookies),
+		TokenLength:    csrfTokenLength,
+		TokenLookup:    "header:" + csrfHeaderName,
+		ContextKey:     csrfContextKey,
+		CookieName:     cookies.Name(csrfCookieName),
+		CookiePath:     "/",
+		CookieHTTPOnly: true,
+		CookieSecure:   cookies.Secure(),
+		CookieSameSite: http.SameSiteLaxMode,
+		ErrorHandler: func(err error, ctx echo.Context) error {
+			ctx.Logger().Warnf("Invalid csrf token: %v\n", err)
+			return ctx.JSON(http.StatusForbidden, "Invalid CSRF token")
+		},
+	})
+}
+
+type csrfTokenResponse struct {
+	CSRFToken string `json:"csrf_token"`
+}
+
+// CSRFトークンを返す。Cookieにも同じトークンが設定される。
+func getCSRFToken() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		token, _ := ctx.Get(csrfContextKey).(string)
+		return ctx.JSON(http.StatusOK, csrfTokenResponse{CSRFToken: token})
+	}
+}
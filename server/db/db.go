@@ -3,40 +3,38 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"os"
 
 	_ "github.com/lib/pq"
 	"github.com/uptrace/bun"
 	"github.com/uptrace/bun/dialect/pgdialect"
 )
 
-var (
-	// TODO: 環境変数から取得するように変更
-	dsn = fmt.Sprintf(
-		"host=%s port=%d dbname=%s user=%s password='%s' sslmode=disable search_path=%s",
-		"postgres",
-		5432,
-		"mydb",
-		"myuser",
-		"mypassword",
-		"myschema",
-	)
-
-	db *bun.DB
+// DATABASE_URL が設定されていない場合の接続先。docker compose の postgres に接続する。
+var defaultDSN = fmt.Sprintf(
+	"host=%s port=%d dbname=%s user=%s password='%s' sslmode=disable search_path=%s",
+	"postgres",
+	5432,
+	"mydb",
+	"myuser",
+	"mypassword",
+	"myschema",
 )
 
-func init() {
-	initDB()
-}
-
-func GetDB() *bun.DB {
-	return db
+// 接続先を環境変数 DATABASE_URL から取得する。
+func DSN() string {
+	if v := os.Getenv("DATABASE_URL"); v != "" {
+		return v
+	}
+	return defaultDSN
 }
 
-func initDB() {
+// DBを開く。実際に接続するのは最初のクエリを実行する時なので、接続できるかは Ping で確認する。
+func Open(dsn string) (*bun.DB, error) {
 	sqldb, err := sql.Open("postgres", dsn)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("Failed to open database: %w", err)
 	}
 
-	db = bun.NewDB(sqldb, pgdialect.New())
+	return bun.NewDB(sqldb, pgdialect.New()), nil
 }
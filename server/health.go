@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/uptrace/bun"
+)
+
+// ヘルスチェックと、起動・停止の処理。
+//
+//   - GET /healthz: プロセスが動いているか(liveness)。依存先は確認しない
+//   - GET /readyz: リクエストを受け付けられるか(readiness)。PostgresとRedisに接続できるかを確認する
+//
+// 停止する際は、先に /readyz を 503 にしてロードバランサーから外れるようにしてから、処理中のリクエストを待つ。
+
+// ヘルスチェックの各確認のタイムアウト
+const healthCheckTimeout = 2 * time.Second
+
+// ヘルスチェックなど、アクセスログやトレースに記録しないパス
+var probePaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+func isProbePath(path string) bool {
+	return probePaths[path]
+}
+
+type dependencyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+func newDependencyChecks(db *bun.DB, store *redis.Client) []dependencyCheck {
+	return []dependencyCheck{
+		{name: "postgres", check: db.PingContext},
+		{name: "redis", check: func(ctx context.Context) error { return store.Ping(ctx).Err() }},
+	}
+}
+
+// すべての依存先を並行して確認し、依存先ごとのエラーを返す。
+func runDependencyChecks(ctx context.Context, checks []dependencyCheck) map[string]error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]error, len(checks))
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.check(ctx)
+			mu.Lock()
+			results[c.name] = err
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// 起動時に、依存先に接続できるまで待つ。間隔を倍にしながら attempts 回まで試す。
+func waitForDependencies(ctx context.Context, logger echo.Logger, checks []dependencyCheck, attempts int, interval time.Duration) error {
+	const maxInterval = 30 * time.Second
+
+	for attempt := 1; ; attempt++ {
+		var errs []error
+		for name, err := range runDependencyChecks(ctx, checks) {
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+		if len(errs) == 0 {
+			return nil
+		}
+
+		err := errors.Join(errs...)
+		if attempt >= attempts {
+			return fmt.Errorf("dependencies are not ready after %d attempts: %w", attempts, err)
+		}
+		logger.Warnf("Dependencies are not ready (attempt %d/%d), retrying in %s: %v\n", attempt, attempts, interval, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		interval = min(interval*2, maxInterval)
+	}
+}
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func healthz() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, healthResponse{Status: "ok"})
+	}
+}
+
+// draining が true の間は、依存先に関係なく 503 を返す。
+func readyz(checks []dependencyCheck, draining *atomic.Bool) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if draining.Load() {
+			return ctx.JSON(http.StatusServiceUnavailable, healthResponse{Status: "shutting down"})
+		}
+
+		res := healthResponse{Status: "ok", Checks: map[string]string{}}
+		for name, err := range runDependencyChecks(ctx.Request().Context(), checks) {
+			if err != nil {
+				ctx.Logger().Warnf("Readiness check %s failed: %v\n", name, err)
+				res.Status = "unavailable"
+				res.Checks[name] = "unavailable"
+				continue
+			}
+			res.Checks[name] = "ok"
+		}
+
+		if res.Status != "ok" {
+			return ctx.JSON(http.StatusServiceUnavailable, res)
+		}
+		return ctx.JSON(http.StatusOK, res)
+	}
+}
+
+// バックグラウンドのジョブが終わるのを、ctx の期限まで待つ。
+func waitGroupWithContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
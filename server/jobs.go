@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+)
+
+// 定期的に実行する不要データの削除ジョブ。
+//
+// run は対象のデータを削除し、削除した件数を返す。
+// ジョブはロックを取得したトランザクション内で実行されるので、 tx を使って削除すること。
+type cleanupJob struct {
+	name string
+	run  func(ctx context.Context, tx bun.Tx, now time.Time) (int64, error)
+}
+
+// 削除ジョブの設定。期間はいずれも、この期間より古いデータを削除するという意味。
+type cleanupConfig struct {
+	// 認証器の登録を一度も完了していないユーザーを削除するまでの猶予期間
+	AbandonedUserGrace time.Duration
+	// 削除予定(pending_deletion)になったユーザーを削除するまでの猶予期間
+	AccountDeletionGrace time.Duration
+	// 無効化された認証器を削除するまでの期間
+	DisabledCredentialRetention time.Duration
+	// 監査ログの保持期間
+	AuthEventRetention time.Duration
+	// 退役したOIDCの署名鍵をJWKSで公開し続ける期間
+	OIDCKeyRetention time.Duration
+	// 有効期限を過ぎたリフレッシュトークンを残しておく期間
+	RefreshTokenRetention time.Duration
+}
+
+func loadCleanupConfig(env *envReader, oidc oidcConfig) cleanupConfig {
+	return cleanupConfig{
+		AbandonedUserGrace:          env.getDuration("ABANDONED_USER_GRACE", 24*time.Hour),
+		AccountDeletionGrace:        env.getDuration("ACCOUNT_DELETION_GRACE", 30*24*time.Hour),
+		DisabledCredentialRetention: env.getDuration("DISABLED_CREDENTIAL_RETENTION", 90*24*time.Hour),
+		AuthEventRetention:          env.getDuration("AUTH_EVENT_RETENTION", 365*24*time.Hour),
+		OIDCKeyRetention:            oidc.KeyRetention,
+		RefreshTokenRetention:       env.getDuration("REFRESH_TOKEN_RETENTION", 7*24*time.Hour),
+	}
+}
+
+func newCleanupJobs(cfg cleanupConfig) []cleanupJob {
+	return []cleanupJob{
+		{
+			name: "abandoned_users",
+			run: func(ctx context.Context, tx bun.Tx, now time.Time) (int64, error) {
+				return purgeAbandonedUsers(ctx, tx, now.Add(-cfg.AbandonedUserGrace))
+			},
+		},
+		{
+			name: "pending_deletion_users",
+			run: func(ctx context.Context, tx bun.Tx, now time.Time) (int64, error) {
+				return purgePendingDeletionUsers(ctx, tx, now.Add(-cfg.AccountDeletionGrace))
+			},
+		},
+		{
+			name: "disabled_credentials",
+			run: func(ctx context.Context, tx bun.Tx, now time.Time) (int64, error) {
+				return expireDisabledCredentials(ctx, tx, now.Add(-cfg.DisabledCredentialRetention))
+			},
+		},
+		{
+			name: "auth_events",
+			run: func(ctx context.Context, tx bun.Tx, now time.Time) (int64, error) {
+				return pruneAuthEvents(ctx, tx, now.Add(-cfg.AuthEventRetention))
+			},
+		},
+		{
+			name: "oidc_signing_keys",
+			run: func(ctx context.Context, tx bun.Tx, now time.Time) (int64, error) {
+				return pruneSigningKeys(ctx, tx, now.Add(-cfg.OIDCKeyRetention))
+			},
+		},
+		{
+			name: "refresh_tokens",
+			run: func(ctx context.Context, tx bun.Tx, now time.Time) (int64, error) {
+				return pruneRefreshTokens(ctx, tx, now.Add(-cfg.RefreshTokenRetention))
+			},
+		},
+	}
+}
+
+// 削除ジョブを定期的に実行する。
+//
+// サーバーを複数台で動かしても同じジョブが同時に実行されないように、
+// ジョブごとにPostgreSQLのアドバイザリロックを取得し、取得できなかった場合はスキップする。
+func startCleanupJobs(ctx context.Context, wg *sync.WaitGroup, logger echo.Logger, db *bun.DB, jobs []cleanupJob, interval time.Duration) {
+	runAll := func() {
+		for _, job := range jobs {
+			n, ran, err := runCleanupJob(ctx, db, job)
+			if err != nil {
+				logger.Errorf("Failed to run cleanup job %s: %v\n", job.name, err)
+				continue
+			}
+			if !ran {
+				logger.Debugf("Cleanup job %s is running on another server\n", job.name)
+				continue
+			}
+			if n > 0 {
+				logger.Infof("Cleanup job %s deleted %d rows\n", job.name, n)
+			}
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runAll()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				runAll()
+			}
+		}
+	}()
+}
+
+// ロックを取得してジョブを実行する。ロックを取得できなかった場合は ran が false になる。
+//
+// pg_try_advisory_xact_lock のロックはトランザクションの終了時に自動で解放されるので、
+// ジョブが途中で失敗してもロックが残り続けることはない。
+func runCleanupJob(ctx context.Context, db bun.IDB, job cleanupJob) (n int64, ran bool, err error) {
+	err = db.RunInTx(ctx, nil, func(c context.Context, tx bun.Tx) error {
+		var locked bool
+		if err := tx.NewRaw("SELECT pg_try_advisory_xact_lock(hashtext(?))", "cleanup:"+job.name).Scan(c, &locked); err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+		ran = true
+
+		n, err = job.run(c, tx, time.Now())
+		return err
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	return n, ran, nil
+}
+
+// 認証器の登録を一度も完了しないまま放置されたユーザーを削除する。
+//
+// 認証器をすべて削除したユーザーは、登録を完了したことがあるので対象外にする。
+// 有効なユーザー以外(無効化・ロック中・削除予定)は、管理者の操作や削除の猶予期間に従うため対象外にする。
+func purgeAbandonedUsers(ctx context.Context, tx bun.Tx, before time.Time) (int64, error) {
+	res, err := tx.NewDelete().
+		Model((*User)(nil)).
+		Where("created_at < ?", before).
+		Where("registered_at IS NULL").
+		Where("status = ?", userStatusActive).
+		Where("NOT EXISTS (SELECT 1 FROM webauthn_credentials AS wc WHERE wc.user_id = ?TableAlias.id)").
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// 削除予定になってから猶予期間を過ぎたユーザーを、認証器とともに削除する。
+// 監査ログは保持期間が過ぎるまで残す。
+func purgePendingDeletionUsers(ctx context.Context, tx bun.Tx, before time.Time) (int64, error) {
+	var userIDs []string
+	err := tx.NewSelect().
+		Model((*User)(nil)).
+		Column("id").
+		Where("status = ?", userStatusPendingDeletion).
+		Where("status_changed_at < ?", before).
+		// 他のリクエストで状態が変更されないようにロックしておく
+		For("UPDATE").
+		Scan(ctx, &userIDs)
+	if err != nil || len(userIDs) == 0 {
+		return 0, err
+	}
+
+	var deleted []WebauthnCredentials
+	_, err = tx.NewDelete().
+		Model(&deleted).
+		Where("user_id IN (?)", bun.In(userIDs)).
+		Returning("*").
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for i := range deleted {
+		if err := enqueueWebhookEvent(ctx, tx, webhookEventPasskeyRemoved, newWebhookPasskeyData(&deleted[i], "account deleted")); err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := tx.NewDelete().
+		Model((*User)(nil)).
+		Where("id IN (?)", bun.In(userIDs)).
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// 無効化されてから一定期間が過ぎた認証器を削除する。
+func expireDisabledCredentials(ctx context.Context, tx bun.Tx, before time.Time) (int64, error) {
+	var deleted []WebauthnCredentials
+	_, err := tx.NewDelete().
+		Model(&deleted).
+		Where("disabled_at < ?", before).
+		Returning("*").
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range deleted {
+		if err := enqueueWebhookEvent(ctx, tx, webhookEventPasskeyRemoved, newWebhookPasskeyData(&deleted[i], "expired after being disabled")); err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(deleted)), nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// log/slog による構造化ログ。
+//
+// ハンドラーは今まで通り ctx.Logger() でログを出力し、 echo.Logger を slog で実装することで構造化する。
+// リクエストごとにリクエストIDやトレースIDを付けたロガーを ctx.SetLogger で設定し、
+// ハンドラーは addLogAttrs でユーザーIDなどの項目を追加する。
+//
+// ログの形式とレベルは LOG_FORMAT(json, text)と LOG_LEVEL(debug, info, warn, error)で指定する。
+
+const redactedValue = "[REDACTED]"
+
+// ログに値を出力しない項目
+var redactedLogKeys = map[string]bool{
+	"public_key":         true,
+	"attestation_object": true,
+	"client_data_json":   true,
+	"authenticator_data": true,
+	"signature":          true,
+	"body":               true,
+}
+
+// ログにはハッシュだけを出力する項目
+var hashedLogKeys = map[string]bool{
+	"credential_id": true,
+}
+
+// ログには先頭の1文字だけを出力する項目
+var maskedLogKeys = map[string]bool{
+	"username":  true,
+	"user_name": true,
+}
+
+// 認証器のクレデンシャルIDを、ログで突き合わせられるようにハッシュ化する。
+func credentialIDHash(credentialID []byte) string {
+	sum := sha256.Sum256(credentialID)
+	return hex.EncodeToString(sum[:8])
+}
+
+func maskLogValue(v string) string {
+	if v == "" {
+		return ""
+	}
+	r, _ := utf8.DecodeRuneInString(v)
+	return string(r) + "***"
+}
+
+// 個人情報や認証器の情報をログに出力しないようにする。
+func redactLogAttr(_ []string, a slog.Attr) slog.Attr {
+	switch {
+	case redactedLogKeys[a.Key]:
+		return slog.String(a.Key, redactedValue)
+	case hashedLogKeys[a.Key]:
+		var b []byte
+		if v, ok := a.Value.Any().([]byte); ok {
+			b = v
+		} else {
+			b = []byte(a.Value.String())
+		}
+		return slog.String(a.Key+"_hash", credentialIDHash(b))
+	case maskedLogKeys[a.Key]:
+		return slog.String(a.Key, maskLogValue(a.Value.String()))
+	}
+	return a
+}
+
+type logConfig struct {
+	Format string
+	Level  *slog.LevelVar
+}
+
+func loadLogConfig() logConfig {
+	level := &slog.LevelVar{}
+	if err := level.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		level.Set(slog.LevelInfo)
+	}
+
+	return logConfig{
+		Format: getEnv("LOG_FORMAT", "json"),
+		Level:  level,
+	}
+}
+
+func (cfg logConfig) newHandler(w io.Writer) slog.Handler {
+	opts := &slog.HandlerOptions{Level: cfg.Level, ReplaceAttr: redactLogAttr}
+	if cfg.Format == "text" {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+// slog で実装した echo.Logger 。
+type slogLogger struct {
+	cfg    logConfig
+	output io.Writer
+	prefix string
+	attrs  []any
+	logger *slog.Logger
+}
+
+var _ echo.Logger = (*slogLogger)(nil)
+
+func newSlogLogger(cfg logConfig, w io.Writer) *slogLogger {
+	return &slogLogger{cfg: cfg, output: w, logger: slog.New(cfg.newHandler(w))}
+}
+
+// 項目を追加したロガーを返す。
+func (l *slogLogger) with(attrs ...any) *slogLogger {
+	return &slogLogger{
+		cfg:    l.cfg,
+		output: l.output,
+		prefix: l.prefix,
+		attrs:  append(append([]any{}, l.attrs...), attrs...),
+		logger: l.logger.With(attrs...),
+	}
+}
+
+// passkey パッケージから、リクエストのロガーに項目を追加できるようにする。
+func (l *slogLogger) With(attrs ...any) echo.Logger {
+	return l.with(attrs...)
+}
+
+func (l *slogLogger) Output() io.Writer { return l.output }
+
+func (l *slogLogger) SetOutput(w io.Writer) {
+	l.output = w
+	l.logger = slog.New(l.cfg.newHandler(w)).With(l.attrs...)
+}
+
+func (l *slogLogger) Prefix() string { return l.prefix }
+
+func (l *slogLogger) SetPrefix(p string) { l.prefix = p }
+
+func (l *slogLogger) Level() log.Lvl {
+	switch level := l.cfg.Level.Level(); {
+	case level <= slog.LevelDebug:
+		return log.DEBUG
+	case level <= slog.LevelInfo:
+		return log.INFO
+	case level <= slog.LevelWarn:
+		return log.WARN
+	default:
+		return log.ERROR
+	}
+}
+
+func (l *slogLogger) SetLevel(v log.Lvl) {
+	switch v {
+	case log.DEBUG:
+		l.cfg.Level.Set(slog.LevelDebug)
+	case log.INFO:
+		l.cfg.Level.Set(slog.LevelInfo)
+	case log.WARN:
+		l.cfg.Level.Set(slog.LevelWarn)
+	default:
+		l.cfg.Level.Set(slog.LevelError)
+	}
+}
+
+// 出力の形式は slog のハンドラーで決まるので、ヘッダーの指定は無視する。
+func (l *slogLogger) SetHeader(string) {}
+
+func (l *slogLogger) log(level slog.Level, msg string) {
+	// Echo のロガーに合わせて末尾に改行を付けている呼び出しが多いので取り除く
+	l.logger.Log(context.Background(), level, strings.TrimSuffix(msg, "\n"))
+}
+
+func (l *slogLogger) logj(level slog.Level, j log.JSON) {
+	attrs := make([]any, 0, len(j)*2)
+	for k, v := range j {
+		attrs = append(attrs, k, v)
+	}
+	l.logger.Log(context.Background(), level, "", attrs...)
+}
+
+func (l *slogLogger) Print(i ...interface{})            { l.log(slog.LevelInfo, fmt.Sprint(i...)) }
+func (l *slogLogger) Printf(f string, a ...interface{}) { l.log(slog.LevelInfo, fmt.Sprintf(f, a...)) }
+func (l *slogLogger) Printj(j log.JSON)                 { l.logj(slog.LevelInfo, j) }
+func (l *slogLogger) Debug(i ...interface{})            { l.log(slog.LevelDebug, fmt.Sprint(i...)) }
+func (l *slogLogger) Debugf(f string, a ...interface{}) { l.log(slog.LevelDebug, fmt.Sprintf(f, a...)) }
+func (l *slogLogger) Debugj(j log.JSON)                 { l.logj(slog.LevelDebug, j) }
+func (l *slogLogger) Info(i ...interface{})             { l.log(slog.LevelInfo, fmt.Sprint(i...)) }
+func (l *slogLogger) Infof(f string, a ...interface{})  { l.log(slog.LevelInfo, fmt.Sprintf(f, a...)) }
+func (l *slogLogger) Infoj(j log.JSON)                  { l.logj(slog.LevelInfo, j) }
+func (l *slogLogger) Warn(i ...interface{})             { l.log(slog.LevelWarn, fmt.Sprint(i...)) }
+func (l *slogLogger) Warnf(f string, a ...interface{})  { l.log(slog.LevelWarn, fmt.Sprintf(f, a...)) }
+func (l *slogLogger) Warnj(j log.JSON)                  { l.logj(slog.LevelWarn, j) }
+func (l *slogLogger) Error(i ...interface{})            { l.log(slog.LevelError, fmt.Sprint(i...)) }
+func (l *slogLogger) Errorf(f string, a ...interface{}) { l.log(slog.LevelError, fmt.Sprintf(f, a...)) }
+func (l *slogLogger) Errorj(j log.JSON)                 { l.logj(slog.LevelError, j) }
+
+func (l *slogLogger) Fatal(i ...interface{}) {
+	l.log(slog.LevelError, fmt.Sprint(i...))
+	os.Exit(1)
+}
+
+func (l *slogLogger) Fatalf(f string, a ...interface{}) {
+	l.log(slog.LevelError, fmt.Sprintf(f, a...))
+	os.Exit(1)
+}
+
+func (l *slogLogger) Fatalj(j log.JSON) {
+	l.logj(slog.LevelError, j)
+	os.Exit(1)
+}
+
+func (l *slogLogger) Panic(i ...interface{}) {
+	msg := fmt.Sprint(i...)
+	l.log(slog.LevelError, msg)
+	panic(msg)
+}
+
+func (l *slogLogger) Panicf(f string, a ...interface{}) {
+	msg := fmt.Sprintf(f, a...)
+	l.log(slog.LevelError, msg)
+	panic(msg)
+}
+
+func (l *slogLogger) Panicj(j log.JSON) {
+	l.logj(slog.LevelError, j)
+	panic(j)
+}
+
+// リクエストのロガーに項目を追加する。以降の ctx.Logger() のログに含まれる。
+func addLogAttrs(ctx echo.Context, attrs ...any) {
+	if l, ok := ctx.Logger().(*slogLogger); ok {
+		ctx.SetLogger(l.with(attrs...))
+	}
+}
+
+// リクエストIDを発行する。クライアントやプロキシが X-Request-Id を付けている場合はそれを使う。
+func requestID() echo.MiddlewareFunc {
+	return middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		Generator: func() string {
+			id, _ := random(16)
+			return id
+		},
+	})
+}
+
+// リクエストID・トレースIDなどを付けたロガーを設定し、リクエストの完了時にアクセスログを出力する。
+// ヘルスチェックなどはアクセスログを出力しない。
+// requestID と httpTracing の後に実行する。
+func requestLogging(base *slogLogger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			start := time.Now()
+			req := ctx.Request()
+			if isProbePath(req.URL.Path) {
+				return next(ctx)
+			}
+
+			attrs := []any{
+				slog.String("request_id", ctx.Response().Header().Get(echo.HeaderXRequestID)),
+			}
+			if tenant, ok := tenantFromContext(ctx); ok {
+				attrs = append(attrs, slog.String("tenant_id", tenant.ID))
+			}
+			if sc := trace.SpanContextFromContext(req.Context()); sc.HasTraceID() {
+				attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+			}
+			ctx.SetLogger(base.with(attrs...))
+
+			err := next(ctx)
+			if err != nil {
+				ctx.Error(err)
+			}
+
+			// ハンドラーが追加した項目も含めて出力する
+			logger := base.logger
+			if l, ok := ctx.Logger().(*slogLogger); ok {
+				logger = l.logger
+			}
+			logger.LogAttrs(req.Context(), slog.LevelInfo, "request completed",
+				slog.String("method", req.Method),
+				slog.String("route", ctx.Path()),
+				slog.Int("status", ctx.Response().Status),
+				slog.Duration("latency", time.Since(start)),
+				slog.String("ip", ctx.RealIP()),
+			)
+
+			return nil
+		}
+	}
+}
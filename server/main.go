@@ -1,47 +1,57 @@
 package main
 
 import (
-	"github.com/go-webauthn/webauthn/webauthn"
-	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
-	_ "github.com/lib/pq"
-)
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-var (
-	webAuthn *webauthn.WebAuthn
-	err      error
+	_ "github.com/lib/pq"
 )
 
 func main() {
-	e := echo.New()
-	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins:     []string{"http://localhost:5173"},
-		AllowCredentials: true, // Cookieを取り扱えるようにする
-	}))
-
-	wconfig := &webauthn.Config{
-		RPDisplayName: "go-passkey-demo",
-		RPID:          "localhost",
-		RPOrigins:     []string{"http://localhost:5173"},
+	// SIGINT・SIGTERM を受け取ったら、処理中のリクエストを待ってから停止する
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	// 停止処理中にもう一度シグナルを受け取った場合は、すぐに終了する
+	context.AfterFunc(ctx, stop)
+
+	// 構造化ログ。Echo のロガーも slog で出力する。
+	logger := newSlogLogger(loadLogConfig(), os.Stdout)
+	slog.SetDefault(logger.logger)
+
+	// 解釈できない設定値がある場合は起動しない
+	cfg, err := loadAppConfig()
+	if err != nil {
+		logger.Fatal(err)
 	}
 
-	webAuthn, err = webauthn.New(wconfig)
+	// トレーシング
+	shutdownTracer, err := initTracer(ctx, cfg.ServiceName)
 	if err != nil {
-		panic(err)
+		logger.Fatal(err)
 	}
 
-	e.POST("/users", createUser())
-	e.GET("/users", getUsers())
-	e.GET("/users/:id", getUser())
-	// パスキー管理
-	e.GET("/users/:id/public_keys", listPublicKeysByUser())
-	e.DELETE("/users/:user_id/public_keys/:public_key_id", deletePublicKey())
-	// 認証機の登録
-	e.POST("/registration/options", beginRegistration(webAuthn))
-	e.POST("/registration/verifications", finishRegistration(webAuthn))
-	// 認証
-	e.POST("/authentication/options", beginLogin(webAuthn))
-	e.POST("/authentication/verifications", finishLogin(webAuthn))
-
-	e.Logger.Fatal(e.Start(":8080"))
+	app, err := newApp(cfg, logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	runErr := app.Run(ctx)
+	if runErr != nil {
+		logger.Error(runErr)
+	}
+
+	// 残っているスパンを送信する
+	tracerCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracer(tracerCtx); err != nil {
+		logger.Errorf("Failed to shutdown tracer: %v\n", err)
+	}
+
+	if runErr != nil {
+		cancel()
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"github.com/uptrace/bun"
+)
+
+// Prometheusのメトリクス。メトリクス用のアドレスの GET /metrics で公開する。
+//
+// ラベルの値の種類が増えるとPrometheusの負荷が高くなるので、ユーザーIDやエラーメッセージなどはラベルにしない。
+// メトリクスは App ごとに作成して、App のレジストリに登録する。同じプロセスで複数の App を作成しても、値が混ざらない。
+type metrics struct {
+	registry *prometheus.Registry
+
+	httpRequestsTotal   *prometheus.CounterVec
+	httpRequestDuration *prometheus.HistogramVec
+
+	ceremoniesTotal  *prometheus.CounterVec
+	ceremonyDuration *prometheus.HistogramVec
+
+	sessionStoreDuration *prometheus.HistogramVec
+	sessionStoreErrors   *prometheus.CounterVec
+
+	dbQueryDuration *prometheus.HistogramVec
+	dbQueryErrors   *prometheus.CounterVec
+}
+
+// メトリクスとレジストリを作成する。ログインセッションの数は client から数える。
+func newMetrics(client *redis.Client) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+
+		httpRequestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of HTTP requests.",
+		}, []string{"method", "route", "status"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Latency of HTTP requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+
+		ceremoniesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "passkey_ceremonies_total",
+			Help: "Number of registration and login ceremonies by phase and result.",
+		}, []string{"ceremony", "phase", "result", "reason"}),
+		ceremonyDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "passkey_ceremony_duration_seconds",
+			Help:    "Latency of registration and login ceremonies.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"ceremony", "phase"}),
+
+		sessionStoreDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "passkey_session_store_duration_seconds",
+			Help:    "Latency of session store (Redis) commands.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"operation"}),
+		sessionStoreErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "passkey_session_store_errors_total",
+			Help: "Number of failed session store (Redis) commands.",
+		}, []string{"operation"}),
+
+		dbQueryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "passkey_db_query_duration_seconds",
+			Help:    "Latency of database queries.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"operation"}),
+		dbQueryErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "passkey_db_query_errors_total",
+			Help: "Number of failed database queries.",
+		}, []string{"operation"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequestsTotal,
+		m.httpRequestDuration,
+		m.ceremoniesTotal,
+		m.ceremonyDuration,
+		m.sessionStoreDuration,
+		m.sessionStoreErrors,
+		m.dbQueryDuration,
+		m.dbQueryErrors,
+		newActiveSessionsGauge(client),
+	)
+	return m
+}
+
+// メトリクスだけを公開するサーバーを作成する。
+// 公開のアドレスで提供すると誰でもリクエスト数やエラーの傾向を取得できてしまうため、内部のネットワークからだけ接続できるアドレスで待ち受ける。
+func newMetricsServer(addr string, registry *prometheus.Registry) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
+// HTTPリクエストの数とレイテンシを記録する。
+// ラベルには、パスそのものではなくルーティングのパターン(/users/:id など)を使う。
+func httpMetrics(m *metrics) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			start := time.Now()
+			err := next(ctx)
+			// エラーのレスポンスのステータスコードを記録するために、ここでレスポンスを書き込む
+			if err != nil {
+				ctx.Error(err)
+			}
+
+			route := ctx.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+			method := ctx.Request().Method
+			m.httpRequestsTotal.WithLabelValues(method, route, strconv.Itoa(ctx.Response().Status)).Inc()
+			m.httpRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+
+			return nil
+		}
+	}
+}
+
+// ハンドラーが記録した、認証器の登録・認証の失敗理由
+const ceremonyFailureReasonContextKey = "ceremony_failure_reason"
+
+// 監査ログの失敗理由を、メトリクスのラベルにできる種類に絞る。
+// 想定していない理由は、検証の失敗としてまとめる。
+func ceremonyFailureReason(reason string) string {
+	switch reason {
+	case "session not found", "user not found", "user name is already taken", "failed to save credential":
+		return strings.ReplaceAll(reason, " ", "_")
+	case errUserLocked.Error(), errUserDisabled.Error(), errUserPendingDeletion.Error():
+		return "inactive"
+	}
+	return "verification_failed"
+}
+
+// 認証器の登録・認証の結果とレイテンシを記録する。
+// ステータスコードが4xx・5xxの場合を失敗とし、ハンドラーが失敗理由を記録していない場合はステータスコードを理由にする。
+func ceremonyMetrics(m *metrics, ceremony, phase string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			start := time.Now()
+			err := next(ctx)
+			if err != nil {
+				ctx.Error(err)
+			}
+
+			result, reason := "success", ""
+			if status := ctx.Response().Status; status >= http.StatusBadRequest {
+				result = "failure"
+				reason, _ = ctx.Get(ceremonyFailureReasonContextKey).(string)
+				if reason == "" {
+					reason = fmt.Sprintf("http_%d", status)
+				}
+			}
+			m.ceremoniesTotal.WithLabelValues(ceremony, phase, result, reason).Inc()
+			m.ceremonyDuration.WithLabelValues(ceremony, phase).Observe(time.Since(start).Seconds())
+
+			return nil
+		}
+	}
+}
+
+// セッションストア(Redis)のコマンドのレイテンシとエラーを記録する。
+type sessionStoreMetricsHook struct {
+	metrics *metrics
+}
+
+func (sessionStoreMetricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h sessionStoreMetricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		h.observe(cmd.Name(), start, err)
+		return err
+	}
+}
+
+func (h sessionStoreMetricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		h.observe("pipeline", start, err)
+		return err
+	}
+}
+
+func (h sessionStoreMetricsHook) observe(operation string, start time.Time, err error) {
+	h.metrics.sessionStoreDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	// キーが存在しないのはエラーとして数えない
+	if err != nil && !errors.Is(err, redis.Nil) {
+		h.metrics.sessionStoreErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// DBのクエリのレイテンシとエラーを記録する。
+type dbMetricsHook struct {
+	metrics *metrics
+}
+
+var _ bun.QueryHook = dbMetricsHook{}
+
+func (dbMetricsHook) BeforeQuery(ctx context.Context, _ *bun.QueryEvent) context.Context {
+	return ctx
+}
+
+func (h dbMetricsHook) AfterQuery(_ context.Context, event *bun.QueryEvent) {
+	operation := event.Operation()
+	h.metrics.dbQueryDuration.WithLabelValues(operation).Observe(time.Since(event.StartTime).Seconds())
+	if event.Err != nil && !errors.Is(event.Err, context.Canceled) {
+		h.metrics.dbQueryErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// 有効なログインセッションの数。
+//
+// Redisのキーを数えるのは重いので、取得した値をしばらくキャッシュする。
+type activeSessionsCollector struct {
+	client *redis.Client
+	ttl    time.Duration
+
+	mu        sync.Mutex
+	value     float64
+	updatedAt time.Time
+}
+
+func (c *activeSessionsCollector) count() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.updatedAt) < c.ttl {
+		return c.value
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var n int
+	iter := c.client.Scan(ctx, 0, loginSessionKeyPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		n++
+	}
+	// 数えられなかった場合は前回の値を返す
+	if err := iter.Err(); err != nil {
+		return c.value
+	}
+
+	c.value = float64(n)
+	c.updatedAt = time.Now()
+	return c.value
+}
+
+func newActiveSessionsGauge(client *redis.Client) prometheus.GaugeFunc {
+	collector := &activeSessionsCollector{client: client, ttl: 30 * time.Second}
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "passkey_active_login_sessions",
+		Help: "Number of active login sessions.",
+	}, collector.count)
+}
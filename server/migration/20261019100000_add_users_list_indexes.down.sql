@@ -0,0 +1,11 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+DROP INDEX IF EXISTS webauthn_credentials_user_id_idx;
+
+--bun:split
+DROP INDEX IF EXISTS users_name_id_idx;
+
+--bun:split
+DROP INDEX IF EXISTS users_created_at_id_idx;
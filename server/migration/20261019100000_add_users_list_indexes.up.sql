@@ -0,0 +1,13 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- GET /users のカーソルページングで使用する (並び替えカラム, id) の複合インデックス
+CREATE INDEX IF NOT EXISTS users_created_at_id_idx ON users (created_at, id);
+
+--bun:split
+-- name_prefix による前方一致検索にも使えるように varchar_pattern_ops を指定する
+CREATE INDEX IF NOT EXISTS users_name_id_idx ON users (name varchar_pattern_ops, id);
+
+--bun:split
+CREATE INDEX IF NOT EXISTS webauthn_credentials_user_id_idx ON webauthn_credentials (user_id);
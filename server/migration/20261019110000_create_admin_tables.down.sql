@@ -0,0 +1,17 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+ALTER TABLE users
+    DROP COLUMN IF EXISTS status_changed_at,
+    DROP COLUMN IF EXISTS status_reason,
+    DROP COLUMN IF EXISTS status;
+
+--bun:split
+DROP TABLE IF EXISTS login_history;
+
+--bun:split
+DROP TABLE IF EXISTS admin_audit_logs;
+
+--bun:split
+DROP TABLE IF EXISTS admins;
@@ -0,0 +1,57 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- 管理者APIの利用者。
+-- トークンはハッシュ化して保存し、平文はCLIで作成したときに一度だけ表示する。
+CREATE TABLE
+    IF NOT EXISTS admins (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+        name VARCHAR(255) NOT NULL UNIQUE,
+        role VARCHAR(32) NOT NULL CHECK (role IN ('viewer', 'operator')),
+        token_hash VARCHAR(64) NOT NULL UNIQUE,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW (),
+        updated_at TIMESTAMP NOT NULL DEFAULT NOW ()
+    );
+
+--bun:split
+-- 管理者APIで行われた操作の記録
+CREATE TABLE
+    IF NOT EXISTS admin_audit_logs (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+        admin_id UUID NOT NULL,
+        action VARCHAR(255) NOT NULL,
+        target_user_id UUID,
+        target_credential_id UUID,
+        status_code INTEGER NOT NULL,
+        detail JSONB,
+        ip VARCHAR(255) NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW ()
+    );
+
+--bun:split
+CREATE INDEX IF NOT EXISTS admin_audit_logs_admin_id_created_at_idx ON admin_audit_logs (admin_id, created_at);
+
+--bun:split
+-- ログインの履歴。管理者APIから参照する。
+CREATE TABLE
+    IF NOT EXISTS login_history (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+        user_id UUID NOT NULL,
+        credential_id UUID,
+        succeeded BOOLEAN NOT NULL,
+        reason TEXT,
+        ip VARCHAR(255) NOT NULL,
+        user_agent TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW ()
+    );
+
+--bun:split
+CREATE INDEX IF NOT EXISTS login_history_user_id_created_at_idx ON login_history (user_id, created_at);
+
+--bun:split
+-- 管理者がアカウントを無効化できるように、ユーザーに状態を持たせる
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS status VARCHAR(32) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'disabled')),
+    ADD COLUMN IF NOT EXISTS status_reason TEXT,
+    ADD COLUMN IF NOT EXISTS status_changed_at TIMESTAMP;
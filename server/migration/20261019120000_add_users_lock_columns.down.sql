@@ -0,0 +1,19 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+ALTER TABLE users
+    DROP COLUMN IF EXISTS last_failed_login_at,
+    DROP COLUMN IF EXISTS failed_login_count,
+    DROP COLUMN IF EXISTS locked_until;
+
+--bun:split
+UPDATE users SET status = 'active' WHERE status = 'locked';
+
+--bun:split
+UPDATE users SET status = 'disabled' WHERE status = 'pending_deletion';
+
+--bun:split
+ALTER TABLE users
+    DROP CONSTRAINT IF EXISTS users_status_check,
+    ADD CONSTRAINT users_status_check CHECK (status IN ('active', 'disabled'));
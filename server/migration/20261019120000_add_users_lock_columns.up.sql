@@ -0,0 +1,14 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+ALTER TABLE users
+    DROP CONSTRAINT IF EXISTS users_status_check,
+    ADD CONSTRAINT users_status_check CHECK (status IN ('active', 'locked', 'disabled', 'pending_deletion'));
+
+--bun:split
+-- ログインの失敗が続いた場合の一時的なロックに使用する
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS failed_login_count INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS last_failed_login_at TIMESTAMP;
@@ -0,0 +1,7 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+ALTER TABLE webauthn_credentials
+    DROP COLUMN IF EXISTS revoked_reason,
+    DROP COLUMN IF EXISTS disabled_at;
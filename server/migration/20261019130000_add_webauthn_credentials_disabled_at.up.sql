@@ -0,0 +1,7 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+ALTER TABLE webauthn_credentials
+    ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS revoked_reason TEXT;
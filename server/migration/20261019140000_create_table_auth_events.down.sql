@@ -0,0 +1,37 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+CREATE TABLE
+    IF NOT EXISTS login_history (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+        user_id UUID NOT NULL,
+        credential_id UUID,
+        succeeded BOOLEAN NOT NULL,
+        reason TEXT,
+        ip VARCHAR(255) NOT NULL,
+        user_agent TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW ()
+    );
+
+--bun:split
+CREATE INDEX IF NOT EXISTS login_history_user_id_created_at_idx ON login_history (user_id, created_at);
+
+--bun:split
+INSERT INTO login_history (user_id, credential_id, succeeded, reason, ip, user_agent, created_at)
+SELECT
+    user_id,
+    credential_id,
+    result = 'success',
+    reason,
+    ip,
+    user_agent,
+    created_at
+FROM auth_events
+WHERE event_type = 'login' AND user_id IS NOT NULL;
+
+--bun:split
+DROP TABLE IF EXISTS auth_events;
+
+--bun:split
+DROP FUNCTION IF EXISTS reject_auth_events_update();
@@ -0,0 +1,55 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- 認証や認証器の操作に関する監査ログ。
+-- 追記のみを想定しており、保持期間を過ぎたものを削除する以外は変更しない。
+CREATE TABLE
+    IF NOT EXISTS auth_events (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+        user_id UUID,
+        credential_id UUID,
+        event_type VARCHAR(64) NOT NULL,
+        result VARCHAR(16) NOT NULL CHECK (result IN ('success', 'failure')),
+        reason TEXT,
+        ip VARCHAR(255) NOT NULL,
+        user_agent TEXT NOT NULL,
+        aaguid UUID,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW ()
+    );
+
+--bun:split
+CREATE INDEX IF NOT EXISTS auth_events_user_id_created_at_idx ON auth_events (user_id, created_at, id);
+
+--bun:split
+-- 保持期間を過ぎたイベントの削除に使用する
+CREATE INDEX IF NOT EXISTS auth_events_created_at_idx ON auth_events (created_at);
+
+--bun:split
+CREATE OR REPLACE FUNCTION reject_auth_events_update() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'auth_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+--bun:split
+CREATE TRIGGER auth_events_append_only
+    BEFORE UPDATE ON auth_events
+    FOR EACH ROW EXECUTE FUNCTION reject_auth_events_update();
+
+--bun:split
+-- login_history の内容は auth_events に移行する
+INSERT INTO auth_events (user_id, credential_id, event_type, result, reason, ip, user_agent, created_at)
+SELECT
+    user_id,
+    credential_id,
+    'login',
+    CASE WHEN succeeded THEN 'success' ELSE 'failure' END,
+    reason,
+    ip,
+    user_agent,
+    created_at
+FROM login_history;
+
+--bun:split
+DROP TABLE IF EXISTS login_history;
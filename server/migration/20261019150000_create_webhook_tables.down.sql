@@ -0,0 +1,8 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+DROP TABLE IF EXISTS webhook_outbox;
+
+--bun:split
+DROP TABLE IF EXISTS webhook_endpoints;
@@ -0,0 +1,38 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- Webhookの送信先。
+-- event_types が空の場合は、すべてのイベントを送信する。
+CREATE TABLE
+    IF NOT EXISTS webhook_endpoints (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+        url TEXT NOT NULL,
+        secret VARCHAR(255) NOT NULL,
+        event_types VARCHAR(64) [] NOT NULL DEFAULT '{}',
+        enabled BOOLEAN NOT NULL DEFAULT TRUE,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW (),
+        updated_at TIMESTAMP NOT NULL DEFAULT NOW ()
+    );
+
+--bun:split
+-- Webhookの送信キュー(outbox)。
+-- 認証器の変更と同じトランザクションで書き込み、サーバー内のディスパッチャーが送信する。
+CREATE TABLE
+    IF NOT EXISTS webhook_outbox (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+        event_id UUID NOT NULL,
+        endpoint_id UUID NOT NULL REFERENCES webhook_endpoints (id) ON DELETE CASCADE,
+        event_type VARCHAR(64) NOT NULL,
+        payload JSONB NOT NULL,
+        status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+        attempts INTEGER NOT NULL DEFAULT 0,
+        next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW (),
+        last_error TEXT,
+        last_status_code INTEGER,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW (),
+        delivered_at TIMESTAMP
+    );
+
+--bun:split
+CREATE INDEX IF NOT EXISTS webhook_outbox_pending_idx ON webhook_outbox (next_attempt_at) WHERE status = 'pending';
@@ -0,0 +1,5 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+DROP INDEX IF EXISTS users_name_key;
@@ -0,0 +1,31 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- 一意制約を付ける前に、同じ名前のユーザーが存在しないことを確認する。
+-- どのユーザーを残すかは判断できないので自動では削除せず、名前を変更するか削除してから再度実行してもらう
+DO $$
+DECLARE
+    duplicates TEXT;
+BEGIN
+    SELECT string_agg(format('%s (%s users)', name, count), ', ')
+    INTO duplicates
+    FROM (
+        SELECT name, COUNT(*) AS count
+        FROM users
+        GROUP BY name
+        HAVING COUNT(*) > 1
+        ORDER BY name
+        LIMIT 20
+    ) AS d;
+
+    IF duplicates IS NOT NULL THEN
+        RAISE EXCEPTION 'Cannot create unique index users_name_key: duplicate user names exist: %', duplicates
+            USING HINT = 'Rename or delete the duplicate users, then run the migration again.';
+    END IF;
+END
+$$;
+
+--bun:split
+-- 新規ユーザーは認証器の登録完了時に保存するため、同じ名前で並行して登録された場合に備えて一意制約を付ける
+CREATE UNIQUE INDEX IF NOT EXISTS users_name_key ON users (name);
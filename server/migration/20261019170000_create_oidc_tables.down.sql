@@ -0,0 +1,8 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+DROP TABLE IF EXISTS oidc_signing_keys;
+
+--bun:split
+DROP TABLE IF EXISTS oidc_clients;
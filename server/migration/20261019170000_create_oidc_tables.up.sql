@@ -0,0 +1,27 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- OpenID Connectのクライアント(このサービスでログインさせる他のアプリ)。
+-- secret_hash が NULL の場合はシークレットを持たない公開クライアント(SPAやネイティブアプリ)として扱う。
+CREATE TABLE
+    IF NOT EXISTS oidc_clients (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+        name VARCHAR(255) NOT NULL,
+        secret_hash VARCHAR(64),
+        redirect_uris TEXT [] NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW (),
+        updated_at TIMESTAMP NOT NULL DEFAULT NOW ()
+    );
+
+--bun:split
+-- IDトークンの署名鍵。
+-- retired_at が NULL の鍵のうち最も新しいもので署名し、ローテーション後もしばらくはJWKSで公開し続ける。
+CREATE TABLE
+    IF NOT EXISTS oidc_signing_keys (
+        id VARCHAR(64) PRIMARY KEY,
+        algorithm VARCHAR(16) NOT NULL,
+        private_key BYTEA NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW (),
+        retired_at TIMESTAMP
+    );
@@ -0,0 +1,28 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- トークンモードでログインしたクライアントのリフレッシュトークン。
+--
+-- リフレッシュのたびに新しいトークンを発行し、使用済みのトークンには used_at を記録する。
+-- 同じログインから発行されたトークンは family_id が同じになり、使用済みのトークンが再度使われた場合はファミリーごと失効させる。
+CREATE TABLE
+    IF NOT EXISTS refresh_tokens (
+        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+        family_id UUID NOT NULL,
+        parent_id UUID,
+        user_id UUID NOT NULL,
+        token_hash VARCHAR(64) NOT NULL UNIQUE,
+        user_verified BOOLEAN NOT NULL DEFAULT FALSE,
+        auth_time TIMESTAMP NOT NULL,
+        expires_at TIMESTAMP NOT NULL,
+        used_at TIMESTAMP,
+        revoked_at TIMESTAMP,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW ()
+    );
+
+--bun:split
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+
+--bun:split
+CREATE INDEX IF NOT EXISTS refresh_tokens_user_id_idx ON refresh_tokens (user_id);
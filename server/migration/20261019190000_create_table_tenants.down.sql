@@ -0,0 +1,20 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+DROP INDEX IF EXISTS webauthn_credentials_tenant_id_credential_id_idx;
+
+--bun:split
+DROP INDEX IF EXISTS users_tenant_id_name_key;
+
+--bun:split
+CREATE UNIQUE INDEX IF NOT EXISTS users_name_key ON users (name);
+
+--bun:split
+ALTER TABLE webauthn_credentials DROP COLUMN IF EXISTS tenant_id;
+
+--bun:split
+ALTER TABLE users DROP COLUMN IF EXISTS tenant_id;
+
+--bun:split
+DROP TABLE IF EXISTS tenants;
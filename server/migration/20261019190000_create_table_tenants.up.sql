@@ -0,0 +1,48 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- ブランドごとのRelying Party。ドメインごとにRP IDや許可するオリジン、認証器のポリシーを持つ。
+CREATE TABLE IF NOT EXISTS tenants (
+    id VARCHAR(63) PRIMARY KEY,
+    rp_id VARCHAR(255) NOT NULL,
+    rp_display_name VARCHAR(255) NOT NULL,
+    rp_origins TEXT [] NOT NULL,
+    -- リクエストの Host ヘッダーからテナントを特定するためのホスト名(ポートを含めてもよい)
+    hosts TEXT [] NOT NULL DEFAULT '{}',
+    user_verification VARCHAR(32) NOT NULL DEFAULT 'preferred',
+    resident_key VARCHAR(32) NOT NULL DEFAULT 'required',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+--bun:split
+-- これまでの設定を既定のテナントとして登録する
+INSERT INTO tenants (id, rp_id, rp_display_name, rp_origins, hosts)
+VALUES ('default', 'localhost', 'go-passkey-demo', '{http://localhost:5173}', '{localhost:8080}')
+ON CONFLICT (id) DO NOTHING;
+
+--bun:split
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(63) NOT NULL DEFAULT 'default' REFERENCES tenants (id);
+
+--bun:split
+ALTER TABLE webauthn_credentials
+    ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(63) NOT NULL DEFAULT 'default' REFERENCES tenants (id);
+
+--bun:split
+-- 既存の行を既定のテナントにした後は、保存時に必ずテナントを指定させる
+ALTER TABLE users ALTER COLUMN tenant_id DROP DEFAULT;
+
+--bun:split
+ALTER TABLE webauthn_credentials ALTER COLUMN tenant_id DROP DEFAULT;
+
+--bun:split
+-- ユーザー名はテナントごとに一意にする
+DROP INDEX IF EXISTS users_name_key;
+
+--bun:split
+CREATE UNIQUE INDEX IF NOT EXISTS users_tenant_id_name_key ON users (tenant_id, name);
+
+--bun:split
+CREATE INDEX IF NOT EXISTS webauthn_credentials_tenant_id_credential_id_idx ON webauthn_credentials (tenant_id, credential_id);
@@ -0,0 +1,6 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+ALTER TABLE tenants
+    DROP COLUMN IF EXISTS related_origins;
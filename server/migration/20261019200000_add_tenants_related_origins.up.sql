@@ -0,0 +1,8 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- RP IDとは別のドメインで同じRPを使うためのオリジン。 /.well-known/webauthn で公開する。
+-- SEE: https://w3c.github.io/webauthn/#sctn-related-origins
+ALTER TABLE tenants
+    ADD COLUMN IF NOT EXISTS related_origins TEXT [] NOT NULL DEFAULT '{}';
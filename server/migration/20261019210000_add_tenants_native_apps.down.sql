@@ -0,0 +1,7 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+ALTER TABLE tenants
+    DROP COLUMN IF EXISTS apple_app_ids,
+    DROP COLUMN IF EXISTS android_apps;
@@ -0,0 +1,10 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- 同じパスキーを使うネイティブアプリ。
+-- android_apps は [{"package_name": "...", "sha256_cert_fingerprints": ["AB:CD:..."]}] の形式で保存する。
+-- apple_app_ids は "<Team ID>.<Bundle ID>" の形式で保存する。
+ALTER TABLE tenants
+    ADD COLUMN IF NOT EXISTS android_apps JSONB NOT NULL DEFAULT '[]',
+    ADD COLUMN IF NOT EXISTS apple_app_ids TEXT [] NOT NULL DEFAULT '{}';
@@ -0,0 +1,6 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+ALTER TABLE users
+    DROP COLUMN IF EXISTS registered_at;
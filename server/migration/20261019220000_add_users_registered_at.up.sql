@@ -0,0 +1,17 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- 認証器の登録を一度でも完了したユーザー。放置されたユーザーの削除で、認証器をすべて削除したユーザーを対象外にするために使用する
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS registered_at TIMESTAMP;
+
+--bun:split
+-- 認証器があるユーザーと、監査ログに登録の成功が残っているユーザーは登録済みとする
+UPDATE users AS u
+SET registered_at = u.created_at
+WHERE u.registered_at IS NULL
+    AND (
+        EXISTS (SELECT 1 FROM webauthn_credentials AS wc WHERE wc.user_id = u.id)
+        OR EXISTS (SELECT 1 FROM auth_events AS ae WHERE ae.user_id = u.id AND ae.event_type = 'registration' AND ae.result = 'success')
+    );
@@ -0,0 +1,10 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+ALTER TABLE oidc_clients
+    DROP COLUMN IF EXISTS tenant_id;
+
+--bun:split
+ALTER TABLE refresh_tokens
+    DROP COLUMN IF EXISTS tenant_id;
@@ -0,0 +1,25 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- リフレッシュトークンは、ログインしたテナントでのみ使えるようにする
+ALTER TABLE refresh_tokens
+    ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(63) NOT NULL DEFAULT 'default' REFERENCES tenants (id);
+
+--bun:split
+-- 既存のリフレッシュトークンは、ユーザーのテナントにする
+UPDATE refresh_tokens AS rt
+SET tenant_id = u.tenant_id
+FROM users AS u
+WHERE u.id = rt.user_id;
+
+--bun:split
+ALTER TABLE refresh_tokens ALTER COLUMN tenant_id DROP DEFAULT;
+
+--bun:split
+-- OpenID Connectのクライアントは、登録したテナントのユーザーのみログインさせる。既存のクライアントは default テナントにする
+ALTER TABLE oidc_clients
+    ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(63) NOT NULL DEFAULT 'default' REFERENCES tenants (id);
+
+--bun:split
+ALTER TABLE oidc_clients ALTER COLUMN tenant_id DROP DEFAULT;
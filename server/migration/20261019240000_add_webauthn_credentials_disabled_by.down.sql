@@ -0,0 +1,6 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+ALTER TABLE webauthn_credentials
+    DROP COLUMN IF EXISTS disabled_by;
@@ -0,0 +1,14 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- 認証器を無効化したのが誰か(user または admin)。管理者が無効化した認証器は、ユーザー本人は有効化できない
+ALTER TABLE webauthn_credentials
+    ADD COLUMN IF NOT EXISTS disabled_by VARCHAR(16);
+
+--bun:split
+-- 既存の無効化された認証器は、どちらが無効化したか分からないので管理者の無効化として扱う
+UPDATE webauthn_credentials
+SET disabled_by = 'admin'
+WHERE disabled_at IS NOT NULL
+    AND disabled_by IS NULL;
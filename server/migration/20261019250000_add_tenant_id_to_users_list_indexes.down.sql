@@ -0,0 +1,17 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+DROP INDEX IF EXISTS users_tenant_id_name_pattern_idx;
+
+--bun:split
+DROP INDEX IF EXISTS users_tenant_id_name_id_idx;
+
+--bun:split
+DROP INDEX IF EXISTS users_tenant_id_created_at_id_idx;
+
+--bun:split
+CREATE INDEX IF NOT EXISTS users_name_id_idx ON users (name varchar_pattern_ops, id);
+
+--bun:split
+CREATE INDEX IF NOT EXISTS users_created_at_id_idx ON users (created_at, id);
@@ -0,0 +1,20 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- GET /users は常にテナントで絞り込むので、テナントを先頭にした (並び替えカラム, id) の複合インデックスに作り直す
+DROP INDEX IF EXISTS users_created_at_id_idx;
+
+--bun:split
+DROP INDEX IF EXISTS users_name_id_idx;
+
+--bun:split
+CREATE INDEX IF NOT EXISTS users_tenant_id_created_at_id_idx ON users (tenant_id, created_at, id);
+
+--bun:split
+-- varchar_pattern_ops のインデックスは照合順序が C 以外だと ORDER BY name やカーソルの比較に使えないので、デフォルトの演算子クラスにする
+CREATE INDEX IF NOT EXISTS users_tenant_id_name_id_idx ON users (tenant_id, name, id);
+
+--bun:split
+-- name_prefix による前方一致検索用
+CREATE INDEX IF NOT EXISTS users_tenant_id_name_pattern_idx ON users (tenant_id, name varchar_pattern_ops);
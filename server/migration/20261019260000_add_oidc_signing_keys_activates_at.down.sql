@@ -0,0 +1,6 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+ALTER TABLE oidc_signing_keys
+    DROP COLUMN IF EXISTS activates_at;
@@ -0,0 +1,18 @@
+SET
+    statement_timeout = 0;
+
+--bun:split
+-- 署名に使い始める日時。次の署名鍵は先にJWKSで公開しておき、この日時から署名に使う
+ALTER TABLE oidc_signing_keys
+    ADD COLUMN IF NOT EXISTS activates_at TIMESTAMP;
+
+--bun:split
+-- 既存の鍵は作成した時から署名に使っている
+UPDATE oidc_signing_keys
+SET activates_at = created_at
+WHERE activates_at IS NULL;
+
+--bun:split
+ALTER TABLE oidc_signing_keys
+    ALTER COLUMN activates_at SET DEFAULT NOW (),
+    ALTER COLUMN activates_at SET NOT NULL;
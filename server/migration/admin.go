@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/uptrace/bun"
+	"github.com/urfave/cli/v2"
+)
+
+type admin struct {
+	bun.BaseModel `bun:"table:admins"`
+
+	Name      string `bun:"name"`
+	Role      string `bun:"role"`
+	TokenHash string `bun:"token_hash"`
+}
+
+// # 管理者の作成コマンド
+//
+// 管理者APIのトークンはハッシュ化して保存するので、平文のトークンは作成時に一度だけ表示する。
+func newAdminCommand(db *bun.DB) *cli.Command {
+	return &cli.Command{
+		Name:  "admin",
+		Usage: "manage admin API users",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "create",
+				Usage: "create an admin and print its API token",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "name", Required: true},
+					&cli.StringFlag{Name: "role", Value: "viewer", Usage: "viewer or operator"},
+				},
+				Action: func(c *cli.Context) error {
+					token, hash, err := newAdminToken()
+					if err != nil {
+						return err
+					}
+
+					_, err = db.NewInsert().
+						Model(&admin{
+							Name:      c.String("name"),
+							Role:      c.String("role"),
+							TokenHash: hash,
+						}).
+						Exec(c.Context)
+					if err != nil {
+						return err
+					}
+
+					fmt.Printf("created admin %s (%s)\n", c.String("name"), c.String("role"))
+					fmt.Printf("token: %s\n", token)
+					return nil
+				},
+			},
+			{
+				Name:      "rotate",
+				Usage:     "issue a new API token for an admin",
+				ArgsUsage: "<name>",
+				Action: func(c *cli.Context) error {
+					token, hash, err := newAdminToken()
+					if err != nil {
+						return err
+					}
+
+					res, err := db.NewUpdate().
+						Model((*admin)(nil)).
+						Set("token_hash = ?", hash).
+						Set("updated_at = NOW()").
+						Where("name = ?", c.Args().First()).
+						Exec(c.Context)
+					if err != nil {
+						return err
+					}
+					if n, _ := res.RowsAffected(); n == 0 {
+						return fmt.Errorf("admin %q is not found", c.Args().First())
+					}
+
+					fmt.Printf("token: %s\n", token)
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// サーバー側の hashToken と同じく、SHA-256のhex文字列をハッシュとして保存する。
+func newAdminToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	token = hex.EncodeToString(b)
+	sum := sha256.Sum256([]byte(token))
+	return token, hex.EncodeToString(sum[:]), nil
+}
@@ -13,9 +13,13 @@ import (
 )
 
 func main() {
-	db := db.GetDB()
+	db, err := db.Open(db.DSN())
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
 
-	err := db.Ping()
+	err = db.Ping()
 	if err != nil {
 		panic(err)
 	}
@@ -34,6 +38,7 @@ func main() {
 		Name: "bun",
 		Commands: []*cli.Command{
 			newDBCommand(migrate.NewMigrator(db, migrations)),
+			newAdminCommand(db),
 		},
 	}
 	if err := app.Run(os.Args); err != nil {
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ネイティブアプリとパスキーを共有するための設定。
+//
+// Androidアプリからの認証は、オリジンが android:apk-key-hash:<署名証明書のSHA-256ハッシュ> になるので、RPOrigins に追加する。
+// また、アプリとドメインを関連付けるために、RP IDのドメインで以下のファイルを公開する。
+//
+//   - Android: /.well-known/assetlinks.json (Digital Asset Links)
+//   - iOS: /.well-known/apple-app-site-association (Associated Domains の webcredentials)
+//
+// SEE: https://developer.android.com/identity/sign-in/credential-manager#add-support-dal
+// SEE: https://developer.apple.com/documentation/xcode/supporting-associated-domains
+
+const androidOriginPrefix = "android:apk-key-hash:"
+
+type androidApp struct {
+	PackageName string `json:"package_name"`
+	// 署名証明書のSHA-256フィンガープリント。 "AB:CD:..." のように、コロン区切りの16進数で指定する。
+	SHA256CertFingerprints []string `json:"sha256_cert_fingerprints"`
+}
+
+// Apple の App ID。Team ID(10文字)と Bundle ID をドットでつないだもの。
+var appleAppIDPattern = regexp.MustCompile(`^[A-Z0-9]{10}\.[A-Za-z0-9.-]+$`)
+
+// フィンガープリントをバイト列に変換する。
+func parseCertFingerprint(v string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(v, ":", ""))
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("invalid sha256 cert fingerprint %q", v)
+	}
+	return b, nil
+}
+
+// Androidアプリのオリジン。フィンガープリントをパディングなしのbase64urlにしたもの。
+func androidOrigin(fingerprint []byte) string {
+	return androidOriginPrefix + base64.RawURLEncoding.EncodeToString(fingerprint)
+}
+
+// テナントに設定したAndroidアプリのオリジン。正しくないフィンガープリントは除く。
+func (t *Tenant) androidOrigins() []string {
+	var origins []string
+	for _, app := range t.AndroidApps {
+		for _, v := range app.SHA256CertFingerprints {
+			if b, err := parseCertFingerprint(v); err == nil {
+				origins = append(origins, androidOrigin(b))
+			}
+		}
+	}
+	return origins
+}
+
+func (t *Tenant) validateNativeApps() error {
+	var errs []error
+	for _, app := range t.AndroidApps {
+		if app.PackageName == "" {
+			errs = append(errs, errors.New("android app must have package_name"))
+		}
+		if len(app.SHA256CertFingerprints) == 0 {
+			errs = append(errs, fmt.Errorf("android app %s must have sha256_cert_fingerprints", app.PackageName))
+		}
+		for _, v := range app.SHA256CertFingerprints {
+			if _, err := parseCertFingerprint(v); err != nil {
+				errs = append(errs, fmt.Errorf("android app %s: %w", app.PackageName, err))
+			}
+		}
+	}
+	for _, id := range t.AppleAppIDs {
+		if !appleAppIDPattern.MatchString(id) {
+			errs = append(errs, fmt.Errorf("invalid apple app id %q: must be <Team ID>.<Bundle ID>", id))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+type assetLinksTarget struct {
+	Namespace              string   `json:"namespace"`
+	PackageName            string   `json:"package_name"`
+	SHA256CertFingerprints []string `json:"sha256_cert_fingerprints"`
+}
+
+type assetLinksStatement struct {
+	Relation []string         `json:"relation"`
+	Target   assetLinksTarget `json:"target"`
+}
+
+// アプリ内のリンクの処理と、パスキー(ログイン情報)の共有を許可する
+var assetLinksRelations = []string{
+	"delegate_permission/common.handle_all_urls",
+	"delegate_permission/common.get_login_creds",
+}
+
+func wellKnownAssetLinks() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		tenant := currentTenant(ctx)
+		if len(tenant.AndroidApps) == 0 {
+			return ctx.JSON(http.StatusNotFound, nil)
+		}
+
+		res := make([]assetLinksStatement, 0, len(tenant.AndroidApps))
+		for _, app := range tenant.AndroidApps {
+			res = append(res, assetLinksStatement{
+				Relation: assetLinksRelations,
+				Target: assetLinksTarget{
+					Namespace:              "android_app",
+					PackageName:            app.PackageName,
+					SHA256CertFingerprints: app.SHA256CertFingerprints,
+				},
+			})
+		}
+
+		return ctx.JSON(http.StatusOK, res)
+	}
+}
+
+type appleAppSiteAssociation struct {
+	WebCredentials struct {
+		Apps []string `json:"apps"`
+	} `json:"webcredentials"`
+}
+
+// iOSは拡張子のないファイルを application/json として取得するので、リダイレクトせずにJSONを返す。
+func wellKnownAppleAppSiteAssociation() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		tenant := currentTenant(ctx)
+		if len(tenant.AppleAppIDs) == 0 {
+			return ctx.JSON(http.StatusNotFound, nil)
+		}
+
+		var res appleAppSiteAssociation
+		res.WebCredentials.Apps = tenant.AppleAppIDs
+
+		return ctx.JSON(http.StatusOK, res)
+	}
+}
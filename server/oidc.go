@@ -0,0 +1,740 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+)
+
+// パスキーでのログインを使った、OpenID Connectプロバイダー(OAuth 2.1の認可サーバー)。
+//
+// 認可コードフローのみ対応し、PKCE(S256)を必須にしている。
+//
+// SEE: https://openid.net/specs/openid-connect-core-1_0.html
+// SEE: https://datatracker.ietf.org/doc/html/draft-ietf-oauth-v2-1
+
+const (
+	oidcAuthorizationCodeDuration = time.Minute
+	oidcAccessTokenDuration       = time.Hour
+	oidcIDTokenDuration           = time.Hour
+
+	oidcAuthorizationCodeKeyPrefix = "oidc_code:"
+	oidcAccessTokenKeyPrefix       = "oidc_access_token:"
+)
+
+const (
+	oidcScopeOpenID  = "openid"
+	oidcScopeProfile = "profile"
+)
+
+var oidcScopes = []string{oidcScopeOpenID, oidcScopeProfile}
+
+// acr の値。
+// ユーザー検証(UV)を伴うパスキーは所持と生体認証/PINの多要素認証になるので、NIST SP 800-63B のAAL2相当とする。
+const (
+	oidcACRUserVerified = "aal2"
+	oidcACRUserPresent  = "aal1"
+)
+
+type oidcConfig struct {
+	// default テナントのIDトークンの iss 。他のテナントの iss は、これに /t/:tenant を付けたものになる(tenantIssuer)。
+	Issuer string
+	// 未ログインの場合にリダイレクトするログイン画面。 return_to パラメータで認可エンドポイントに戻ってくる。
+	LoginURL string
+	// 署名鍵をローテーションする間隔
+	KeyRotation time.Duration
+	// 次の署名鍵を、署名に使い始める前にJWKSで公開しておく期間。利用者がJWKSをキャッシュする期間より長くすること。
+	KeyPrepublication time.Duration
+	// ローテーション後に古い署名鍵をJWKSで公開し続ける期間。トークンの有効期限より長くすること。
+	KeyRetention time.Duration
+	// 検証に使う公開鍵をキャッシュする期間
+	KeyCacheTTL time.Duration
+}
+
+func loadOIDCConfig(env *envReader) oidcConfig {
+	cfg := oidcConfig{
+		Issuer:            strings.TrimSuffix(getEnv("OIDC_ISSUER", "http://localhost:8080"), "/"),
+		LoginURL:          getEnv("OIDC_LOGIN_URL", "http://localhost:5173/"),
+		KeyRotation:       env.getDuration("OIDC_KEY_ROTATION", 30*24*time.Hour),
+		KeyPrepublication: env.getDuration("OIDC_KEY_PREPUBLICATION", 24*time.Hour),
+		KeyRetention:      env.getDuration("OIDC_KEY_RETENTION", 24*time.Hour),
+		KeyCacheTTL:       env.getDuration("OIDC_KEY_CACHE_TTL", time.Minute),
+	}
+	// 次の鍵を公開している間も、今の鍵で署名し続けるため
+	if cfg.KeyPrepublication >= cfg.KeyRotation {
+		env.fail("OIDC_KEY_PREPUBLICATION", cfg.KeyPrepublication.String(), errors.New("must be shorter than OIDC_KEY_ROTATION"))
+	}
+
+	return cfg
+}
+
+// テナントの iss 。ディスカバリで返す各エンドポイントのURLもこれを基準にする。
+//
+// テナントごとに iss を分けて、他のテナントで発行したトークンを検証で拒否できるようにする。
+func (cfg oidcConfig) tenantIssuer(tenantID string) string {
+	if tenantID == defaultTenantID {
+		return cfg.Issuer
+	}
+	return cfg.Issuer + tenantPathPrefix + url.PathEscape(tenantID)
+}
+
+// OpenID Connectのクライアント。クライアントは登録したテナントでのみ使える。
+// SecretHash が空の場合はシークレットを持たない公開クライアントとして扱う。
+type OIDCClient struct {
+	bun.BaseModel `bun:"table:oidc_clients,alias:oc"`
+
+	ID           string    `json:"client_id" bun:"id,pk"`
+	TenantID     string    `json:"tenant_id" bun:"tenant_id"`
+	Name         string    `json:"name" bun:"name"`
+	SecretHash   string    `json:"-" bun:"secret_hash,nullzero"`
+	RedirectURIs []string  `json:"redirect_uris" bun:"redirect_uris,array"`
+	CreatedAt    time.Time `json:"created_at" bun:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" bun:"updated_at"`
+}
+
+func (c *OIDCClient) isConfidential() bool {
+	return c.SecretHash != ""
+}
+
+func findOIDCClient(ctx context.Context, db bun.IDB, tenantID, clientID string) (*OIDCClient, error) {
+	var client OIDCClient
+	err := db.NewSelect().
+		Model(&client).
+		Where("id::text = ?", clientID).
+		Where("tenant_id = ?", tenantID).
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &client, nil
+}
+
+// OAuth 2.0 のエラーレスポンス。
+//
+// SEE: https://datatracker.ietf.org/doc/html/rfc6749#section-5.2
+type oauthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// 認可コードに紐づけて保存する、認可リクエストとログインの情報。
+type oidcAuthorizationCode struct {
+	TenantID      string    `json:"tenant_id"`
+	ClientID      string    `json:"client_id"`
+	RedirectURI   string    `json:"redirect_uri"`
+	UserID        string    `json:"user_id"`
+	Scopes        []string  `json:"scopes"`
+	Nonce         string    `json:"nonce,omitempty"`
+	CodeChallenge string    `json:"code_challenge"`
+	AuthTime      time.Time `json:"auth_time"`
+	UserVerified  bool      `json:"user_verified"`
+}
+
+// 認可コードを発行する。認可コードは有効期限が短く、一度しか使えない。
+func (s *sessionStore) createAuthorizationCode(ctx context.Context, data *oidcAuthorizationCode) (string, error) {
+	code, err := random(32)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate authorization code: %w", err)
+	}
+
+	value, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("Failed to encoding data to redis value: %w", err)
+	}
+
+	if err := s.client.Set(ctx, oidcAuthorizationCodeKeyPrefix+code, value, oidcAuthorizationCodeDuration).Err(); err != nil {
+		return "", fmt.Errorf("Failed to save authorization code: %w", err)
+	}
+
+	return code, nil
+}
+
+// 認可コードを取り出す。同じコードを二度使えないように、取得と同時に削除する。
+func (s *sessionStore) redeemAuthorizationCode(ctx context.Context, code string) (*oidcAuthorizationCode, error) {
+	val, err := s.client.GetDel(ctx, oidcAuthorizationCodeKeyPrefix+code).Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get authorization code: %w", err)
+	}
+
+	var data *oidcAuthorizationCode
+	if err := json.Unmarshal(val, &data); err != nil {
+		return nil, fmt.Errorf("Failed to decode authorization code: %w", err)
+	}
+
+	return data, nil
+}
+
+// アクセストークンに紐づけて保存する情報。
+type oidcAccessToken struct {
+	TenantID string   `json:"tenant_id"`
+	UserID   string   `json:"user_id"`
+	ClientID string   `json:"client_id"`
+	Scopes   []string `json:"scopes"`
+}
+
+// アクセストークンを発行する。Redisにはトークンのハッシュをキーにして保存する。
+func (s *sessionStore) createAccessToken(ctx context.Context, data *oidcAccessToken) (string, error) {
+	token, err := random(32)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate access token: %w", err)
+	}
+
+	value, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("Failed to encoding data to redis value: %w", err)
+	}
+
+	if err := s.client.Set(ctx, oidcAccessTokenKeyPrefix+hashToken(token), value, oidcAccessTokenDuration).Err(); err != nil {
+		return "", fmt.Errorf("Failed to save access token: %w", err)
+	}
+
+	return token, nil
+}
+
+func (s *sessionStore) getAccessToken(ctx context.Context, token string) (*oidcAccessToken, error) {
+	val, err := s.client.Get(ctx, oidcAccessTokenKeyPrefix+hashToken(token)).Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get access token: %w", err)
+	}
+
+	var data *oidcAccessToken
+	if err := json.Unmarshal(val, &data); err != nil {
+		return nil, fmt.Errorf("Failed to decode access token: %w", err)
+	}
+
+	return data, nil
+}
+
+// ログイン時のユーザー検証(UV)フラグから、 amr と acr を決める。
+//
+// amr の値は RFC 8176 に従う。パスキーは常に hwk(ハードウェアの鍵の所持)で、UVがある場合は user(ユーザーの存在確認)を加える。
+//
+// SEE: https://www.rfc-editor.org/rfc/rfc8176
+func oidcAuthenticationMethods(userVerified bool) (amr []string, acr string) {
+	if userVerified {
+		return []string{"hwk", "user"}, oidcACRUserVerified
+	}
+	return []string{"hwk"}, oidcACRUserPresent
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+
+	Nonce             string   `json:"nonce,omitempty"`
+	AuthTime          int64    `json:"auth_time"`
+	AMR               []string `json:"amr"`
+	ACR               string   `json:"acr"`
+	Name              string   `json:"name,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+}
+
+// 現在の署名鍵でJWTに署名する。ヘッダーの kid で、JWKSのどの鍵で検証すればよいかを示す。
+// typ はIDトークンとアクセストークンを区別するために指定する。
+func signJWT(ctx context.Context, db bun.IDB, cfg oidcConfig, typ string, claims jwt.Claims) (string, error) {
+	key, err := currentSigningKey(ctx, db, cfg.KeyRotation, cfg.KeyPrepublication)
+	if err != nil {
+		return "", err
+	}
+
+	privateKey, err := key.ecdsaKey()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = key.ID
+	token.Header["typ"] = typ
+
+	return token.SignedString(privateKey)
+}
+
+// ディスカバリドキュメント。
+//
+// SEE: https://openid.net/specs/openid-connect-discovery-1_0.html
+type oidcDiscoveryResponse struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	ACRValuesSupported                []string `json:"acr_values_supported"`
+}
+
+func oidcDiscovery(cfg oidcConfig) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		issuer := cfg.tenantIssuer(currentTenant(ctx).ID)
+		return ctx.JSON(http.StatusOK, oidcDiscoveryResponse{
+			Issuer:                            issuer,
+			AuthorizationEndpoint:             issuer + "/oauth2/authorize",
+			TokenEndpoint:                     issuer + "/oauth2/token",
+			UserinfoEndpoint:                  issuer + "/userinfo",
+			JWKSURI:                           issuer + "/.well-known/jwks.json",
+			ScopesSupported:                   oidcScopes,
+			ResponseTypesSupported:            []string{"code"},
+			GrantTypesSupported:               []string{"authorization_code"},
+			SubjectTypesSupported:             []string{"public"},
+			IDTokenSigningAlgValuesSupported:  []string{oidcSigningAlgorithm},
+			TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+			CodeChallengeMethodsSupported:     []string{"S256"},
+			ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "amr", "acr", "name", "preferred_username"},
+			ACRValuesSupported:                []string{oidcACRUserVerified, oidcACRUserPresent},
+		})
+	}
+}
+
+func oidcJWKS(db *bun.DB, cfg oidcConfig) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		// 鍵がまだ1つもない場合や、ローテーションの時期が近い場合に備えて、署名に使う鍵と次の鍵を先に用意しておく
+		if _, err := currentSigningKey(ctx.Request().Context(), db, cfg.KeyRotation, cfg.KeyPrepublication); err != nil {
+			ctx.Logger().Errorf("Failed to get signing key: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		keys, err := publishedSigningKeys(ctx.Request().Context(), db, cfg.KeyRetention)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to select signing keys: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		set := jwkSet{Keys: make([]jwk, 0, len(keys))}
+		for i := range keys {
+			k, err := newJWK(&keys[i])
+			if err != nil {
+				ctx.Logger().Errorf("Failed to encode signing key: %v\n", err)
+				return ctx.JSON(http.StatusInternalServerError, nil)
+			}
+			set.Keys = append(set.Keys, *k)
+		}
+
+		return ctx.JSON(http.StatusOK, set)
+	}
+}
+
+// 認可エンドポイント。
+//
+// クライアントとリダイレクトURIが正しくない場合は、攻撃者のサイトにリダイレクトしないようにエラーをそのまま返す。
+// それ以外のエラーはリダイレクトURIにエラーを付けてリダイレクトする。
+func oidcAuthorize(db *bun.DB, sessions *sessionStore, cfg oidcConfig) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		params := ctx.QueryParams()
+		tenant := currentTenant(ctx)
+
+		client, err := findOIDCClient(ctx.Request().Context(), db, tenant.ID, params.Get("client_id"))
+		if err != nil {
+			ctx.Logger().Errorf("Failed to find oidc client: %v\n", err)
+			return ctx.JSON(http.StatusBadRequest, oauthErrorResponse{Error: "invalid_request", ErrorDescription: "unknown client_id"})
+		}
+		redirectURI := params.Get("redirect_uri")
+		if !slices.Contains(client.RedirectURIs, redirectURI) {
+			return ctx.JSON(http.StatusBadRequest, oauthErrorResponse{Error: "invalid_request", ErrorDescription: "redirect_uri is not registered"})
+		}
+
+		state := params.Get("state")
+		fail := func(code, description string) error {
+			return ctx.Redirect(http.StatusFound, authorizationRedirectURL(redirectURI, url.Values{
+				"error":             {code},
+				"error_description": {description},
+				"state":             {state},
+			}))
+		}
+
+		if params.Get("response_type") != "code" {
+			return fail("unsupported_response_type", "only response_type=code is supported")
+		}
+		scopes := strings.Fields(params.Get("scope"))
+		if !slices.Contains(scopes, oidcScopeOpenID) {
+			return fail("invalid_scope", "scope must contain openid")
+		}
+		// 対応していないスコープは無視する
+		scopes = slices.DeleteFunc(scopes, func(s string) bool { return !slices.Contains(oidcScopes, s) })
+
+		codeChallenge := params.Get("code_challenge")
+		if params.Get("code_challenge_method") != "S256" || len(codeChallenge) < 43 || len(codeChallenge) > 128 {
+			return fail("invalid_request", "PKCE with code_challenge_method=S256 is required")
+		}
+
+		session, ok := currentLoginSession(ctx)
+		if !ok {
+			if params.Get("prompt") == "none" {
+				return fail("login_required", "user is not logged in")
+			}
+
+			// ログイン後に、同じ認可リクエストに戻ってこられるようにする
+			loginURL, err := url.Parse(cfg.LoginURL)
+			if err != nil {
+				ctx.Logger().Errorf("Invalid login url: %v\n", err)
+				return ctx.JSON(http.StatusInternalServerError, nil)
+			}
+			q := loginURL.Query()
+			q.Set("return_to", cfg.tenantIssuer(tenant.ID)+ctx.Request().URL.RequestURI())
+			loginURL.RawQuery = q.Encode()
+			return ctx.Redirect(http.StatusFound, loginURL.String())
+		}
+
+		user, err := findUserByID(ctx.Request().Context(), db, session.UserID)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to find user: %v\n", err)
+			return fail("login_required", "user is not found")
+		}
+		if err := user.checkActive(time.Now()); err != nil {
+			return fail("access_denied", "account is not active")
+		}
+
+		code, err := sessions.createAuthorizationCode(ctx.Request().Context(), &oidcAuthorizationCode{
+			TenantID:      tenant.ID,
+			ClientID:      client.ID,
+			RedirectURI:   redirectURI,
+			UserID:        user.ID,
+			Scopes:        scopes,
+			Nonce:         params.Get("nonce"),
+			CodeChallenge: codeChallenge,
+			AuthTime:      session.CreatedAt,
+			UserVerified:  session.UserVerified,
+		})
+		if err != nil {
+			ctx.Logger().Errorf("Failed to create authorization code: %v\n", err)
+			return fail("server_error", "failed to issue authorization code")
+		}
+
+		return ctx.Redirect(http.StatusFound, authorizationRedirectURL(redirectURI, url.Values{
+			"code":  {code},
+			"state": {state},
+		}))
+	}
+}
+
+// リダイレクトURIにクエリパラメータを追加する。空の値は付けない。
+func authorizationRedirectURL(redirectURI string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		// 登録時に検証しているので、ここでは起きない
+		return redirectURI
+	}
+
+	q := u.Query()
+	for k, v := range params {
+		if len(v) > 0 && v[0] != "" {
+			q.Set(k, v[0])
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+var errInvalidOIDCClient = errors.New("invalid client")
+
+// トークンエンドポイントでクライアントを認証する。
+// client_secret_basic、 client_secret_post、公開クライアントの場合はclient_idのみ(none)に対応する。
+func authenticateOIDCClient(ctx echo.Context, db bun.IDB) (*OIDCClient, error) {
+	clientID, secret, ok := ctx.Request().BasicAuth()
+	if ok {
+		// Basic認証の値はフォームエンコードされている
+		//
+		// SEE: https://datatracker.ietf.org/doc/html/rfc6749#section-2.3.1
+		var err error
+		if clientID, err = url.QueryUnescape(clientID); err != nil {
+			return nil, errInvalidOIDCClient
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil, errInvalidOIDCClient
+		}
+	} else {
+		clientID = ctx.FormValue("client_id")
+		secret = ctx.FormValue("client_secret")
+	}
+
+	client, err := findOIDCClient(ctx.Request().Context(), db, currentTenant(ctx).ID, clientID)
+	if err != nil {
+		return nil, errInvalidOIDCClient
+	}
+	if client.isConfidential() && subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, errInvalidOIDCClient
+	}
+
+	return client, nil
+}
+
+// PKCEの code_verifier を検証する。
+//
+// SEE: https://datatracker.ietf.org/doc/html/rfc7636#section-4.6
+func verifyCodeChallenge(verifier, challenge string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// トークンエンドポイント。認可コードを、アクセストークンとIDトークンに交換する。
+func oidcToken(db *bun.DB, sessions *sessionStore, cfg oidcConfig) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		// トークンを含むレスポンスはキャッシュさせない
+		ctx.Response().Header().Set("Cache-Control", "no-store")
+
+		client, err := authenticateOIDCClient(ctx, db)
+		if err != nil {
+			ctx.Response().Header().Set("WWW-Authenticate", `Basic realm="oauth2"`)
+			return ctx.JSON(http.StatusUnauthorized, oauthErrorResponse{Error: "invalid_client"})
+		}
+
+		if ctx.FormValue("grant_type") != "authorization_code" {
+			return ctx.JSON(http.StatusBadRequest, oauthErrorResponse{Error: "unsupported_grant_type"})
+		}
+
+		code, err := sessions.redeemAuthorizationCode(ctx.Request().Context(), ctx.FormValue("code"))
+		if err != nil {
+			ctx.Logger().Errorf("Invalid authorization code: %v\n", err)
+			return ctx.JSON(http.StatusBadRequest, oauthErrorResponse{Error: "invalid_grant", ErrorDescription: "authorization code is invalid or expired"})
+		}
+		if code.TenantID != client.TenantID || code.ClientID != client.ID || code.RedirectURI != ctx.FormValue("redirect_uri") {
+			return ctx.JSON(http.StatusBadRequest, oauthErrorResponse{Error: "invalid_grant", ErrorDescription: "authorization code was issued to another client or redirect_uri"})
+		}
+		if !verifyCodeChallenge(ctx.FormValue("code_verifier"), code.CodeChallenge) {
+			return ctx.JSON(http.StatusBadRequest, oauthErrorResponse{Error: "invalid_grant", ErrorDescription: "code_verifier does not match"})
+		}
+
+		// 認可してからトークンを発行するまでに、アカウントが無効化されているかもしれない
+		user, err := findUserByID(ctx.Request().Context(), db, code.UserID)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to find user: %v\n", err)
+			return ctx.JSON(http.StatusBadRequest, oauthErrorResponse{Error: "invalid_grant", ErrorDescription: "user is not found"})
+		}
+		if err := user.checkActive(time.Now()); err != nil {
+			return ctx.JSON(http.StatusBadRequest, oauthErrorResponse{Error: "invalid_grant", ErrorDescription: "account is not active"})
+		}
+
+		accessToken, err := sessions.createAccessToken(ctx.Request().Context(), &oidcAccessToken{
+			TenantID: client.TenantID,
+			UserID:   user.ID,
+			ClientID: client.ID,
+			Scopes:   code.Scopes,
+		})
+		if err != nil {
+			ctx.Logger().Errorf("Failed to create access token: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, oauthErrorResponse{Error: "server_error"})
+		}
+
+		now := time.Now()
+		amr, acr := oidcAuthenticationMethods(code.UserVerified)
+		claims := &idTokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    cfg.tenantIssuer(client.TenantID),
+				Subject:   user.ID,
+				Audience:  jwt.ClaimStrings{client.ID},
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(oidcIDTokenDuration)),
+			},
+			Nonce:    code.Nonce,
+			AuthTime: code.AuthTime.Unix(),
+			AMR:      amr,
+			ACR:      acr,
+		}
+		if slices.Contains(code.Scopes, oidcScopeProfile) {
+			claims.Name = user.Name
+			claims.PreferredUsername = user.Name
+		}
+		idToken, err := signJWT(ctx.Request().Context(), db, cfg, "JWT", claims)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to sign id token: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, oauthErrorResponse{Error: "server_error"})
+		}
+
+		return ctx.JSON(http.StatusOK, oidcTokenResponse{
+			AccessToken: accessToken,
+			TokenType:   "Bearer",
+			ExpiresIn:   int(oidcAccessTokenDuration.Seconds()),
+			IDToken:     idToken,
+			Scope:       strings.Join(code.Scopes, " "),
+		})
+	}
+}
+
+type oidcUserInfoResponse struct {
+	Subject           string `json:"sub"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+}
+
+// UserInfoエンドポイント。アクセストークンのユーザーの情報を返す。他のテナントで発行されたアクセストークンは使えない。
+func oidcUserInfo(db *bun.DB, sessions *sessionStore) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		invalidToken := func() error {
+			ctx.Response().Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			return ctx.JSON(http.StatusUnauthorized, oauthErrorResponse{Error: "invalid_token"})
+		}
+
+		token, ok := strings.CutPrefix(ctx.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if !ok || token == "" {
+			return invalidToken()
+		}
+		accessToken, err := sessions.getAccessToken(ctx.Request().Context(), token)
+		if err != nil || accessToken.TenantID != currentTenant(ctx).ID {
+			return invalidToken()
+		}
+
+		user, err := findUserByID(ctx.Request().Context(), db, accessToken.UserID)
+		if err != nil || user.checkActive(time.Now()) != nil {
+			return invalidToken()
+		}
+
+		res := oidcUserInfoResponse{Subject: user.ID}
+		if slices.Contains(accessToken.Scopes, oidcScopeProfile) {
+			res.Name = user.Name
+			res.PreferredUsername = user.Name
+		}
+
+		return ctx.JSON(http.StatusOK, res)
+	}
+}
+
+type createOIDCClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// false の場合はシークレットを発行しない公開クライアントになる
+	Confidential bool `json:"confidential"`
+}
+
+type createOIDCClientResponse struct {
+	OIDCClient
+	// シークレットは作成時にのみ返す
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// リダイレクトURIは完全一致で照合するので、登録時にフラグメントを含まない絶対URLであることを確認しておく。
+func validateRedirectURI(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("redirect_uri must be an absolute http(s) url: %s", v)
+	}
+	if u.Fragment != "" {
+		return fmt.Errorf("redirect_uri must not contain a fragment: %s", v)
+	}
+
+	return nil
+}
+
+func adminCreateOIDCClient(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var req createOIDCClientRequest
+		if err := ctx.Bind(&req); err != nil {
+			ctx.Logger().Errorf("Failed to process request: %v\n", err)
+			return ctx.JSON(http.StatusBadRequest, nil)
+		}
+
+		if req.Name == "" {
+			return ctx.JSON(http.StatusBadRequest, "Name is required")
+		}
+		if len(req.RedirectURIs) == 0 {
+			return ctx.JSON(http.StatusBadRequest, "At least one redirect_uri is required")
+		}
+		for _, v := range req.RedirectURIs {
+			if err := validateRedirectURI(v); err != nil {
+				return ctx.JSON(http.StatusBadRequest, err.Error())
+			}
+		}
+
+		client := &OIDCClient{
+			TenantID:     currentTenant(ctx).ID,
+			Name:         req.Name,
+			RedirectURIs: req.RedirectURIs,
+		}
+		var secret string
+		if req.Confidential {
+			s, err := random(32)
+			if err != nil {
+				ctx.Logger().Errorf("Failed to generate secret: %v\n", err)
+				return ctx.JSON(http.StatusInternalServerError, nil)
+			}
+			secret = "cs_" + s
+			client.SecretHash = hashToken(secret)
+		}
+
+		_, err := db.NewInsert().
+			Model(client).
+			Column("tenant_id", "name", "secret_hash", "redirect_uris").
+			Returning("*").
+			Exec(ctx.Request().Context())
+		if err != nil {
+			ctx.Logger().Errorf("Failed to insert oidc client: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		setAdminAuditDetail(ctx, map[string]interface{}{"client_id": client.ID, "name": client.Name})
+
+		return ctx.JSON(http.StatusCreated, createOIDCClientResponse{
+			OIDCClient:   *client,
+			ClientSecret: secret,
+		})
+	}
+}
+
+func adminListOIDCClients(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		clients := []OIDCClient{}
+		err := db.NewSelect().
+			Model(&clients).
+			Where("tenant_id = ?", currentTenant(ctx).ID).
+			Order("created_at").
+			Scan(ctx.Request().Context())
+		if err != nil {
+			ctx.Logger().Errorf("Failed to select oidc clients: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		return ctx.JSON(http.StatusOK, clients)
+	}
+}
+
+func adminDeleteOIDCClient(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		clientID := ctx.Param("client_id")
+		setAdminAuditDetail(ctx, map[string]interface{}{"client_id": clientID})
+
+		res, err := db.NewDelete().
+			Model((*OIDCClient)(nil)).
+			Where("id::text = ?", clientID).
+			Where("tenant_id = ?", currentTenant(ctx).ID).
+			Exec(ctx.Request().Context())
+		if err != nil {
+			ctx.Logger().Errorf("Failed to delete oidc client: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ctx.JSON(http.StatusNotFound, nil)
+		}
+
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
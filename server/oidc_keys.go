@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+const oidcSigningAlgorithm = "ES256"
+
+// IDトークンの署名鍵。
+//
+// NOTE: デモなので秘密鍵はそのままDBに保存している。本番ではKMSなどで管理した方がよい。
+type OIDCSigningKey struct {
+	bun.BaseModel `bun:"table:oidc_signing_keys,alias:osk"`
+
+	ID         string    `bun:"id,pk"`
+	Algorithm  string    `bun:"algorithm"`
+	PrivateKey []byte    `bun:"private_key"`
+	CreatedAt  time.Time `bun:"created_at"`
+	// 署名に使い始める日時。それまでは JWKS で公開するだけにする
+	ActivatesAt time.Time `bun:"activates_at,nullzero"`
+	// 署名に使わなくなる日時。次の鍵を用意した時に、その鍵の ActivatesAt を設定する
+	RetiredAt time.Time `bun:"retired_at,nullzero"`
+}
+
+func (k *OIDCSigningKey) ecdsaKey() (*ecdsa.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(k.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", k.ID, err)
+	}
+
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an ECDSA key", k.ID)
+	}
+
+	return ecKey, nil
+}
+
+// 新しい署名鍵を生成する。kid は鍵とは関係のないランダムな値にする。
+func generateOIDCSigningKey() (*OIDCSigningKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	kid, err := random(16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCSigningKey{
+		ID:         kid,
+		Algorithm:  oidcSigningAlgorithm,
+		PrivateKey: der,
+	}, nil
+}
+
+// 現在署名に使う鍵を返す。署名に使い始めていない次の鍵や、退役した鍵は対象にしない。
+func findActiveSigningKey(ctx context.Context, db bun.IDB) (*OIDCSigningKey, error) {
+	now := time.Now()
+	var key OIDCSigningKey
+	err := db.NewSelect().
+		Model(&key).
+		Where("activates_at <= ?", now).
+		Where("retired_at IS NULL OR retired_at > ?", now).
+		OrderExpr("activates_at DESC").
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// 署名に使う鍵を返す。
+//
+// 鍵を切り替えると、JWKSをキャッシュしている利用者は新しい kid のトークンを検証できない。
+// そのため、署名に使い始めてから rotation - prepublication が経過したら次の鍵を作成してJWKSで公開し、
+// prepublication が経過してから(かつ今の鍵を rotation の間使ってから)次の鍵で署名する。
+// 今の鍵には、次の鍵で署名し始める日時を退役日時として設定する。
+//
+// 有効な鍵が1つもない場合は、まだ誰もキャッシュしていないので、作成した鍵ですぐに署名する。
+// 複数台のサーバーが同時にローテーションしないように、アドバイザリロックを取得してから作成する。
+func currentSigningKey(ctx context.Context, db bun.IDB, rotation, prepublication time.Duration) (*OIDCSigningKey, error) {
+	key, err := findActiveSigningKey(ctx, db)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	// 次の鍵を用意済み(退役日時を設定済み)の場合も、そのまま使う
+	if key != nil && (!key.RetiredAt.IsZero() || time.Since(key.ActivatesAt) < rotation-prepublication) {
+		return key, nil
+	}
+
+	err = db.RunInTx(ctx, nil, func(c context.Context, tx bun.Tx) error {
+		if _, err := tx.ExecContext(c, "SELECT pg_advisory_xact_lock(hashtext(?))", "oidc_signing_keys"); err != nil {
+			return err
+		}
+
+		// ロックを待っている間に、他のサーバーがローテーションしているかもしれない
+		current, err := findActiveSigningKey(c, tx)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if current != nil && (!current.RetiredAt.IsZero() || time.Since(current.ActivatesAt) < rotation-prepublication) {
+			key = current
+			return nil
+		}
+
+		newKey, err := generateOIDCSigningKey()
+		if err != nil {
+			return err
+		}
+		newKey.ActivatesAt = time.Now()
+		if current != nil {
+			newKey.ActivatesAt = current.ActivatesAt.Add(rotation)
+			// 次の鍵は、JWKSで prepublication の間公開してから使い始める
+			if earliest := time.Now().Add(prepublication); newKey.ActivatesAt.Before(earliest) {
+				newKey.ActivatesAt = earliest
+			}
+		}
+		_, err = tx.NewInsert().
+			Model(newKey).
+			Column("id", "algorithm", "private_key", "activates_at").
+			Returning("*").
+			Exec(c)
+		if err != nil {
+			return err
+		}
+
+		if current == nil {
+			key = newKey
+			return nil
+		}
+
+		_, err = tx.NewUpdate().
+			Model((*OIDCSigningKey)(nil)).
+			Set("retired_at = ?", newKey.ActivatesAt).
+			Where("id = ?", current.ID).
+			Exec(c)
+		if err != nil {
+			return err
+		}
+
+		key = current
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate signing key: %w", err)
+	}
+
+	return key, nil
+}
+
+// JWKSで公開する鍵を返す。
+// 署名に使い始める前の次の鍵も公開する。
+// 退役した鍵も、その鍵で署名したトークンを検証できるように retention の間は公開し続ける。
+func publishedSigningKeys(ctx context.Context, db bun.IDB, retention time.Duration) ([]OIDCSigningKey, error) {
+	keys := []OIDCSigningKey{}
+	err := db.NewSelect().
+		Model(&keys).
+		Where("retired_at IS NULL OR retired_at > ?", time.Now().Add(-retention)).
+		OrderExpr("created_at DESC").
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// 検証に使う公開鍵のキャッシュ。
+//
+// kid に対応する鍵は変わらないが、公開を終えた鍵で署名したトークンを受け付けないように、 ttl ごとにDBで確認し直す。
+// 確認し直す時に、期限の切れた鍵はキャッシュから取り除く。
+type signingKeyCache struct {
+	db        bun.IDB
+	retention time.Duration
+	ttl       time.Duration
+
+	mu   sync.Mutex
+	keys map[string]cachedSigningKey
+}
+
+type cachedSigningKey struct {
+	key      *ecdsa.PublicKey
+	loadedAt time.Time
+}
+
+func newSigningKeyCache(db bun.IDB, retention, ttl time.Duration) *signingKeyCache {
+	return &signingKeyCache{db: db, retention: retention, ttl: ttl, keys: map[string]cachedSigningKey{}}
+}
+
+// kid に対応する、検証に使う公開鍵を返す。JWKSで公開している鍵のみ対象にする。
+func (c *signingKeyCache) publicKey(ctx context.Context, kid string) (*ecdsa.PublicKey, error) {
+	c.mu.Lock()
+	cached, ok := c.keys[kid]
+	c.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < c.ttl {
+		return cached.key, nil
+	}
+
+	key, err := signingPublicKey(ctx, c.db, c.retention, kid)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, v := range c.keys {
+		if now.Sub(v.loadedAt) >= c.ttl {
+			delete(c.keys, k)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.keys[kid] = cachedSigningKey{key: key, loadedAt: now}
+
+	return key, nil
+}
+
+// kid に対応する、検証に使う公開鍵をDBから取得する。JWKSで公開している鍵のみ対象にする。
+func signingPublicKey(ctx context.Context, db bun.IDB, retention time.Duration, kid string) (*ecdsa.PublicKey, error) {
+	var k OIDCSigningKey
+	err := db.NewSelect().
+		Model(&k).
+		Where("id = ?", kid).
+		Where("retired_at IS NULL OR retired_at > ?", time.Now().Add(-retention)).
+		Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("signing key %s is not found: %w", kid, err)
+	}
+
+	privateKey, err := k.ecdsaKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &privateKey.PublicKey, nil
+}
+
+// 公開を終えた署名鍵を削除する。
+func pruneSigningKeys(ctx context.Context, db bun.IDB, before time.Time) (int64, error) {
+	res, err := db.NewDelete().
+		Model((*OIDCSigningKey)(nil)).
+		Where("retired_at < ?", before).
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// JSON Web Key。ES256の公開鍵のみ扱う。
+//
+// SEE: https://www.rfc-editor.org/rfc/rfc7517
+type jwk struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+func newJWK(k *OIDCSigningKey) (*jwk, error) {
+	key, err := k.ecdsaKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// 座標はカーブのサイズに合わせて0埋めする
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return &jwk{
+		KeyType:   "EC",
+		Curve:     key.Curve.Params().Name,
+		X:         base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		Y:         base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+		Use:       "sig",
+		Algorithm: k.Algorithm,
+		KeyID:     k.ID,
+	}, nil
+}
@@ -0,0 +1,676 @@
+package passkey_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daikideal/go-passkey-demo/passkey"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+)
+
+// 同じシナリオを Echo と net/http のアダプターで実行し、ステータスコードとレスポンスが一致することを確認する。
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost"
+	testScope  = "test"
+)
+
+// ストアの日時を固定して、アダプター間でレスポンスを比較できるようにする
+var testNow = time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+
+type adapter struct {
+	name string
+	new  func(svc *passkey.Service, rp *passkey.RelyingParty) (http.Handler, error)
+}
+
+var adapters = []adapter{
+	{
+		name: "echo",
+		new: func(svc *passkey.Service, rp *passkey.RelyingParty) (http.Handler, error) {
+			h, err := passkey.NewEchoHandler(svc, passkey.EchoConfig{
+				RelyingParty: func(echo.Context) (*passkey.RelyingParty, error) { return rp, nil },
+			})
+			if err != nil {
+				return nil, err
+			}
+			e := echo.New()
+			e.Logger.SetOutput(io.Discard)
+			h.Register(e)
+			return e, nil
+		},
+	},
+	{
+		name: "net/http",
+		new: func(svc *passkey.Service, rp *passkey.RelyingParty) (http.Handler, error) {
+			return passkey.NewHTTPHandler(svc, passkey.HTTPConfig{
+				RelyingParty: func(*http.Request) (*passkey.RelyingParty, error) { return rp, nil },
+				Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+			})
+		},
+	},
+}
+
+// シナリオの各ステップの結果。アダプター間で比較する。
+type result struct {
+	Status      int
+	ContentType string
+	Body        string
+}
+
+type scenario struct {
+	t      *testing.T
+	url    string
+	client *http.Client
+	store  *memoryStore
+	auth   *authenticator
+	// 登録していない認証器。他人の userHandle を指定したアサーションに使う
+	foreign *authenticator
+
+	challenge  string
+	userID     string
+	created    []byte
+	asserted   []byte
+	ceremonyID string
+}
+
+type step struct {
+	name   string
+	method string
+	path   func(s *scenario) string
+	body   func(s *scenario) []byte
+	header func(s *scenario) http.Header
+	want   int
+	// チャレンジなど、実行ごとに変わるレスポンスは比較しない
+	compareBody bool
+	check       func(s *scenario, body []byte)
+}
+
+func fixed(v string) func(*scenario) string { return func(*scenario) string { return v } }
+
+var steps = []step{
+	{
+		name: "begin registration", method: http.MethodPost, path: fixed("/registration/options"),
+		body: func(*scenario) []byte { return []byte(`{"username":"alice"}`) },
+		want: http.StatusOK,
+		check: func(s *scenario, body []byte) {
+			var creation protocol.CredentialCreation
+			if err := json.Unmarshal(body, &creation); err != nil {
+				s.t.Fatalf("failed to decode creation options: %v", err)
+			}
+			s.challenge = creation.Response.Challenge.String()
+			id, _ := base64.RawURLEncoding.DecodeString(creation.Response.User.ID.(string))
+			s.userID = string(id)
+		},
+	},
+	{
+		name: "finish registration", method: http.MethodPost, path: fixed("/registration/verifications"),
+		body: func(s *scenario) []byte {
+			s.created = s.auth.create(s.challenge)
+			return s.created
+		},
+		want: http.StatusCreated, compareBody: true,
+	},
+	{
+		name: "replay registration", method: http.MethodPost, path: fixed("/registration/verifications"),
+		body: func(s *scenario) []byte { return s.created },
+		want: http.StatusBadRequest, compareBody: true,
+	},
+	{
+		name: "begin registration for existing user without authorization", method: http.MethodPost, path: fixed("/registration/options"),
+		body: func(*scenario) []byte { return []byte(`{"username":"alice"}`) },
+		want: http.StatusForbidden, compareBody: true,
+	},
+	{
+		name: "begin login", method: http.MethodPost, path: fixed("/authentication/options"),
+		want: http.StatusOK,
+		check: func(s *scenario, body []byte) {
+			var assertion protocol.CredentialAssertion
+			if err := json.Unmarshal(body, &assertion); err != nil {
+				s.t.Fatalf("failed to decode assertion options: %v", err)
+			}
+			s.challenge = assertion.Response.Challenge.String()
+		},
+	},
+	{
+		name: "finish login with tampered signature", method: http.MethodPost, path: fixed("/authentication/verifications"),
+		body: func(s *scenario) []byte { return s.auth.get(s.challenge, []byte(s.userID), true) },
+		want: http.StatusBadRequest, compareBody: true,
+	},
+	{
+		name: "finish login with foreign credential", method: http.MethodPost, path: fixed("/authentication/verifications"),
+		body: func(s *scenario) []byte { return s.foreign.get(s.challenge, []byte(s.userID), false) },
+		want: http.StatusBadRequest, compareBody: true,
+	},
+	{
+		name: "finish login", method: http.MethodPost, path: fixed("/authentication/verifications"),
+		body: func(s *scenario) []byte {
+			s.asserted = s.auth.get(s.challenge, []byte(s.userID), false)
+			return s.asserted
+		},
+		want: http.StatusOK, compareBody: true,
+	},
+	{
+		name: "replay login", method: http.MethodPost, path: fixed("/authentication/verifications"),
+		body: func(s *scenario) []byte { return s.asserted },
+		want: http.StatusBadRequest, compareBody: true,
+	},
+	{
+		name: "begin login for client without cookies", method: http.MethodPost, path: fixed("/authentication/options"),
+		want: http.StatusOK,
+		check: func(s *scenario, body []byte) {
+			var assertion protocol.CredentialAssertion
+			if err := json.Unmarshal(body, &assertion); err != nil {
+				s.t.Fatalf("failed to decode assertion options: %v", err)
+			}
+			s.challenge = assertion.Response.Challenge.String()
+			// Cookieの代わりにヘッダーで送り返す
+			s.client.Jar, _ = cookiejar.New(nil)
+		},
+	},
+	{
+		name: "finish login with ceremony session header", method: http.MethodPost, path: fixed("/authentication/verifications"),
+		body:   func(s *scenario) []byte { return s.auth.get(s.challenge, []byte(s.userID), false) },
+		header: func(s *scenario) http.Header { return http.Header{passkey.CeremonySessionHeader: {s.ceremonyID}} },
+		want:   http.StatusOK, compareBody: true,
+	},
+	{
+		name: "list credentials", method: http.MethodGet, path: func(s *scenario) string { return "/users/" + s.userID + "/public_keys" },
+		want: http.StatusOK, compareBody: true,
+		check: func(s *scenario, body []byte) {
+			var res []passkey.CredentialResponse
+			if err := json.Unmarshal(body, &res); err != nil {
+				s.t.Fatalf("failed to decode credentials: %v", err)
+			}
+			if len(res) != 1 || res[0].Status != passkey.CredentialStatusActive {
+				s.t.Errorf("credentials = %+v, want 1 active credential", res)
+			}
+		},
+	},
+	{
+		name: "disable credential", method: http.MethodPost, path: func(s *scenario) string { return "/users/" + s.userID + "/public_keys/1/disable" },
+		body: func(*scenario) []byte { return []byte(`{"reason":"lost"}`) },
+		want: http.StatusNoContent, compareBody: true,
+	},
+	{
+		name: "list disabled credentials", method: http.MethodGet, path: func(s *scenario) string { return "/users/" + s.userID + "/public_keys" },
+		want: http.StatusOK, compareBody: true,
+		check: func(s *scenario, body []byte) {
+			var res []passkey.CredentialResponse
+			if err := json.Unmarshal(body, &res); err != nil {
+				s.t.Fatalf("failed to decode credentials: %v", err)
+			}
+			if len(res) != 1 || res[0].Status != passkey.CredentialStatusDisabled || res[0].RevokedReason != "lost" {
+				s.t.Errorf("credentials = %+v, want 1 credential disabled as lost", res)
+			}
+		},
+	},
+	{
+		name: "enable missing credential", method: http.MethodPost, path: func(s *scenario) string { return "/users/" + s.userID + "/public_keys/9/enable" },
+		want: http.StatusNotFound, compareBody: true,
+	},
+	{
+		name: "enable credential", method: http.MethodPost, path: func(s *scenario) string { return "/users/" + s.userID + "/public_keys/1/enable" },
+		want: http.StatusNoContent, compareBody: true,
+	},
+	{
+		name: "delete credential", method: http.MethodDelete, path: func(s *scenario) string { return "/users/" + s.userID + "/public_keys/1" },
+		want: http.StatusNoContent, compareBody: true,
+	},
+	{
+		name: "list deleted credentials", method: http.MethodGet, path: func(s *scenario) string { return "/users/" + s.userID + "/public_keys" },
+		want: http.StatusOK, compareBody: true,
+	},
+}
+
+func TestAdapters(t *testing.T) {
+	wa, err := webauthn.New(&webauthn.Config{RPID: testRPID, RPDisplayName: "test", RPOrigins: []string{testOrigin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := &passkey.RelyingParty{WebAuthn: wa, Scope: testScope}
+
+	results := make([][]result, len(adapters))
+	for i, a := range adapters {
+		t.Run(a.name, func(t *testing.T) {
+			store := newMemoryStore()
+			svc, err := passkey.NewService(passkey.ServiceConfig{
+				Users:       store,
+				Credentials: store,
+				Sessions:    store,
+				OnEvent:     store.recordEvent,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := a.new(svc, rp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := httptest.NewServer(h)
+			defer srv.Close()
+
+			jar, _ := cookiejar.New(nil)
+			s := &scenario{t: t, url: srv.URL, client: &http.Client{Jar: jar}, store: store, auth: &authenticator{}, foreign: newUnregisteredAuthenticator()}
+			for _, st := range steps {
+				res, body := s.do(st)
+				if res.Status != st.want {
+					t.Fatalf("%s: status = %d, want %d (body: %s)", st.name, res.Status, st.want, body)
+				}
+				if st.check != nil {
+					st.check(s, body)
+				}
+				if !st.compareBody {
+					res.Body = ""
+				}
+				results[i] = append(results[i], res)
+			}
+
+			checkEvents(t, store.events(), s.foreign.credentialID)
+		})
+	}
+
+	// すべてのアダプターで、同じステータスコードとレスポンスを返す
+	for i := 1; i < len(adapters); i++ {
+		for j, st := range steps {
+			if j >= len(results[0]) || j >= len(results[i]) {
+				break
+			}
+			if results[0][j] != results[i][j] {
+				t.Errorf("%s: %s returned %+v, %s returned %+v", st.name, adapters[0].name, results[0][j], adapters[i].name, results[i][j])
+			}
+		}
+	}
+}
+
+func (s *scenario) do(st step) (result, []byte) {
+	s.t.Helper()
+
+	var body io.Reader
+	if st.body != nil {
+		body = bytes.NewReader(st.body(s))
+	}
+	req, err := http.NewRequest(st.method, s.url+st.path(s), body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if st.header != nil {
+		for k, v := range st.header(s) {
+			req.Header[k] = v
+		}
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		s.t.Fatalf("%s: %v", st.name, err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		s.t.Fatalf("%s: %v", st.name, err)
+	}
+	if v := res.Header.Get(passkey.CeremonySessionHeader); v != "" {
+		s.ceremonyID = v
+	}
+
+	return result{Status: res.StatusCode, ContentType: res.Header.Get("Content-Type"), Body: string(b)}, b
+}
+
+// 監査ログやロックに必要な情報が、どのアダプターからも OnEvent に渡されることを確認する。
+// 登録していない認証器(foreignCredentialID)での失敗は、ロックの対象にならないことも確認する。
+func checkEvents(t *testing.T, events []recordedEvent, foreignCredentialID []byte) {
+	t.Helper()
+
+	var verificationFailures, foreignFailures, logins int
+	for _, ev := range events {
+		if ev.info == nil {
+			t.Errorf("%s event has no request info", ev.Type)
+			continue
+		}
+		if ev.info.IP == "" || ev.info.UserAgent == "" || ev.info.Logger == nil {
+			t.Errorf("%s event has incomplete request info: %+v", ev.Type, ev.info)
+		}
+		if ev.Type == passkey.EventLogin && ev.VerificationFailed {
+			verificationFailures++
+		}
+		if ev.Type == passkey.EventLogin && ev.Success {
+			logins++
+		}
+		if ev.Type == passkey.EventLogin && !ev.Success && bytes.Equal(ev.RawCredentialID, foreignCredentialID) {
+			foreignFailures++
+			if ev.VerificationFailed {
+				t.Errorf("login with foreign credential is counted as a verification failure: %+v", ev.Event)
+			}
+		}
+	}
+	if foreignFailures != 1 {
+		t.Errorf("login failures with foreign credential = %d, want 1", foreignFailures)
+	}
+	if verificationFailures != 1 {
+		t.Errorf("login verification failures = %d, want 1", verificationFailures)
+	}
+	if logins != 2 {
+		t.Errorf("successful logins = %d, want 2", logins)
+	}
+}
+
+type recordedEvent struct {
+	passkey.Event
+	info *passkey.RequestInfo
+}
+
+// ユーザー・認証器・セッションをメモリに保存するストア。
+type memoryStore struct {
+	mu          sync.Mutex
+	users       map[string]*memoryUser
+	sessions    map[string]*passkey.Session
+	nextID      int
+	nextSession int
+	recorded    []recordedEvent
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{users: map[string]*memoryUser{}, sessions: map[string]*passkey.Session{}}
+}
+
+func (s *memoryStore) recordEvent(ctx context.Context, ev *passkey.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, _ := passkey.RequestInfoFrom(ctx)
+	s.recorded = append(s.recorded, recordedEvent{Event: *ev, info: info})
+}
+
+func (s *memoryStore) events() []recordedEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]recordedEvent{}, s.recorded...)
+}
+
+type memoryUser struct {
+	id, name    string
+	credentials []*passkey.Credential
+	webauthn    []webauthn.Credential
+}
+
+func (u *memoryUser) WebAuthnID() []byte                         { return []byte(u.id) }
+func (u *memoryUser) WebAuthnName() string                       { return u.name }
+func (u *memoryUser) WebAuthnDisplayName() string                { return u.name }
+func (u *memoryUser) WebAuthnCredentials() []webauthn.Credential { return u.webauthn }
+func (u *memoryUser) UserID() string                             { return u.id }
+func (u *memoryUser) CheckActive() error                         { return nil }
+
+func (u *memoryUser) CredentialExcludeList() []protocol.CredentialDescriptor {
+	list := make([]protocol.CredentialDescriptor, len(u.webauthn))
+	for i, c := range u.webauthn {
+		list[i] = c.Descriptor()
+	}
+	return list
+}
+
+func (s *memoryStore) FindUserByName(_ context.Context, _, name string) (passkey.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.name == name {
+			return u, nil
+		}
+	}
+	return nil, passkey.ErrUserNotFound
+}
+
+func (s *memoryStore) FindUserByID(_ context.Context, _ string, userHandle []byte) (passkey.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[string(userHandle)]; ok {
+		return u, nil
+	}
+	return nil, passkey.ErrUserNotFound
+}
+
+func (s *memoryStore) NewUser(_, name string, userHandle []byte) passkey.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := string(userHandle)
+	if userHandle == nil {
+		s.nextID++
+		id = fmt.Sprintf("user-%d", s.nextID)
+	}
+	return &memoryUser{id: id, name: name}
+}
+
+func (s *memoryStore) AddCredential(_ context.Context, user passkey.User, newUser bool, credential *webauthn.Credential) (*passkey.Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := user.(*memoryUser)
+	if newUser {
+		for _, v := range s.users {
+			if v.name == u.name {
+				return nil, passkey.ErrUserNameTaken
+			}
+		}
+		s.users[u.id] = u
+	}
+
+	cred := &passkey.Credential{
+		ID:            fmt.Sprint(len(u.credentials) + 1),
+		UserID:        u.id,
+		CredentialID:  credential.ID,
+		Flags:         credential.Flags,
+		Authenticator: credential.Authenticator,
+		CreatedAt:     testNow,
+	}
+	u.credentials = append(u.credentials, cred)
+	u.webauthn = append(u.webauthn, *credential)
+	return cred, nil
+}
+
+func (s *memoryStore) UpdateCredential(_ context.Context, user passkey.User, credential *webauthn.Credential) (*passkey.Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := user.(*memoryUser)
+	for i, c := range u.credentials {
+		if bytes.Equal(c.CredentialID, credential.ID) {
+			u.webauthn[i] = *credential
+			c.Authenticator = credential.Authenticator
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) ListCredentials(_ context.Context, _, userID string) ([]passkey.Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []passkey.Credential
+	if u, ok := s.users[userID]; ok {
+		for _, c := range u.credentials {
+			res = append(res, *c)
+		}
+	}
+	return res, nil
+}
+
+func (s *memoryStore) DeleteCredential(_ context.Context, userID, id string) (*passkey.Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, nil
+	}
+	for i, c := range u.credentials {
+		if c.ID == id {
+			u.credentials = append(u.credentials[:i], u.credentials[i+1:]...)
+			u.webauthn = append(u.webauthn[:i], u.webauthn[i+1:]...)
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) SetCredentialDisabled(_ context.Context, userID, id string, disabled bool, reason string) (*passkey.Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, nil
+	}
+	for _, c := range u.credentials {
+		if c.ID == id {
+			c.DisabledAt, c.RevokedReason = time.Time{}, ""
+			if disabled {
+				c.DisabledAt, c.RevokedReason = testNow, reason
+			}
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// Redisと同じく、保存した時点の値を返すようにJSONにしてから保存する。
+func (s *memoryStore) CreateSession(_ context.Context, session *passkey.Session, _ time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	var stored passkey.Session
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return "", err
+	}
+	s.nextSession++
+	id := fmt.Sprintf("session-%d", s.nextSession)
+	s.sessions[id] = &stored
+	return id, nil
+}
+
+func (s *memoryStore) GetSession(_ context.Context, id string) (*passkey.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("session %s is not found", id)
+	}
+	return session, nil
+}
+
+func (s *memoryStore) DeleteSession(_ context.Context, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// テスト用の認証器。ES256の鍵で、アテステーションなし(none)の登録と、認証の署名を行う。
+type authenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+var b64 = base64.RawURLEncoding
+
+// どのユーザーにも登録していない認証器を作成する。
+func newUnregisteredAuthenticator() *authenticator {
+	a := &authenticator{}
+	a.create("")
+	return a
+}
+
+func authenticatorData(flags protocol.AuthenticatorFlags, signCount uint32, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	b := append([]byte{}, rpIDHash[:]...)
+	b = append(b, byte(flags))
+	b = binary.BigEndian.AppendUint32(b, signCount)
+	return append(b, attested...)
+}
+
+func clientData(typ, challenge string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": testOrigin})
+	return b
+}
+
+// navigator.credentials.create() の結果を作成する。
+func (a *authenticator) create(challenge string) []byte {
+	a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.credentialID = make([]byte, 16)
+	rand.Read(a.credentialID)
+
+	publicKey, _ := cbor.Marshal(map[int]any{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	// AAGUID(ゼロ)、クレデンシャルIDの長さ、クレデンシャルID、公開鍵
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+
+	flags := protocol.FlagUserPresent | protocol.FlagUserVerified | protocol.FlagAttestedCredentialData
+	attestationObject, _ := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": authenticatorData(flags, 0, attested),
+	})
+
+	body, _ := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(a.credentialID),
+		"rawId": b64.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(clientData("webauthn.create", challenge)),
+			"attestationObject": b64.EncodeToString(attestationObject),
+		},
+	})
+	return body
+}
+
+// navigator.credentials.get() の結果を作成する。 tamper が true の場合は、署名を壊す。
+func (a *authenticator) get(challenge string, userHandle []byte, tamper bool) []byte {
+	a.signCount++
+	authData := authenticatorData(protocol.FlagUserPresent|protocol.FlagUserVerified, a.signCount, nil)
+	cd := clientData("webauthn.get", challenge)
+	cdHash := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdHash[:]...))
+	signature, _ := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if tamper {
+		signature[len(signature)-1] ^= 1
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(a.credentialID),
+		"rawId": b64.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(cd),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(signature),
+			"userHandle":        b64.EncodeToString(userHandle),
+		},
+	})
+	return body
+}
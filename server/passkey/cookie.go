@@ -0,0 +1,71 @@
+package passkey
+
+import (
+	"net/http"
+	"time"
+)
+
+// Cookieの作成と読み込みは、属性や名前の付け方をそろえるためにすべて CookieFactory を通す。
+//
+// 本番環境では、Secure 属性を付けて名前に __Host- プレフィックスを付ける。
+// __Host- プレフィックスのCookieは、HTTPSで Path=/ かつ Domain 属性なしでないと保存されないので、サブドメインなどから上書きされない。
+//
+// SEE: https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Set-Cookie#cookie_prefixes
+
+const hostCookiePrefix = "__Host-"
+
+// 認証器の登録・認証のセッションIDを保存するCookieの名前
+const (
+	RegistrationCookieName   = "registration"
+	AuthenticationCookieName = "authentication"
+)
+
+// 認証のセッションIDを、Cookieを扱えないクライアントとやりとりするためのヘッダー
+const CeremonySessionHeader = "X-Ceremony-Session"
+
+type CookieFactory struct {
+	Production bool
+}
+
+// 環境に合わせたCookieの名前を返す。
+func (f CookieFactory) Name(name string) string {
+	if f.Production {
+		return hostCookiePrefix + name
+	}
+	return name
+}
+
+func (f CookieFactory) Secure() bool {
+	return f.Production
+}
+
+// Cookieを作成する。JavaScriptから読む必要のあるCookieはないので、すべて HttpOnly にする。
+// maxAge が0の場合は、ブラウザを閉じるまで有効なCookieになる。
+func (f CookieFactory) New(name, value string, maxAge time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     f.Name(name),
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   f.Secure(),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// リクエストからCookieを読み込む。
+func (f CookieFactory) Get(r *http.Request, name string) (*http.Cookie, error) {
+	return r.Cookie(f.Name(name))
+}
+
+// リクエストから登録・認証のセッションIDを取得する。Cookieがない場合はヘッダーを見る。
+func (f CookieFactory) ceremonySessionID(r *http.Request, name string) (string, bool) {
+	if cookie, err := f.Get(r, name); err == nil {
+		return cookie.Value, true
+	}
+	if v := r.Header.Get(CeremonySessionHeader); v != "" {
+		return v, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,108 @@
+package passkey
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 認証器の状態
+const (
+	CredentialStatusActive   = "active"
+	CredentialStatusDisabled = "disabled"
+)
+
+// 認証器の一覧のレスポンス。公開鍵やクレデンシャルIDは返さない。
+type CredentialResponse struct {
+	ID            string     `json:"id"`
+	AAGUID        string     `json:"AAGUID"`
+	Status        string     `json:"status"`
+	DisabledAt    *time.Time `json:"disabled_at,omitempty"`
+	RevokedReason string     `json:"revoked_reason,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+func (c *Credential) Status() string {
+	if c.Disabled() {
+		return CredentialStatusDisabled
+	}
+	return CredentialStatusActive
+}
+
+// スコープ内のユーザーの認証器の一覧を返す。
+func (s *Service) ListCredentials(ctx context.Context, rp *RelyingParty, userID string) ([]CredentialResponse, error) {
+	credentials, err := s.credentials.ListCredentials(ctx, rp.Scope, userID)
+	if err != nil {
+		return nil, newError(CodeInternal, "", "Failed to select webauthn credentials: %w", err)
+	}
+
+	res := make([]CredentialResponse, 0, len(credentials))
+	for _, v := range credentials {
+		// 参考: https://github.com/go-webauthn/webauthn/blob/debcfe78a7c30c1d9115c889115fe583042c81a4/webauthn/login.go#L346
+		aaguid, err := uuid.FromBytes(v.Authenticator.AAGUID)
+		if err != nil {
+			// 壊れた認証器があっても、他の認証器は返す
+			continue
+		}
+
+		cred := CredentialResponse{
+			ID:            v.ID,
+			AAGUID:        aaguid.String(),
+			Status:        v.Status(),
+			RevokedReason: v.RevokedReason,
+			CreatedAt:     v.CreatedAt,
+		}
+		if v.Disabled() {
+			cred.DisabledAt = &v.DisabledAt
+		}
+		res = append(res, cred)
+	}
+
+	return res, nil
+}
+
+// 認証器を削除する。対象の認証器が見つからない場合もエラーにしない。
+func (s *Service) DeleteCredential(ctx context.Context, userID, credentialID string) error {
+	deleted, err := s.credentials.DeleteCredential(ctx, userID, credentialID)
+	if err != nil {
+		s.emit(ctx, &Event{Type: EventCredentialDelete, UserID: userID, CredentialID: credentialID, Reason: "failed to delete credential"})
+		return newError(CodeInternal, "", "Failed to delete webauthn credential: %w", err)
+	}
+	if deleted != nil {
+		s.emit(ctx, &Event{Type: EventCredentialDelete, Success: true, UserID: userID, Credential: deleted})
+	}
+
+	return nil
+}
+
+// 認証器を無効化するリクエスト。アダプターがリクエストボディから読み込む。
+type disableCredentialRequest struct {
+	Reason string `json:"reason"`
+}
+
+// 認証器を無効化、または有効化する。
+// 紛失の疑いがある場合などに、認証器を削除せずに一時的に使えなくするために使う。
+func (s *Service) SetCredentialDisabled(ctx context.Context, userID, credentialID string, disabled bool, reason string) error {
+	eventType := EventCredentialEnable
+	if disabled {
+		eventType = EventCredentialDisable
+	}
+
+	cred, err := s.credentials.SetCredentialDisabled(ctx, userID, credentialID, disabled, reason)
+	if errors.Is(err, ErrCredentialLocked) {
+		s.emit(ctx, &Event{Type: eventType, UserID: userID, CredentialID: credentialID, Reason: "credential is locked"})
+		return newError(CodeForbidden, "", "Webauthn credential cannot be enabled: %w", err)
+	}
+	if err != nil {
+		s.emit(ctx, &Event{Type: eventType, UserID: userID, CredentialID: credentialID, Reason: "failed to update credential"})
+		return newError(CodeInternal, "", "Failed to update webauthn credential: %w", err)
+	}
+	if cred == nil {
+		return newError(CodeNotFound, "", "Webauthn credential is not found: %s", credentialID)
+	}
+	s.emit(ctx, &Event{Type: eventType, Success: true, UserID: userID, Credential: cred, Reason: reason})
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package passkey
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Service を Echo のエンドポイントとして公開するアダプター。
+type EchoHandler struct {
+	svc *Service
+	cfg EchoConfig
+}
+
+type EchoConfig struct {
+	// リクエストの Relying Party を返す。
+	RelyingParty func(ctx echo.Context) (*RelyingParty, error)
+	// 登録・認証のセッションIDを保存するCookie
+	Cookies CookieFactory
+	// 認証に成功した後に呼ばれ、レスポンスを返す。ログインセッションの作成やトークンの発行はここで行う。
+	// 指定しない場合は、ユーザーIDだけを返す。
+	OnLogin func(ctx echo.Context, login *Login) error
+}
+
+func NewEchoHandler(svc *Service, cfg EchoConfig) (*EchoHandler, error) {
+	if cfg.RelyingParty == nil {
+		return nil, errors.New("passkey: RelyingParty is required")
+	}
+	if cfg.OnLogin == nil {
+		cfg.OnLogin = func(ctx echo.Context, login *Login) error {
+			return ctx.JSON(http.StatusOK, map[string]string{"user_id": login.User.UserID()})
+		}
+	}
+
+	return &EchoHandler{svc: svc, cfg: cfg}, nil
+}
+
+// ルートを登録できる *echo.Echo と *echo.Group 。
+type EchoRouter interface {
+	GET(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	POST(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	DELETE(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+}
+
+// すべてのエンドポイントを登録する。
+// 認証器の管理は本人のみに許可する必要があるので、 credentialMiddleware で認可を行うこと。
+//
+//   - POST /registration/options, /registration/verifications: 認証器の登録
+//   - POST /authentication/options, /authentication/verifications: 認証
+//   - GET /users/:user_id/public_keys: 認証器の一覧
+//   - DELETE /users/:user_id/public_keys/:credential_id: 認証器の削除
+//   - POST /users/:user_id/public_keys/:credential_id/disable, enable: 認証器の無効化・有効化
+func (h *EchoHandler) Register(r EchoRouter, credentialMiddleware ...echo.MiddlewareFunc) {
+	r.POST("/registration/options", h.BeginRegistration())
+	r.POST("/registration/verifications", h.FinishRegistration())
+	r.POST("/authentication/options", h.BeginLogin())
+	r.POST("/authentication/verifications", h.FinishLogin())
+	r.GET("/users/:user_id/public_keys", h.ListCredentials(), credentialMiddleware...)
+	r.DELETE("/users/:user_id/public_keys/:credential_id", h.DeleteCredential(), credentialMiddleware...)
+	r.POST("/users/:user_id/public_keys/:credential_id/disable", h.DisableCredential(), credentialMiddleware...)
+	r.POST("/users/:user_id/public_keys/:credential_id/enable", h.EnableCredential(), credentialMiddleware...)
+}
+
+type echoContextKey struct{}
+
+// Echo のアダプターから呼ばれた場合に、 Service に渡したコンテキストからリクエストの echo.Context を取得する。
+// ServiceConfig.OnEvent で、 RequestInfo にない Echo 固有の情報が必要な場合に使う。
+func EchoContext(ctx context.Context) (echo.Context, bool) {
+	c, ok := ctx.Value(echoContextKey{}).(echo.Context)
+	return c, ok
+}
+
+// リクエストの Relying Party を特定してから fn を呼び出す。
+// fn が返した *Error はログに出力し、エラーの種類に応じたレスポンスを返す。
+func (h *EchoHandler) handle(fn func(ctx context.Context, c echo.Context, rp *RelyingParty) error) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := context.WithValue(c.Request().Context(), echoContextKey{}, c)
+		ctx = WithRequestInfo(ctx, &RequestInfo{IP: c.RealIP(), UserAgent: c.Request().UserAgent(), Logger: echoLogger{c}})
+		ctx = withAnnotator(ctx, func(attrs ...any) { addLogAttrs(c, attrs...) })
+
+		rp, err := h.cfg.RelyingParty(c)
+		if err != nil {
+			err = newError(CodeInternal, "", "Failed to resolve relying party: %w", err)
+		} else {
+			err = fn(ctx, c, rp)
+		}
+
+		var e *Error
+		if !errors.As(err, &e) {
+			return err
+		}
+		if e.Code == CodeForbidden || e.Code == CodeConflict {
+			c.Logger().Warnf("%v\n", err)
+		} else {
+			c.Logger().Errorf("%v\n", err)
+		}
+		if e.Message != "" {
+			return c.JSON(e.Code.HTTPStatus(), e.Message)
+		}
+		return c.JSON(e.Code.HTTPStatus(), nil)
+	}
+}
+
+// 項目を追加した後のロガーに出力するように、ログを出力する時に ctx.Logger() を取得する。
+type echoLogger struct {
+	ctx echo.Context
+}
+
+func (l echoLogger) Errorf(format string, args ...any) { l.ctx.Logger().Errorf(format, args...) }
+func (l echoLogger) Warnf(format string, args ...any)  { l.ctx.Logger().Warnf(format, args...) }
+
+// 項目を追加できるロガー(構造化ログなど)
+type attrLogger interface {
+	With(attrs ...any) echo.Logger
+}
+
+// リクエストのロガーに項目を追加する。
+// ロガーが With を実装している場合のみ追加し、以降の ctx.Logger() のログに含まれる。
+func addLogAttrs(ctx echo.Context, attrs ...any) {
+	if l, ok := ctx.Logger().(attrLogger); ok {
+		ctx.SetLogger(l.With(attrs...))
+	}
+}
+
+func (h *EchoHandler) BeginRegistration() echo.HandlerFunc {
+	return h.handle(func(ctx context.Context, c echo.Context, rp *RelyingParty) error {
+		var req beginRegistrationRequest
+		if err := c.Bind(&req); err != nil {
+			return newError(CodeInvalidRequest, "", "Failed to process request: %w", err)
+		}
+
+		options, sessionID, err := h.svc.BeginRegistration(ctx, rp, req.Username)
+		if err != nil {
+			return err
+		}
+		c.SetCookie(h.cfg.Cookies.New(RegistrationCookieName, sessionID, h.svc.SessionTimeout()))
+
+		return c.JSON(http.StatusOK, options)
+	})
+}
+
+func (h *EchoHandler) FinishRegistration() echo.HandlerFunc {
+	return h.handle(func(ctx context.Context, c echo.Context, rp *RelyingParty) error {
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return newError(CodeInternal, "", "Failed to read request: %w", err)
+		}
+
+		var sessionID string
+		if cookie, err := h.cfg.Cookies.Get(c.Request(), RegistrationCookieName); err == nil {
+			sessionID = cookie.Value
+		}
+		if _, err := h.svc.FinishRegistration(ctx, rp, sessionID, body); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusCreated, "Registration success!")
+	})
+}
+
+func (h *EchoHandler) BeginLogin() echo.HandlerFunc {
+	return h.handle(func(ctx context.Context, c echo.Context, rp *RelyingParty) error {
+		options, sessionID, err := h.svc.BeginLogin(ctx, rp)
+		if err != nil {
+			return err
+		}
+		c.SetCookie(h.cfg.Cookies.New(AuthenticationCookieName, sessionID, h.svc.SessionTimeout()))
+		// Cookieを扱えないクライアントは、ヘッダーでセッションIDを受け取って verifications に送り返す
+		c.Response().Header().Set(CeremonySessionHeader, sessionID)
+
+		return c.JSON(http.StatusOK, options)
+	})
+}
+
+func (h *EchoHandler) FinishLogin() echo.HandlerFunc {
+	return h.handle(func(ctx context.Context, c echo.Context, rp *RelyingParty) error {
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return newError(CodeInternal, "", "Failed to read request: %w", err)
+		}
+
+		sessionID, _ := h.cfg.Cookies.ceremonySessionID(c.Request(), AuthenticationCookieName)
+		login, err := h.svc.FinishLogin(ctx, rp, sessionID, body)
+		if err != nil {
+			return err
+		}
+
+		return h.cfg.OnLogin(c, login)
+	})
+}
+
+func (h *EchoHandler) ListCredentials() echo.HandlerFunc {
+	return h.handle(func(ctx context.Context, c echo.Context, rp *RelyingParty) error {
+		res, err := h.svc.ListCredentials(ctx, rp, c.Param("user_id"))
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, res)
+	})
+}
+
+func (h *EchoHandler) DeleteCredential() echo.HandlerFunc {
+	return h.handle(func(ctx context.Context, c echo.Context, rp *RelyingParty) error {
+		if err := h.svc.DeleteCredential(ctx, c.Param("user_id"), c.Param("credential_id")); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+}
+
+func (h *EchoHandler) DisableCredential() echo.HandlerFunc {
+	return h.handle(func(ctx context.Context, c echo.Context, rp *RelyingParty) error {
+		var req disableCredentialRequest
+		if err := c.Bind(&req); err != nil {
+			return newError(CodeInvalidRequest, "", "Failed to process request: %w", err)
+		}
+		if err := h.svc.SetCredentialDisabled(ctx, c.Param("user_id"), c.Param("credential_id"), true, req.Reason); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+}
+
+func (h *EchoHandler) EnableCredential() echo.HandlerFunc {
+	return h.handle(func(ctx context.Context, c echo.Context, rp *RelyingParty) error {
+		if err := h.svc.SetCredentialDisabled(ctx, c.Param("user_id"), c.Param("credential_id"), false, ""); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,115 @@
+package passkey
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 登録・認証や認証器の操作の種類
+type EventType string
+
+const (
+	EventRegistration      EventType = "registration"
+	EventLogin             EventType = "login"
+	EventCredentialDelete  EventType = "credential.delete"
+	EventCredentialDisable EventType = "credential.disable"
+	EventCredentialEnable  EventType = "credential.enable"
+)
+
+// ServiceConfig.OnEvent に渡す、登録・認証や認証器の操作の結果。
+// ユーザーや認証器が特定できない失敗(セッション切れなど)の場合は、 UserID や Credential は空になる。
+type Event struct {
+	Type    EventType
+	Success bool
+	// 失敗した理由や、無効化の理由
+	Reason string
+
+	UserID string
+	// 登録・認証の場合のみ設定する
+	User User
+	// 操作した認証器。ストアから取得できなかった場合は nil で、 CredentialID か RawCredentialID だけを設定する。
+	Credential      *Credential
+	CredentialID    string
+	RawCredentialID []byte
+
+	// 認証器の検証に失敗したか。ログインの失敗回数を数えるのに使う。
+	// ユーザーが見つからない場合や、アカウントの状態によって拒否した場合、ユーザーの認証器ではないクレデンシャルIDの場合は false になる。
+	VerificationFailed bool
+}
+
+// 認証に成功したユーザーと認証器。アダプターの OnLogin に渡す。
+type Login struct {
+	User User
+	// 認証に使った認証器。ストアから取得できなかった場合は nil
+	Credential *Credential
+	// 認証器でユーザー検証(生体認証やPIN)が行われたかどうか
+	UserVerified bool
+	// 認証したスコープ
+	Scope string
+}
+
+// アダプターが Service に渡すコンテキストに設定する、リクエストの情報。
+// ServiceConfig.OnEvent で、フレームワークに依存せずに監査ログなどを記録するのに使う。
+// Service を直接呼び出す場合(gRPC など)は、呼び出し側が WithRequestInfo で設定する。
+type RequestInfo struct {
+	// クライアントのIPアドレス
+	IP        string
+	UserAgent string
+	// リクエストのロガー。ユーザーIDなど、 Service が追加した項目も出力される。
+	Logger Logger
+}
+
+// RequestInfo のロガー。 echo.Logger はそのまま使える。
+type Logger interface {
+	Errorf(format string, args ...any)
+	Warnf(format string, args ...any)
+}
+
+type requestInfoKey struct{}
+
+// Service に渡すコンテキストに、リクエストの情報を設定する。
+func WithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// Service に渡したコンテキストから、リクエストの情報を取得する。
+func RequestInfoFrom(ctx context.Context) (*RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info, ok
+}
+
+type annotatorKey struct{}
+
+// リクエストのログに項目を追加する関数を、コンテキストに設定する。アダプターが設定する。
+func withAnnotator(ctx context.Context, f func(attrs ...any)) context.Context {
+	return context.WithValue(ctx, annotatorKey{}, f)
+}
+
+// リクエストのログに項目(ユーザーIDなど)を追加する。アダプターが設定していない場合は何もしない。
+func annotate(ctx context.Context, attrs ...any) {
+	if f, ok := ctx.Value(annotatorKey{}).(func(attrs ...any)); ok {
+		f(attrs...)
+	}
+}
+
+var tracer = otel.Tracer("github.com/daikideal/go-passkey-demo/passkey")
+
+// go-webauthn の検証をスパンとして記録する。
+// 署名の検証や、アテステーションの証明書チェーンの検証に時間がかかっていないかを確認できるようにする。
+func traceWebAuthn(ctx context.Context, scope, name string, fn func() error) error {
+	_, span := tracer.Start(ctx, "webauthn."+name,
+		trace.WithAttributes(attribute.String("passkey.scope", scope)),
+	)
+	defer span.End()
+
+	err := fn()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,253 @@
+package passkey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Service を net/http のエンドポイントとして公開するアダプター。
+// 標準ライブラリの http.ServeMux や chi などのルーターに、 http.Handler としてマウントする。
+// プレフィックスの下にマウントする場合は、 http.StripPrefix と組み合わせる。
+//
+// エンドポイントは EchoHandler.Register と同じ。
+type HTTPHandler struct {
+	svc *Service
+	cfg HTTPConfig
+	mux *http.ServeMux
+}
+
+type HTTPConfig struct {
+	// リクエストの Relying Party を返す。
+	RelyingParty func(r *http.Request) (*RelyingParty, error)
+	// 登録・認証のセッションIDを保存するCookie
+	Cookies CookieFactory
+	// 認証に成功した後に呼ばれ、レスポンスを書き込む。ログインセッションの作成やトークンの発行はここで行う。
+	// 指定しない場合は、ユーザーIDだけを返す。
+	OnLogin func(w http.ResponseWriter, r *http.Request, login *Login)
+	// 認証器の管理のエンドポイントに適用するミドルウェア。本人のみに許可する必要があるので、ここで認可を行うこと。
+	CredentialMiddleware func(http.Handler) http.Handler
+	// エラーを出力するロガー。指定しない場合は slog.Default()
+	Logger *slog.Logger
+	// クライアントのIPアドレスを返す。指定しない場合は RemoteAddr を使う。
+	// リバースプロキシの後ろで動かす場合は、信頼できるプロキシが付けたヘッダーから取得すること。
+	ClientIP func(r *http.Request) string
+}
+
+func NewHTTPHandler(svc *Service, cfg HTTPConfig) (*HTTPHandler, error) {
+	if cfg.RelyingParty == nil {
+		return nil, errors.New("passkey: RelyingParty is required")
+	}
+	if cfg.OnLogin == nil {
+		cfg.OnLogin = func(w http.ResponseWriter, r *http.Request, login *Login) {
+			writeJSON(w, http.StatusOK, map[string]string{"user_id": login.User.UserID()})
+		}
+	}
+	if cfg.CredentialMiddleware == nil {
+		cfg.CredentialMiddleware = func(next http.Handler) http.Handler { return next }
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.ClientIP == nil {
+		cfg.ClientIP = remoteIP
+	}
+
+	h := &HTTPHandler{svc: svc, cfg: cfg, mux: http.NewServeMux()}
+	h.mux.Handle("POST /registration/options", h.handle(h.beginRegistration))
+	h.mux.Handle("POST /registration/verifications", h.handle(h.finishRegistration))
+	h.mux.Handle("POST /authentication/options", h.handle(h.beginLogin))
+	h.mux.Handle("POST /authentication/verifications", h.handle(h.finishLogin))
+	h.mux.Handle("GET /users/{user_id}/public_keys", cfg.CredentialMiddleware(h.handle(h.listCredentials)))
+	h.mux.Handle("DELETE /users/{user_id}/public_keys/{credential_id}", cfg.CredentialMiddleware(h.handle(h.deleteCredential)))
+	h.mux.Handle("POST /users/{user_id}/public_keys/{credential_id}/disable", cfg.CredentialMiddleware(h.handle(h.disableCredential)))
+	h.mux.Handle("POST /users/{user_id}/public_keys/{credential_id}/enable", cfg.CredentialMiddleware(h.handle(h.enableCredential)))
+
+	return h, nil
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+type httpRequestKey struct{}
+
+// net/http のアダプターから呼ばれた場合に、 Service に渡したコンテキストからリクエストを取得する。
+// ServiceConfig.OnEvent で、 RequestInfo にない情報(ヘッダーなど)が必要な場合に使う。
+func HTTPRequest(ctx context.Context) (*http.Request, bool) {
+	r, ok := ctx.Value(httpRequestKey{}).(*http.Request)
+	return r, ok
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// 項目を追加した後のロガーに出力するように、ログを出力する時にロガーを取得する。
+// echo.Logger に合わせて末尾に改行を付けた呼び出しもあるので、取り除いてから出力する。
+type slogPrintfLogger struct {
+	logger **slog.Logger
+}
+
+func (l slogPrintfLogger) Errorf(format string, args ...any) {
+	(*l.logger).Error(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+func (l slogPrintfLogger) Warnf(format string, args ...any) {
+	(*l.logger).Warn(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+// リクエストの Relying Party を特定してから fn を呼び出す。
+// fn が返したエラーはログに出力し、エラーの種類に応じたレスポンスを返す。
+func (h *HTTPHandler) handle(fn func(ctx context.Context, w http.ResponseWriter, r *http.Request, rp *RelyingParty) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := h.cfg.Logger
+		ctx := context.WithValue(r.Context(), httpRequestKey{}, r)
+		ctx = WithRequestInfo(ctx, &RequestInfo{IP: h.cfg.ClientIP(r), UserAgent: r.UserAgent(), Logger: slogPrintfLogger{&logger}})
+		ctx = withAnnotator(ctx, func(attrs ...any) { logger = logger.With(attrs...) })
+
+		rp, err := h.cfg.RelyingParty(r)
+		if err != nil {
+			err = newError(CodeInternal, "", "Failed to resolve relying party: %w", err)
+		} else {
+			err = fn(ctx, w, r, rp)
+		}
+		if err == nil {
+			return
+		}
+
+		code := CodeOf(err)
+		level := slog.LevelError
+		if code == CodeForbidden || code == CodeConflict {
+			level = slog.LevelWarn
+		}
+		logger.Log(ctx, level, err.Error())
+
+		if msg := messageOf(err); msg != "" {
+			writeJSON(w, code.HTTPStatus(), msg)
+			return
+		}
+		writeJSON(w, code.HTTPStatus(), nil)
+	})
+}
+
+// Echo の ctx.JSON と同じく、ボディが nil の場合は null を返す。
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *HTTPHandler) beginRegistration(ctx context.Context, w http.ResponseWriter, r *http.Request, rp *RelyingParty) error {
+	var req beginRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return newError(CodeInvalidRequest, "", "Failed to process request: %w", err)
+	}
+
+	options, sessionID, err := h.svc.BeginRegistration(ctx, rp, req.Username)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, h.cfg.Cookies.New(RegistrationCookieName, sessionID, h.svc.SessionTimeout()))
+	writeJSON(w, http.StatusOK, options)
+
+	return nil
+}
+
+func (h *HTTPHandler) finishRegistration(ctx context.Context, w http.ResponseWriter, r *http.Request, rp *RelyingParty) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return newError(CodeInternal, "", "Failed to read request: %w", err)
+	}
+
+	var sessionID string
+	if cookie, err := h.cfg.Cookies.Get(r, RegistrationCookieName); err == nil {
+		sessionID = cookie.Value
+	}
+	if _, err := h.svc.FinishRegistration(ctx, rp, sessionID, body); err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, "Registration success!")
+
+	return nil
+}
+
+func (h *HTTPHandler) beginLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, rp *RelyingParty) error {
+	options, sessionID, err := h.svc.BeginLogin(ctx, rp)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, h.cfg.Cookies.New(AuthenticationCookieName, sessionID, h.svc.SessionTimeout()))
+	// Cookieを扱えないクライアントは、ヘッダーでセッションIDを受け取って verifications に送り返す
+	w.Header().Set(CeremonySessionHeader, sessionID)
+	writeJSON(w, http.StatusOK, options)
+
+	return nil
+}
+
+func (h *HTTPHandler) finishLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, rp *RelyingParty) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return newError(CodeInternal, "", "Failed to read request: %w", err)
+	}
+
+	sessionID, _ := h.cfg.Cookies.ceremonySessionID(r, AuthenticationCookieName)
+	login, err := h.svc.FinishLogin(ctx, rp, sessionID, body)
+	if err != nil {
+		return err
+	}
+	h.cfg.OnLogin(w, r, login)
+
+	return nil
+}
+
+func (h *HTTPHandler) listCredentials(ctx context.Context, w http.ResponseWriter, r *http.Request, rp *RelyingParty) error {
+	res, err := h.svc.ListCredentials(ctx, rp, r.PathValue("user_id"))
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, res)
+
+	return nil
+}
+
+func (h *HTTPHandler) deleteCredential(ctx context.Context, w http.ResponseWriter, r *http.Request, rp *RelyingParty) error {
+	if err := h.svc.DeleteCredential(ctx, r.PathValue("user_id"), r.PathValue("credential_id")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+func (h *HTTPHandler) disableCredential(ctx context.Context, w http.ResponseWriter, r *http.Request, rp *RelyingParty) error {
+	var req disableCredentialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return newError(CodeInvalidRequest, "", "Failed to process request: %w", err)
+	}
+	if err := h.svc.SetCredentialDisabled(ctx, r.PathValue("user_id"), r.PathValue("credential_id"), true, req.Reason); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+func (h *HTTPHandler) enableCredential(ctx context.Context, w http.ResponseWriter, r *http.Request, rp *RelyingParty) error {
+	if err := h.svc.SetCredentialDisabled(ctx, r.PathValue("user_id"), r.PathValue("credential_id"), false, ""); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package passkey
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// 認証(Discoverable Login)を開始し、 navigator.credentials.get() に渡すオプションと、認証のセッションIDを返す。
+func (s *Service) BeginLogin(ctx context.Context, rp *RelyingParty) (*protocol.CredentialAssertion, string, error) {
+	annotate(ctx, "ceremony", "login", "phase", "begin")
+
+	var options *protocol.CredentialAssertion
+	var data *webauthn.SessionData
+	err := traceWebAuthn(ctx, rp.Scope, "BeginDiscoverableLogin", func() error {
+		var err error
+		options, data, err = rp.WebAuthn.BeginDiscoverableLogin()
+		return err
+	})
+	if err != nil {
+		return nil, "", newError(CodeInternal, "Failed to begin login", "Failed to begin login: %w", err)
+	}
+
+	sessionID, err := s.sessions.CreateSession(ctx, &Session{SessionData: *data, Scope: rp.Scope}, s.sessionTimeout)
+	if err != nil {
+		return nil, "", newError(CodeInternal, "", "Failed to start session: %w", err)
+	}
+
+	return options, sessionID, nil
+}
+
+// 認証を完了し、認証したユーザーと認証器を返す。
+// body は navigator.credentials.get() の結果(PublicKeyCredential)のJSON。
+func (s *Service) FinishLogin(ctx context.Context, rp *RelyingParty, sessionID string, body []byte) (*Login, error) {
+	annotate(ctx, "ceremony", "login", "phase", "finish")
+
+	if sessionID == "" {
+		return nil, newError(CodeInvalidRequest, "", "Session id is not set")
+	}
+	session, err := s.sessions.GetSession(ctx, sessionID)
+	if err == nil && session.Scope != rp.Scope {
+		err = fmt.Errorf("session belongs to another scope: %s", session.Scope)
+	}
+	if err != nil {
+		s.emit(ctx, &Event{Type: EventLogin, Reason: "session not found"})
+		return nil, newError(CodeInvalidRequest, "", "Session is not found: %w", err)
+	}
+
+	var user User
+	// アカウントの状態によってログインを拒否した場合のエラー。失敗回数には数えない。
+	var inactiveErr error
+	// ValidateDiscoverableLogin にて、どのようにログインするユーザーを特定するかを定義する関数。
+	//
+	// userHandle は User インターフェース実装されている WebAuthnID() のこと。
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		u, err := s.users.FindUserByID(ctx, rp.Scope, userHandle)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to find user: %w", err)
+		}
+		user = u
+		annotate(ctx, "user_id", u.UserID(), "credential_id", rawID)
+
+		// ロック中や無効化されたユーザーはログインさせない
+		if err := user.CheckActive(); err != nil {
+			inactiveErr = err
+			return nil, err
+		}
+
+		return user, nil
+	}
+
+	var res *protocol.ParsedCredentialAssertionData
+	err = traceWebAuthn(ctx, rp.Scope, "ParseCredentialRequestResponse", func() error {
+		var err error
+		res, err = protocol.ParseCredentialRequestResponseBytes(body)
+		return err
+	})
+	if err != nil {
+		return nil, newError(CodeInvalidRequest, "Failed to parse credential request response", "Failed to parse credential request response: %w", err)
+	}
+
+	var credential *webauthn.Credential
+	err = traceWebAuthn(ctx, rp.Scope, "ValidateDiscoverableLogin", func() error {
+		var err error
+		credential, err = rp.WebAuthn.ValidateDiscoverableLogin(handler, session.SessionData, res)
+		return err
+	})
+	if err != nil {
+		if user == nil {
+			s.emit(ctx, &Event{Type: EventLogin, Reason: "user not found"})
+			return nil, newError(CodeInvalidRequest, "Failed to validate discoverable login", "Failed to validate discoverable login: %w", err)
+		}
+		if inactiveErr != nil {
+			s.emit(ctx, &Event{Type: EventLogin, UserID: user.UserID(), User: user, Reason: inactiveErr.Error()})
+			return nil, newError(CodeForbidden, "Account is not active", "Failed to validate discoverable login: %w", err)
+		}
+
+		// ユーザーの認証器ではないクレデンシャルIDの場合は、失敗回数に数えない。
+		// userHandle だけを他人のものにしたアサーションで、そのユーザーをロックできないようにするため。
+		s.emit(ctx, &Event{
+			Type:               EventLogin,
+			UserID:             user.UserID(),
+			User:               user,
+			RawCredentialID:    res.RawID,
+			Reason:             err.Error(),
+			VerificationFailed: ownsCredential(user, res.RawID),
+		})
+		return nil, newError(CodeInvalidRequest, "Failed to validate discoverable login", "Failed to validate discoverable login: %w", err)
+	}
+
+	// 同じセッションで、同じアサーションを再度使えないようにする。
+	// 署名カウンタを使わない認証器(多くのパスキー)では、カウンタでは再送を検出できない。
+	s.sessions.DeleteSession(ctx, sessionID)
+
+	stored, err := s.credentials.UpdateCredential(ctx, user, credential)
+	if err != nil {
+		return nil, newError(CodeInternal, "", "Failed to update webauthn credential: %w", err)
+	}
+
+	s.emit(ctx, &Event{Type: EventLogin, Success: true, UserID: user.UserID(), User: user, Credential: stored, RawCredentialID: credential.ID})
+
+	return &Login{
+		User:         user,
+		Credential:   stored,
+		UserVerified: credential.Flags.UserVerified,
+		Scope:        rp.Scope,
+	}, nil
+}
+
+// ユーザーが登録している(無効化していない)認証器のクレデンシャルIDかどうか。
+func ownsCredential(user User, credentialID []byte) bool {
+	for _, c := range user.WebAuthnCredentials() {
+		if bytes.Equal(c.ID, credentialID) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,37 @@
+// Package passkey は、パスキー(WebAuthn)による認証器の登録・認証と、認証器の管理を行う。
+//
+// ユーザーや認証器、セッションの保存先はインターフェースで受け取るので、DBやセッションストアに依存しない。
+// 処理は HTTP のフレームワークに依存しない Service にまとめてあり、次のアダプターからエンドポイントとして公開する。
+//
+//   - EchoHandler: Echo のルーターやグループに登録する
+//   - HTTPHandler: net/http の http.Handler として、標準ライブラリや chi などのルーターにマウントする
+//
+// 認証に成功した後のログイン状態(Cookieのセッションやトークン)は、使う側が OnLogin で作成する。
+package passkey
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// 登録・認証のセッションの有効期間のデフォルト
+const DefaultSessionTimeout = 5 * time.Minute
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	// 同じ名前のユーザーが、並行して登録された場合
+	ErrUserNameTaken = errors.New("user name is already taken")
+	// 管理者が無効化した認証器など、ユーザーが有効化できない認証器を有効化しようとした場合
+	ErrCredentialLocked = errors.New("credential cannot be enabled by the user")
+)
+
+// リクエストの Relying Party 。マルチテナントの場合は、テナントごとに異なる設定を返す。
+type RelyingParty struct {
+	WebAuthn *webauthn.WebAuthn
+	// 認証器の登録時のオプション(Resident Key やユーザー検証の要件など)
+	RegistrationOptions []webauthn.RegistrationOption
+	// ユーザーを分ける単位(テナントIDなど)。ストアに渡し、開始したのと別のスコープではセッションを使えないようにする。
+	Scope string
+}
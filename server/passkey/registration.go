@@ -0,0 +1,145 @@
+package passkey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// 認証器の登録を開始するリクエスト。アダプターがリクエストボディから読み込む。
+type beginRegistrationRequest struct {
+	Username string `json:"username"`
+}
+
+// 認証器の登録を開始し、 navigator.credentials.create() に渡すオプションと、登録のセッションIDを返す。
+// ユーザーが存在しない場合は新規ユーザーとして扱うが、登録が完了するまでは保存しない。
+// 既存のユーザーの場合は、 ServiceConfig.AuthorizeRegistration で許可された場合のみ開始する。
+func (s *Service) BeginRegistration(ctx context.Context, rp *RelyingParty, username string) (*protocol.CredentialCreation, string, error) {
+	annotate(ctx, "ceremony", "registration", "phase", "begin")
+
+	// 認証機を登録するユーザーを特定。
+	session := &Session{Scope: rp.Scope}
+	user, err := s.users.FindUserByName(ctx, rp.Scope, username)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			return nil, "", newError(CodeInvalidRequest, "", "Failed to find user: %w", err)
+		}
+		user = s.users.NewUser(rp.Scope, username, nil)
+		session.NewUserName = username
+	}
+
+	annotate(ctx, "user_id", user.UserID())
+
+	// 既存のユーザーへの追加は、使う側が本人であることを確認できた場合のみ許可する
+	if session.NewUserName == "" {
+		if err := s.authorize(ctx, user); err != nil {
+			return nil, "", newError(CodeForbidden, "", "User %s is not allowed to add a credential: %w", user.UserID(), err)
+		}
+	}
+
+	// ロック中や無効化されたユーザーには、認証器を追加させない
+	if err := user.CheckActive(); err != nil {
+		return nil, "", newError(CodeForbidden, "", "User %s cannot register a credential: %w", user.UserID(), err)
+	}
+
+	var options *protocol.CredentialCreation
+	var data *webauthn.SessionData
+	err = traceWebAuthn(ctx, rp.Scope, "BeginRegistration", func() error {
+		var err error
+		options, data, err = rp.WebAuthn.BeginRegistration(
+			user,
+			append(rp.RegistrationOptions, webauthn.WithExclusions(user.CredentialExcludeList()))...,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, "", newError(CodeInternal, "", "Failed to begin registration: %w", err)
+	}
+
+	// 認証機登録セッションを開始
+	session.SessionData = *data
+	sessionID, err := s.sessions.CreateSession(ctx, session, s.sessionTimeout)
+	if err != nil {
+		return nil, "", newError(CodeInternal, "", "Failed to start session: %w", err)
+	}
+
+	return options, sessionID, nil
+}
+
+// 認証器の登録を完了し、認証器を保存する。新規ユーザーの場合は、ユーザーも保存する。
+// body は navigator.credentials.create() の結果(PublicKeyCredential)のJSON。
+func (s *Service) FinishRegistration(ctx context.Context, rp *RelyingParty, sessionID string, body []byte) (*Credential, error) {
+	annotate(ctx, "ceremony", "registration", "phase", "finish")
+
+	var req protocol.CredentialCreationResponse
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, newError(CodeInvalidRequest, "", "Failed to parse request: %w", err)
+	}
+
+	// 認証機登録セッションを特定
+	if sessionID == "" {
+		return nil, newError(CodeInvalidRequest, "", "Session id is not set")
+	}
+	session, err := s.sessions.GetSession(ctx, sessionID)
+	if err != nil {
+		s.emit(ctx, &Event{Type: EventRegistration, Reason: "session not found"})
+		return nil, newError(CodeInvalidRequest, "", "Session is not found: %w", err)
+	}
+	// 別のスコープで開始したセッションは使えない
+	if session.Scope != rp.Scope {
+		s.emit(ctx, &Event{Type: EventRegistration, Reason: "session not found"})
+		return nil, newError(CodeInvalidRequest, "", "Registration session belongs to another scope: %s", session.Scope)
+	}
+
+	// セッションからユーザーを特定。新規ユーザーの場合はまだ保存されていないので、セッションの情報から組み立てる。
+	isNewUser := session.NewUserName != ""
+	var user User
+	if isNewUser {
+		user = s.users.NewUser(rp.Scope, session.NewUserName, session.UserID)
+	} else {
+		user, err = s.users.FindUserByID(ctx, rp.Scope, session.UserID)
+		if err != nil {
+			s.emit(ctx, &Event{Type: EventRegistration, Reason: "user not found"})
+			return nil, newError(CodeNotFound, "", "User is not found: %w", err)
+		}
+	}
+
+	annotate(ctx, "user_id", user.UserID())
+
+	var credential *webauthn.Credential
+	err = traceWebAuthn(ctx, rp.Scope, "FinishRegistration", func() error {
+		parsed, err := protocol.ParseCredentialCreationResponseBytes(body)
+		if err != nil {
+			return err
+		}
+		credential, err = rp.WebAuthn.CreateCredential(user, session.SessionData, parsed)
+		return err
+	})
+	if err != nil {
+		s.emit(ctx, &Event{Type: EventRegistration, UserID: user.UserID(), User: user, Reason: err.Error()})
+		return nil, newError(CodeInternal, "", "Failed to finish registration: %w", err)
+	}
+
+	annotate(ctx, "credential_id", credential.ID)
+
+	stored, err := s.credentials.AddCredential(ctx, user, isNewUser, credential)
+	if err != nil {
+		if errors.Is(err, ErrUserNameTaken) {
+			// 同じ名前で並行して登録された場合
+			s.emit(ctx, &Event{Type: EventRegistration, Reason: "user name is already taken"})
+			return nil, newError(CodeConflict, "", "User name is already taken: %w", err)
+		}
+
+		s.emit(ctx, &Event{Type: EventRegistration, UserID: user.UserID(), User: user, Reason: "failed to save credential"})
+		return nil, newError(CodeInternal, "", "Failed to insert webauthn credential: %w", err)
+	}
+	// 同じセッションで再度登録できないようにする
+	s.sessions.DeleteSession(ctx, sessionID)
+
+	s.emit(ctx, &Event{Type: EventRegistration, Success: true, UserID: user.UserID(), User: user, Credential: stored})
+
+	return stored, nil
+}
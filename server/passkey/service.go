@@ -0,0 +1,143 @@
+package passkey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// 登録・認証と認証器の管理の処理。
+//
+// HTTPのフレームワークには依存せず、リクエストボディやセッションIDを受け取って結果を返す。
+// Cookieやヘッダーの読み書き、レスポンスの作成はアダプター(Echo の Handler、 net/http の HTTPHandler)が行う。
+// gRPC などから使う場合は、 Service のメソッドを直接呼び出す。
+type Service struct {
+	users          UserStore
+	credentials    CredentialStore
+	sessions       SessionStore
+	sessionTimeout time.Duration
+	onEvent        func(ctx context.Context, ev *Event)
+	authorize      func(ctx context.Context, user User) error
+}
+
+type ServiceConfig struct {
+	Users       UserStore
+	Credentials CredentialStore
+	Sessions    SessionStore
+
+	// 登録・認証のセッションの有効期間。0の場合は DefaultSessionTimeout
+	SessionTimeout time.Duration
+
+	// 登録・認証や認証器の操作の結果を受け取る。監査ログやメトリクスの記録に使う。
+	// アダプターを通した場合は、 RequestInfoFrom でクライアントのIPアドレスやロガーを取得できる。
+	OnEvent func(ctx context.Context, ev *Event)
+
+	// 既存のユーザーに認証器を追加してよいかを判定する。エラーを返すと、登録を開始せずに拒否する。
+	// 他人のアカウントに認証器を追加されないように、リクエストしたのがユーザー本人であることを確認すること。
+	// 指定しない場合は、既存のユーザーへの追加をすべて拒否する(新規ユーザーの登録のみ受け付ける)。
+	AuthorizeRegistration func(ctx context.Context, user User) error
+}
+
+func NewService(cfg ServiceConfig) (*Service, error) {
+	if cfg.Users == nil || cfg.Credentials == nil || cfg.Sessions == nil {
+		return nil, errors.New("passkey: Users, Credentials and Sessions are required")
+	}
+	if cfg.SessionTimeout == 0 {
+		cfg.SessionTimeout = DefaultSessionTimeout
+	}
+	if cfg.OnEvent == nil {
+		cfg.OnEvent = func(context.Context, *Event) {}
+	}
+	if cfg.AuthorizeRegistration == nil {
+		cfg.AuthorizeRegistration = func(context.Context, User) error {
+			return errors.New("adding a credential to an existing user is not allowed")
+		}
+	}
+
+	return &Service{
+		users:          cfg.Users,
+		credentials:    cfg.Credentials,
+		sessions:       cfg.Sessions,
+		sessionTimeout: cfg.SessionTimeout,
+		onEvent:        cfg.OnEvent,
+		authorize:      cfg.AuthorizeRegistration,
+	}, nil
+}
+
+// 登録・認証のセッションの有効期間。アダプターがCookieの有効期間に使う。
+func (s *Service) SessionTimeout() time.Duration {
+	return s.sessionTimeout
+}
+
+func (s *Service) emit(ctx context.Context, ev *Event) {
+	if ev.Credential != nil && ev.CredentialID == "" {
+		ev.CredentialID = ev.Credential.ID
+	}
+	s.onEvent(ctx, ev)
+}
+
+// エラーの種類。アダプターがHTTPのステータスなどに変換する。
+type ErrorCode int
+
+const (
+	CodeInternal ErrorCode = iota
+	CodeInvalidRequest
+	CodeForbidden
+	CodeNotFound
+	CodeConflict
+)
+
+func (c ErrorCode) HTTPStatus() int {
+	switch c {
+	case CodeInvalidRequest:
+		return http.StatusBadRequest
+	case CodeForbidden:
+		return http.StatusForbidden
+	case CodeNotFound:
+		return http.StatusNotFound
+	case CodeConflict:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Service のメソッドが返すエラー。
+type Error struct {
+	Code ErrorCode
+	// クライアントに返すメッセージ。空の場合はボディを返さない。
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(code ErrorCode, message string, format string, args ...any) *Error {
+	return &Error{Code: code, Message: message, Err: fmt.Errorf(format, args...)}
+}
+
+// エラーの種類を返す。 *Error でない場合は CodeInternal
+func CodeOf(err error) ErrorCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeInternal
+}
+
+// クライアントに返すメッセージを返す。
+func messageOf(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Message
+	}
+	return ""
+}
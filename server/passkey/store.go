@@ -0,0 +1,84 @@
+package passkey
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// 認証器を登録・認証するユーザー。使う側のユーザーのモデルに実装する。
+type User interface {
+	webauthn.User
+
+	// 監査ログやレスポンスで使う、ユーザーのID
+	UserID() string
+	// 同じ認証器が複数登録されるのを防ぐために、登録済みの認証器を返す。
+	// 無効化している認証器も、再度有効化できるので含める。
+	CredentialExcludeList() []protocol.CredentialDescriptor
+	// 認証器の登録・認証を許可しない場合(ロック中や無効化されている場合など)はエラーを返す。
+	CheckActive() error
+}
+
+// 保存されている認証器。
+type Credential struct {
+	// ストアでのID。WebAuthnのクレデンシャルID(CredentialID)とは別。
+	ID           string
+	UserID       string
+	CredentialID []byte
+	Flags        webauthn.CredentialFlags
+	// AAGUIDや署名カウンタ
+	Authenticator webauthn.Authenticator
+	// 無効化されていない場合はゼロ値
+	DisabledAt    time.Time
+	RevokedReason string
+	CreatedAt     time.Time
+}
+
+func (c *Credential) Disabled() bool {
+	return !c.DisabledAt.IsZero()
+}
+
+type UserStore interface {
+	// スコープ内で、名前からユーザーを取得する。存在しない場合は ErrUserNotFound を返す。
+	FindUserByName(ctx context.Context, scope, name string) (User, error)
+	// スコープ内で、 WebAuthnID からユーザーを取得する。存在しない場合は ErrUserNotFound を返す。
+	FindUserByID(ctx context.Context, scope string, userHandle []byte) (User, error)
+	// 新規ユーザーを作成する。認証器の登録が完了するまでは保存しない。
+	// userHandle が nil の場合は新しいIDを割り当て、そうでない場合はそのIDのユーザーを作成する(登録の完了時)。
+	NewUser(scope, name string, userHandle []byte) User
+}
+
+type CredentialStore interface {
+	// 認証器を保存する。 newUser が true の場合は、ユーザーも一緒に保存する。
+	// 同じ名前のユーザーがすでに存在する場合は ErrUserNameTaken を返す。
+	AddCredential(ctx context.Context, user User, newUser bool, credential *webauthn.Credential) (*Credential, error)
+	// 認証に成功した認証器の署名カウンタとフラグを保存する。認証器が見つからない場合は nil を返す。
+	UpdateCredential(ctx context.Context, user User, credential *webauthn.Credential) (*Credential, error)
+	// スコープ内のユーザーの認証器を返す。無効化されている認証器も含める。
+	ListCredentials(ctx context.Context, scope, userID string) ([]Credential, error)
+	// 認証器を削除し、削除した認証器を返す。見つからない場合は nil を返す。
+	DeleteCredential(ctx context.Context, userID, id string) (*Credential, error)
+	// 認証器を無効化、または有効化し、更新後の認証器を返す。見つからない場合は nil を返す。
+	// ユーザーが有効化できない認証器(管理者が無効化したものなど)の場合は ErrCredentialLocked を返す。
+	SetCredentialDisabled(ctx context.Context, userID, id string, disabled bool, reason string) (*Credential, error)
+}
+
+// 登録・認証のセッション。
+//
+// 新規ユーザーの場合は、認証器の登録が完了するまでユーザーを保存しない。
+// そのため、登録するユーザーの名前をセッションに保持しておく。ユーザーのIDは SessionData.UserID に入っている。
+type Session struct {
+	webauthn.SessionData
+
+	Scope       string `json:"scope"`
+	NewUserName string `json:"new_user_name,omitempty"`
+}
+
+type SessionStore interface {
+	// セッションを保存し、セッションIDを返す。
+	CreateSession(ctx context.Context, session *Session, ttl time.Duration) (string, error)
+	GetSession(ctx context.Context, id string) (*Session, error)
+	DeleteSession(ctx context.Context, id string)
+}
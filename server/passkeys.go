@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/daikideal/go-passkey-demo/passkey"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+)
+
+// 認証器の登録・認証と認証器の管理は passkey パッケージのハンドラーで行う。
+// ここでは、DB・セッションストア・テナント・監査ログを passkey パッケージにつなぐ。
+func newPasskeyHandler(db *bun.DB, sessions *sessionStore, oidc oidcConfig, cookies passkey.CookieFactory, logger passkey.Logger) (*passkey.EchoHandler, error) {
+	store := &passkeyStore{db: db}
+	svc, err := passkey.NewService(passkey.ServiceConfig{
+		Users:       store,
+		Credentials: store,
+		Sessions:    sessions,
+		OnEvent:     recordPasskeyEvent(db, logger),
+		// 既存のユーザーに認証器を追加できるのは、そのユーザーとしてログインしている場合のみ
+		AuthorizeRegistration: func(c context.Context, user passkey.User) error {
+			ctx, ok := passkey.EchoContext(c)
+			if !ok {
+				return errors.New("request is not authenticated")
+			}
+			userID, ok := currentUserID(ctx)
+			if !ok {
+				return errors.New("request is not authenticated")
+			}
+			if userID != user.UserID() {
+				return fmt.Errorf("requested by another user: %s", userID)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return passkey.NewEchoHandler(svc, passkey.EchoConfig{
+		// Relying Party はテナントごとに異なる。ユーザーもテナントごとに分ける。
+		RelyingParty: func(ctx echo.Context) (*passkey.RelyingParty, error) {
+			tenant, ok := tenantFromContext(ctx)
+			if !ok {
+				return nil, errors.New("tenant is not resolved")
+			}
+
+			// Resident Key やユーザー検証の要件はテナントのポリシーに従う。
+			// デフォルトではパスキー認証が試したいので、 Resident Key しかサポートしない。
+			return &passkey.RelyingParty{
+				WebAuthn:            tenantWebAuthn(ctx),
+				RegistrationOptions: tenant.registrationOptions(),
+				Scope:               tenant.ID,
+			}, nil
+		},
+		Cookies: cookies,
+		OnLogin: completeLogin(db, sessions, oidc, cookies),
+	})
+}
+
+// passkey.UserStore と passkey.CredentialStore の実装。
+// ユーザーと認証器の変更は、Webhookの送信キューへの追加と同じトランザクションで行う。
+type passkeyStore struct {
+	db *bun.DB
+}
+
+func (s *passkeyStore) FindUserByName(ctx context.Context, tenantID, name string) (passkey.User, error) {
+	user, err := findUserByName(ctx, s.db, tenantID, name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, passkey.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *passkeyStore) FindUserByID(ctx context.Context, tenantID string, userHandle []byte) (passkey.User, error) {
+	// WebAuthnID はUUIDをバイト列に変換したものなので、文字列に戻せばユーザーを特定できる
+	user, err := findUserByID(ctx, s.db, string(userHandle))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, passkey.ErrUserNotFound
+		}
+		return nil, err
+	}
+	// 他のテナントのユーザーは存在しないものとして扱う
+	if user.TenantID != tenantID {
+		return nil, fmt.Errorf("%w: user %s belongs to another tenant: %s", passkey.ErrUserNotFound, user.ID, user.TenantID)
+	}
+
+	return user, nil
+}
+
+func (s *passkeyStore) NewUser(tenantID, name string, userHandle []byte) passkey.User {
+	id := string(userHandle)
+	if userHandle == nil {
+		id = uuid.NewString()
+	}
+
+	return &User{
+		ID:       id,
+		TenantID: tenantID,
+		Name:     name,
+		Status:   userStatusActive,
+	}
+}
+
+func (s *passkeyStore) AddCredential(ctx context.Context, u passkey.User, newUser bool, credential *webauthn.Credential) (*passkey.Credential, error) {
+	user := u.(*User)
+	cred := &WebauthnCredentials{
+		UserID:          user.ID,
+		TenantID:        user.TenantID,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transport:       credential.Transport,
+		Flags:           credential.Flags,
+		Authenticator:   credential.Authenticator,
+	}
+
+	err := s.db.RunInTx(ctx, nil, func(c context.Context, tx bun.Tx) error {
+		if newUser {
+			user.RegisteredAt = time.Now()
+			if err := insertUser(c, tx, user); err != nil {
+				return err
+			}
+		} else {
+			// 登録を完了していないユーザー(POST /users で作成したユーザーなど)に、最初の認証器を追加した場合
+			_, err := tx.NewUpdate().
+				Model((*User)(nil)).
+				Set("registered_at = NOW()").
+				Where("id = ? AND registered_at IS NULL", user.ID).
+				Exec(c)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.NewInsert().
+			Model(cred).
+			Column("user_id", "tenant_id", "credential_id", "public_key", "attestation_type", "transport", "flags", "authenticator").
+			Returning("id, created_at").
+			Exec(c)
+		if err != nil {
+			return err
+		}
+
+		return enqueueWebhookEvent(c, tx, webhookEventPasskeyAdded, newWebhookPasskeyData(cred, ""))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newPasskeyCredential(cred), nil
+}
+
+func (s *passkeyStore) UpdateCredential(ctx context.Context, u passkey.User, credential *webauthn.Credential) (*passkey.Credential, error) {
+	stored := u.(*User).findCredential(credential.ID)
+	if stored == nil {
+		return nil, nil
+	}
+	if err := updateCredentialAfterLogin(ctx, s.db, stored, credential); err != nil {
+		return nil, err
+	}
+
+	return newPasskeyCredential(stored), nil
+}
+
+func (s *passkeyStore) ListCredentials(ctx context.Context, tenantID, userID string) ([]passkey.Credential, error) {
+	var credentials []*WebauthnCredentials
+	if err := s.db.NewSelect().
+		Model(&credentials).
+		Column("*").
+		Where("user_id = ? AND tenant_id = ?", userID, tenantID).
+		Scan(ctx); err != nil {
+		return nil, err
+	}
+
+	res := make([]passkey.Credential, len(credentials))
+	for i, v := range credentials {
+		res[i] = *newPasskeyCredential(v)
+	}
+
+	return res, nil
+}
+
+func (s *passkeyStore) DeleteCredential(ctx context.Context, userID, id string) (*passkey.Credential, error) {
+	deleted, err := removePublicKey(ctx, s.db, userID, id, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return newPasskeyCredential(deleted), nil
+}
+
+func (s *passkeyStore) SetCredentialDisabled(ctx context.Context, userID, id string, disabled bool, reason string) (*passkey.Credential, error) {
+	// passkey パッケージのハンドラーは、ユーザー本人の操作にのみ使っている
+	cred, err := changePublicKeyDisabled(ctx, s.db, userID, id, disabled, reason, credentialDisabledByUser)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPasskeyCredential(cred), nil
+}
+
+func newPasskeyCredential(cred *WebauthnCredentials) *passkey.Credential {
+	if cred == nil {
+		return nil
+	}
+
+	return &passkey.Credential{
+		ID:            cred.ID,
+		UserID:        cred.UserID,
+		CredentialID:  cred.CredentialID,
+		Flags:         cred.Flags,
+		Authenticator: cred.Authenticator,
+		DisabledAt:    cred.DisabledAt,
+		RevokedReason: cred.RevokedReason,
+		CreatedAt:     cred.CreatedAt,
+	}
+}
+
+// passkey パッケージのイベントを監査ログに記録する(passkey.ServiceConfig.OnEvent)。
+// ログインの結果によって、失敗回数の記録やアカウントのロックも行う。
+//
+// どのアダプターから呼ばれても記録するように、IPアドレスなどは passkey.RequestInfo から取得する。
+// 設定されていない場合(Service を直接呼び出した場合など)は空のまま記録し、 logger にエラーを出力する。
+func recordPasskeyEvent(db *bun.DB, logger passkey.Logger) func(context.Context, *passkey.Event) {
+	return func(ctx context.Context, ev *passkey.Event) {
+		info, ok := passkey.RequestInfoFrom(ctx)
+		if !ok {
+			info = &passkey.RequestInfo{Logger: logger}
+		}
+		user, _ := ev.User.(*User)
+
+		ae := &AuthEvent{
+			UserID:       ev.UserID,
+			CredentialID: ev.CredentialID,
+			EventType:    string(ev.Type),
+			Result:       authEventFailure,
+			Reason:       ev.Reason,
+			IP:           info.IP,
+			UserAgent:    info.UserAgent,
+		}
+		if ev.Success {
+			ae.Result = authEventSuccess
+		}
+		switch {
+		case ev.Credential != nil:
+			ae.withPasskeyCredential(ev.Credential)
+		case user != nil && ev.RawCredentialID != nil:
+			// 検証に失敗した認証器は、ユーザーの認証器から特定する
+			ae.withCredential(user.findCredential(ev.RawCredentialID))
+		}
+		// Echo のルートの場合は、認証器の登録・認証の失敗理由をメトリクスに記録できるようにする
+		if c, ok := passkey.EchoContext(ctx); ok && !ev.Success && (ev.Type == passkey.EventRegistration || ev.Type == passkey.EventLogin) {
+			c.Set(ceremonyFailureReasonContextKey, ceremonyFailureReason(ev.Reason))
+		}
+		if err := insertAuthEvent(ctx, db, ae); err != nil {
+			info.Logger.Errorf("Failed to insert auth event: %v\n", err)
+		}
+
+		if ev.Type != passkey.EventLogin || user == nil {
+			return
+		}
+		if ev.Success {
+			if err := resetFailedLogins(ctx, db, user); err != nil {
+				info.Logger.Errorf("Failed to reset failed logins: %v\n", err)
+			}
+			return
+		}
+		// 失敗回数は、ユーザーの認証器で署名やカウンタの検証に失敗した場合だけ数える
+		if !ev.VerificationFailed || user.findCredential(ev.RawCredentialID) == nil {
+			return
+		}
+
+		locked, err := recordFailedLogin(ctx, db, user.ID)
+		if err != nil {
+			info.Logger.Errorf("Failed to record failed login: %v\n", err)
+		} else if locked {
+			info.Logger.Warnf("User %s is locked due to too many failed login attempts\n", user.ID)
+			lock := &AuthEvent{UserID: user.ID, EventType: authEventAccountLock, Result: authEventSuccess, Reason: "too many failed login attempts", IP: info.IP, UserAgent: info.UserAgent}
+			if err := insertAuthEvent(ctx, db, lock); err != nil {
+				info.Logger.Errorf("Failed to insert auth event: %v\n", err)
+			}
+		}
+	}
+}
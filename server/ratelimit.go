@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// トークンバケットによるレート制限。
+//
+// バケットには最大 Burst 個のトークンが入り、1秒あたり Rate 個ずつ補充される。
+// リクエストごとにトークンを1つ消費し、トークンがない場合は補充されるまで待ってもらう。
+
+const rateLimitKeyPrefix = "rate_limit:"
+
+type rateLimit struct {
+	// 1秒あたりに補充するトークンの数
+	Rate float64
+	// バケットに入るトークンの最大数
+	Burst int
+}
+
+// "10/1m" のような「回数/期間」の形式で、期間あたりの回数を指定する。
+// 期間内に回数分まで連続してリクエストでき、その後は期間を回数で割った間隔で1回ずつ回復する。
+func parseRateLimit(v string) (rateLimit, error) {
+	count, period, ok := strings.Cut(v, "/")
+	if !ok {
+		return rateLimit{}, fmt.Errorf("rate limit must be <count>/<duration>: %s", v)
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return rateLimit{}, fmt.Errorf("invalid count: %s", v)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid duration: %s", v)
+	}
+
+	return rateLimit{Rate: float64(n) / d.Seconds(), Burst: n}, nil
+}
+
+// 環境変数からレート制限を取得する。
+func (r *envReader) getRateLimit(key string, defaultValue rateLimit) rateLimit {
+	v := getEnv(key, "")
+	if v == "" {
+		return defaultValue
+	}
+
+	l, err := parseRateLimit(v)
+	if err != nil {
+		r.fail(key, v, err)
+		return defaultValue
+	}
+	return l
+}
+
+// レート制限を確認するバケット
+type rateLimitBucket struct {
+	key   string
+	limit rateLimit
+}
+
+type rateLimiter interface {
+	// すべてのバケットからトークンを1つずつ消費する。
+	// 1つでも消費できないバケットがある場合は、どのバケットからも消費せずに、
+	// 制限されたバケットのインデックスと、そのバケットにトークンが補充されるまでの時間を返す。
+	// すべて消費できた場合、 denied は -1 になる。
+	Allow(ctx context.Context, buckets []rateLimitBucket) (denied int, retryAfter time.Duration, err error)
+}
+
+// トークンの残りから、次に1つ消費できるまでの時間を計算する。
+func rateLimitRetryAfter(tokens float64, limit rateLimit) time.Duration {
+	return time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+}
+
+// サーバーのメモリ上で管理するレート制限。サーバーごとに制限されるので、1台で動かす場合に使う。
+type memoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	// バケットが満杯に戻る日時。これを過ぎたバケットは削除しても結果が変わらない。
+	fullAt time.Time
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{buckets: map[string]*memoryBucket{}, lastSweep: time.Now()}
+}
+
+func (l *memoryRateLimiter) Allow(_ context.Context, buckets []rateLimitBucket) (int, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	// すべてのバケットを補充してから、消費できるかを確認する
+	bs := make([]*memoryBucket, len(buckets))
+	denied, retryAfter := -1, time.Duration(0)
+	for i, v := range buckets {
+		b, ok := l.buckets[v.key]
+		if !ok {
+			b = &memoryBucket{tokens: float64(v.limit.Burst), updatedAt: now}
+			l.buckets[v.key] = b
+		}
+		b.tokens = math.Min(float64(v.limit.Burst), b.tokens+now.Sub(b.updatedAt).Seconds()*v.limit.Rate)
+		b.updatedAt = now
+		bs[i] = b
+
+		if b.tokens < 1 {
+			if d := rateLimitRetryAfter(b.tokens, v.limit); denied == -1 || d > retryAfter {
+				denied, retryAfter = i, d
+			}
+		}
+	}
+	if denied != -1 {
+		return denied, retryAfter, nil
+	}
+
+	for i, b := range bs {
+		limit := buckets[i].limit
+		b.tokens--
+		b.fullAt = now.Add(time.Duration((float64(limit.Burst) - b.tokens) / limit.Rate * float64(time.Second)))
+	}
+	return -1, 0, nil
+}
+
+// 満杯に戻ったバケットを、1分に1回まとめて削除する。
+func (l *memoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if now.After(b.fullAt) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Redisで管理するレート制限。複数台のサーバーで制限を共有できる。
+//
+// 読み込みと更新の間に他のリクエストが割り込まないように、Luaスクリプトで処理する。
+// 時刻はサーバーごとのずれを避けるためにRedisの時刻を使う。
+type redisRateLimiter struct {
+	client *redis.Client
+}
+
+// ARGV にはバケットごとに rate と burst を順に渡す。
+// 制限された場合は、バケットの番号(1から)と、トークンが補充されるまでの秒数を返す。
+var rateLimitScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+
+local tokens = {}
+local denied = 0
+local wait = 0
+for i = 1, #KEYS do
+	local rate = tonumber(ARGV[i * 2 - 1])
+	local burst = tonumber(ARGV[i * 2])
+	local bucket = redis.call('HMGET', KEYS[i], 'tokens', 'ts')
+	local v = tonumber(bucket[1]) or burst
+	local ts = tonumber(bucket[2]) or now
+	v = math.min(burst, v + (now - ts) * rate)
+	tokens[i] = v
+
+	if v < 1 and (1 - v) / rate > wait then
+		denied = i
+		wait = (1 - v) / rate
+	end
+end
+
+-- 1つでも制限された場合は、どのバケットからも消費しない
+if denied > 0 then
+	-- 小数は整数に丸められてしまうので文字列で返す
+	return {denied, tostring(wait)}
+end
+
+for i = 1, #KEYS do
+	local rate = tonumber(ARGV[i * 2 - 1])
+	local burst = tonumber(ARGV[i * 2])
+	local v = tokens[i] - 1
+	redis.call('HSET', KEYS[i], 'tokens', tostring(v), 'ts', tostring(now))
+	redis.call('EXPIRE', KEYS[i], math.ceil((burst - v) / rate) + 1)
+end
+
+return {0, '0'}
+`)
+
+func newRedisRateLimiter(client *redis.Client) *redisRateLimiter {
+	return &redisRateLimiter{client: client}
+}
+
+func (l *redisRateLimiter) Allow(ctx context.Context, buckets []rateLimitBucket) (int, time.Duration, error) {
+	keys := make([]string, len(buckets))
+	args := make([]any, 0, len(buckets)*2)
+	for i, b := range buckets {
+		keys[i] = rateLimitKeyPrefix + b.key
+		args = append(args, b.limit.Rate, b.limit.Burst)
+	}
+
+	res, err := rateLimitScript.Run(ctx, l.client, keys, args...).Slice()
+	if err != nil {
+		return -1, 0, err
+	}
+	if len(res) != 2 {
+		return -1, 0, fmt.Errorf("unexpected result of rate limit script: %v", res)
+	}
+
+	denied, _ := res[0].(int64)
+	if denied == 0 {
+		return -1, 0, nil
+	}
+
+	s, _ := res[1].(string)
+	wait, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return -1, 0, fmt.Errorf("unexpected result of rate limit script: %w", err)
+	}
+	return int(denied) - 1, time.Duration(wait * float64(time.Second)), nil
+}
+
+// RATE_LIMIT_BACKEND で、レート制限をどこで管理するかを選ぶ。
+func newRateLimiter(cfg rateLimitConfig, client *redis.Client) rateLimiter {
+	if cfg.Backend == "memory" {
+		return newMemoryRateLimiter()
+	}
+	return newRedisRateLimiter(client)
+}
+
+// 各エンドポイントのレート制限の設定。環境変数で「回数/期間」の形式で指定する。
+type rateLimitConfig struct {
+	// redis または memory
+	Backend string
+	// 認証器の登録・認証のIPアドレスごとの制限
+	CeremonyPerIP rateLimit
+	// 認証器の登録のユーザー名ごとの制限
+	RegistrationPerUsername rateLimit
+	// 認証器の登録・認証のサーバー全体での制限
+	CeremonyGlobal rateLimit
+	// ユーザーの検索や取得のIPアドレスごとの制限
+	LookupPerIP rateLimit
+	// トークンの発行のIPアドレスごとの制限
+	TokenPerIP rateLimit
+}
+
+func loadRateLimitConfig(env *envReader) rateLimitConfig {
+	return rateLimitConfig{
+		Backend:                 getEnv("RATE_LIMIT_BACKEND", "redis"),
+		CeremonyPerIP:           env.getRateLimit("RATE_LIMIT_CEREMONY_PER_IP", rateLimit{Rate: 20.0 / 60, Burst: 20}),
+		RegistrationPerUsername: env.getRateLimit("RATE_LIMIT_REGISTRATION_PER_USERNAME", rateLimit{Rate: 5.0 / 60, Burst: 5}),
+		CeremonyGlobal:          env.getRateLimit("RATE_LIMIT_CEREMONY_GLOBAL", rateLimit{Rate: 1000.0 / 60, Burst: 1000}),
+		LookupPerIP:             env.getRateLimit("RATE_LIMIT_LOOKUP_PER_IP", rateLimit{Rate: 60.0 / 60, Burst: 60}),
+		TokenPerIP:              env.getRateLimit("RATE_LIMIT_TOKEN_PER_IP", rateLimit{Rate: 30.0 / 60, Burst: 30}),
+	}
+}
+
+// レート制限のルール。
+// key が空文字を返した場合は、そのルールでは制限しない。
+type rateLimitRule struct {
+	name  string
+	limit rateLimit
+	key   func(ctx echo.Context) string
+}
+
+// IPアドレスごとに制限する。
+// クライアントのIPアドレスは、ルーターの IPExtractor で信頼できるプロキシのヘッダーからのみ取得する(TRUSTED_PROXIES)。
+func rateLimitByIP(name string, limit rateLimit) rateLimitRule {
+	return rateLimitRule{
+		name:  name + ":ip",
+		limit: limit,
+		key:   func(ctx echo.Context) string { return ctx.RealIP() },
+	}
+}
+
+// ユーザー名を取得するために読み込むリクエストボディの最大サイズ
+const rateLimitMaxBodySize = 16 << 10
+
+// テナントごとに、リクエストボディの username ごとに制限する。
+// 大文字小文字を変えて制限を回避されないように、小文字にそろえる。
+func rateLimitByUsername(name string, limit rateLimit) rateLimitRule {
+	return rateLimitRule{
+		name:  name + ":username",
+		limit: limit,
+		key: func(ctx echo.Context) string {
+			// 大きなボディでメモリを使い切られないように、先頭だけを読み込む。
+			// ハンドラーでもボディを読めるように、読み込んだ内容を残りの前に戻しておく。
+			original := ctx.Request().Body
+			body, err := io.ReadAll(io.LimitReader(original, rateLimitMaxBodySize+1))
+			ctx.Request().Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), original), original}
+			if err != nil || len(body) > rateLimitMaxBodySize {
+				return ""
+			}
+
+			var req struct {
+				Username string `json:"username"`
+			}
+			if err := json.Unmarshal(body, &req); err != nil {
+				return ""
+			}
+			if req.Username == "" {
+				return ""
+			}
+			return currentTenant(ctx).ID + ":" + strings.ToLower(req.Username)
+		},
+	}
+}
+
+// サーバー全体で制限する。
+func rateLimitGlobal(name string, limit rateLimit) rateLimitRule {
+	return rateLimitRule{
+		name:  name + ":global",
+		limit: limit,
+		key:   func(ctx echo.Context) string { return "all" },
+	}
+}
+
+// ルールのいずれかで制限された場合は、429 Too Many Requests と Retry-After ヘッダーを返す。
+// 制限された場合は、他のルールのトークンも消費しない。
+//
+// レート制限の確認に失敗した場合(Redisに接続できないなど)は、サービスを止めないようにリクエストを通す。
+func rateLimitMiddleware(limiter rateLimiter, rules ...rateLimitRule) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			var buckets []rateLimitBucket
+			var applied []rateLimitRule
+			for _, rule := range rules {
+				key := rule.key(ctx)
+				if key == "" {
+					continue
+				}
+				buckets = append(buckets, rateLimitBucket{key: rule.name + ":" + key, limit: rule.limit})
+				applied = append(applied, rule)
+			}
+			if len(buckets) == 0 {
+				return next(ctx)
+			}
+
+			denied, retryAfter, err := limiter.Allow(ctx.Request().Context(), buckets)
+			if err != nil {
+				ctx.Logger().Errorf("Failed to check rate limit: %v\n", err)
+				return next(ctx)
+			}
+			if denied >= 0 {
+				// ユーザー名ごとの制限のキーには、ユーザー名が含まれるので出力しない
+				addLogAttrs(ctx, "rate_limit_rule", applied[denied].name)
+				ctx.Logger().Warnf("Rate limit exceeded\n")
+				ctx.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				return ctx.JSON(http.StatusTooManyRequests, "Too many requests")
+			}
+
+			return next(ctx)
+		}
+	}
+}
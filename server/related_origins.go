@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Related Origin Requests。
+//
+// RP IDとは別のドメイン(例: brand.example と brand.co.jp)で同じRPのパスキーを使うために、
+// RP IDのドメインの /.well-known/webauthn で、そのRPを使ってよいオリジンの一覧を公開する。
+// ブラウザはこの一覧を確認してから、別ドメインでのRP IDの指定を許可する。
+//
+// SEE: https://w3c.github.io/webauthn/#sctn-related-origins
+
+// ブラウザが必ずサポートする、関連オリジンの登録可能ドメインのラベル数の下限。
+// これを超えた分は、ブラウザによっては無視される。
+const relatedOriginsMaxLabels = 5
+
+type wellKnownWebAuthnResponse struct {
+	Origins []string `json:"origins"`
+}
+
+// テナントの関連オリジンを公開する。テナントは Host ヘッダー(= RP IDのドメイン)で特定される。
+func wellKnownWebAuthn() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		tenant := currentTenant(ctx)
+		if len(tenant.RelatedOrigins) == 0 {
+			return ctx.JSON(http.StatusNotFound, nil)
+		}
+
+		return ctx.JSON(http.StatusOK, wellKnownWebAuthnResponse{Origins: tenant.RelatedOrigins})
+	}
+}
+
+// オリジンが RP ID と同じドメインか、そのサブドメインか。
+func isOriginWithinRPID(origin *url.URL, rpID string) bool {
+	host := strings.ToLower(origin.Hostname())
+	rpID = strings.ToLower(rpID)
+
+	return host == rpID || strings.HasSuffix(host, "."+rpID)
+}
+
+// "https://example.com" のような、パスなどを含まないオリジンとして解釈する。
+func parseOrigin(v string) (*url.URL, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid origin %q: %w", v, err)
+	}
+	if u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid origin %q: must be <scheme>://<host>[:<port>]", v)
+	}
+	// localhost 以外は安全なコンテキストでないとWebAuthnを使えない
+	if u.Scheme != "https" && u.Hostname() != "localhost" {
+		return nil, fmt.Errorf("invalid origin %q: must be https", v)
+	}
+
+	return u, nil
+}
+
+// 登録可能ドメインのラベル(example.co.jp なら example)。
+func registrableDomainLabel(origin *url.URL) string {
+	domain, err := publicsuffix.EffectiveTLDPlusOne(origin.Hostname())
+	if err != nil {
+		// localhost など、公開サフィックスを持たない場合はホスト名をそのまま使う
+		return origin.Hostname()
+	}
+
+	label, _, _ := strings.Cut(domain, ".")
+	return label
+}
+
+// テナントの RPOrigins と関連オリジンが矛盾していないか確認する。
+//
+//   - RPOrigins のうち RP ID のドメイン外のものは、関連オリジンとして公開していないとブラウザに拒否される
+//   - 関連オリジンの登録可能ドメインのラベルが多すぎる場合は、ブラウザによっては無視されるので警告を返す
+func (t *Tenant) validateRelatedOrigins() (warnings []string, err error) {
+	var errs []error
+	for _, v := range t.RPOrigins {
+		origin, err := parseOrigin(v)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !isOriginWithinRPID(origin, t.RPID) && !slices.Contains(t.RelatedOrigins, v) {
+			errs = append(errs, fmt.Errorf("origin %s is outside of RP ID %s and must be listed in related_origins", v, t.RPID))
+		}
+	}
+
+	var labels []string
+	for _, v := range t.RelatedOrigins {
+		origin, err := parseOrigin(v)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if label := registrableDomainLabel(origin); !slices.Contains(labels, label) {
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) > relatedOriginsMaxLabels {
+		warnings = append(warnings, fmt.Sprintf("related_origins has %d registrable domain labels; browsers may ignore origins beyond %d", len(labels), relatedOriginsMaxLabels))
+	}
+
+	return warnings, errors.Join(errs...)
+}
+
+// 起動時にすべてのテナントの設定を確認する。設定が正しくないテナントがある場合や、読み込めなかった場合はエラーを返す。
+func (r *tenantRegistry) validate(ctx context.Context) error {
+	var tenants []*Tenant
+	if err := r.db.NewSelect().Model(&tenants).Scan(ctx); err != nil {
+		return fmt.Errorf("Failed to load tenants to validate: %w", err)
+	}
+
+	var errs []error
+	for _, t := range tenants {
+		warnings, err := t.validate()
+		for _, w := range warnings {
+			r.logger.Warnf("Tenant %s: %s\n", t.ID, w)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", t.ID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
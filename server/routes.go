@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// クライアントのIPアドレスの取得方法を作成する。
+//
+// X-Forwarded-For はクライアントが自由に付けられるので、 trustedProxies(CIDR)から来たリクエストの場合のみ使う。
+// 指定しない場合は、接続元のIPアドレスをそのまま使う。
+func newIPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	// デフォルトではプライベートネットワークなども信頼するので、指定したアドレスだけにする
+	opts := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, v := range trustedProxies {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TRUSTED_PROXIES: %w", err)
+		}
+		opts = append(opts, echo.TrustIPRange(ipNet))
+	}
+
+	return echo.ExtractIPFromXFFHeader(opts...), nil
+}
+
+// ミドルウェアとルーティングを設定した Echo を作成する。
+func (app *App) newRouter() *echo.Echo {
+	cfg := app.cfg
+	db, sessions, tenants := app.db, app.sessions, app.tenants
+
+	e := echo.New()
+	// ctx.RealIP() でクライアントのIPアドレスを取得する方法。レート制限や監査ログに使う。
+	e.IPExtractor = app.clientIP
+
+	// 構造化ログとトレーシング
+	e.Logger = app.logger
+	e.Use(requestID(), httpTracing(cfg.ServiceName), traceIDPropagation(), requestLogging(app.logger))
+	// ハンドラーやミドルウェアでパニックが起きても、サーバーを止めずに 500 を返す
+	e.Use(middleware.Recover())
+
+	// メトリクス
+	e.Use(httpMetrics(app.metrics))
+
+	// リクエストのテナントを特定する。パスのプレフィックスを取り除くので、ルーティングより前に実行する。
+	// Host ヘッダーに一致するテナントがない場合は DEFAULT_TENANT のテナントにする(空にすると 404 を返す)。
+	e.Pre(resolveTenant(tenants, cfg.DefaultTenant))
+	allowedOrigins := cfg.AllowedOrigins
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		// allowedOrigins に加えて、各テナントのオリジンを許可する
+		AllowOriginFunc: func(origin string) (bool, error) {
+			if slices.Contains(allowedOrigins, origin) {
+				return true, nil
+			}
+			return tenants.allowsOrigin(context.Background(), origin)
+		},
+		AllowCredentials: true, // Cookieを取り扱えるようにする
+	}))
+	e.Use(securityHeaders(allowedOrigins))
+	// Cookieで認証しているリクエストのCSRF対策
+	e.Use(checkRequestOrigin(allowedOrigins, cfg.Cookies), csrfProtection(cfg.Cookies))
+
+	// トークンモードでログインしたクライアントのアクセストークンと、Cookieのログインセッションを検証する
+	oidc := cfg.OIDC
+	e.Use(accessTokenAuth(db, app.signingKeys, oidc), loginSessionAuth(sessions, cfg.Cookies))
+
+	// レート制限
+	limiter := newRateLimiter(cfg.RateLimits, app.redis)
+	limits := cfg.RateLimits
+	registrationRateLimit := rateLimitMiddleware(limiter,
+		rateLimitByIP("ceremony", limits.CeremonyPerIP),
+		rateLimitByUsername("registration", limits.RegistrationPerUsername),
+		rateLimitGlobal("ceremony", limits.CeremonyGlobal),
+	)
+	ceremonyRateLimit := rateLimitMiddleware(limiter,
+		rateLimitByIP("ceremony", limits.CeremonyPerIP),
+		rateLimitGlobal("ceremony", limits.CeremonyGlobal),
+	)
+	lookupRateLimit := rateLimitMiddleware(limiter, rateLimitByIP("lookup", limits.LookupPerIP))
+	tokenRateLimit := rateLimitMiddleware(limiter, rateLimitByIP("token", limits.TokenPerIP))
+
+	e.GET("/healthz", healthz())
+	e.GET("/readyz", readyz(app.checks, &app.draining))
+	e.GET("/csrf", getCSRFToken())
+	e.POST("/users", createUser(db, sessions), registrationRateLimit)
+	e.GET("/users", getUsers(db), lookupRateLimit)
+	e.GET("/users/:id", getUser(db), lookupRateLimit)
+	// パスキー管理
+	passkeys := app.passkeys
+	e.GET("/users/:user_id/public_keys", passkeys.ListCredentials(), requireSelf("user_id"))
+	// 監査ログ
+	e.GET("/users/:id/events", listUserAuthEvents(db), requireSelf("id"))
+	// ログインセッション
+	e.GET("/users/:id/sessions", listUserSessions(db, sessions), requireSelf("id"))
+	e.DELETE("/users/:id/sessions", deleteUserSessions(db, sessions), requireSelf("id"))
+	e.DELETE("/users/:id/sessions/:session_id", deleteUserSession(db, sessions), requireSelf("id"))
+	e.DELETE("/users/:user_id/public_keys/:credential_id", passkeys.DeleteCredential(), requireSelf("user_id"))
+	e.POST("/users/:user_id/public_keys/:credential_id/disable", passkeys.DisableCredential(), requireSelf("user_id"))
+	e.POST("/users/:user_id/public_keys/:credential_id/enable", passkeys.EnableCredential(), requireSelf("user_id"))
+	// 認証機の登録
+	e.POST("/registration/options", passkeys.BeginRegistration(), ceremonyMetrics(app.metrics, "registration", "begin"), registrationRateLimit)
+	e.POST("/registration/verifications", passkeys.FinishRegistration(), ceremonyMetrics(app.metrics, "registration", "finish"), ceremonyRateLimit)
+	// 認証
+	e.POST("/authentication/options", passkeys.BeginLogin(), ceremonyMetrics(app.metrics, "login", "begin"), ceremonyRateLimit)
+	e.POST("/authentication/verifications", passkeys.FinishLogin(), ceremonyMetrics(app.metrics, "login", "finish"), ceremonyRateLimit)
+	// トークンモード
+	e.POST("/token/refresh", refreshTokens(db, oidc), tokenRateLimit)
+	e.POST("/token/revoke", revokeToken(db), tokenRateLimit)
+	// Related Origin Requests
+	e.GET("/.well-known/webauthn", wellKnownWebAuthn())
+	// ネイティブアプリとのパスキーの共有
+	e.GET("/.well-known/assetlinks.json", wellKnownAssetLinks())
+	e.GET("/.well-known/apple-app-site-association", wellKnownAppleAppSiteAssociation())
+	// OpenID Connect
+	e.GET("/.well-known/openid-configuration", oidcDiscovery(oidc))
+	e.GET("/.well-known/jwks.json", oidcJWKS(db, oidc))
+	e.GET("/oauth2/authorize", oidcAuthorize(db, sessions, oidc))
+	e.POST("/oauth2/token", oidcToken(db, sessions, oidc), tokenRateLimit)
+	e.GET("/userinfo", oidcUserInfo(db, sessions))
+	e.POST("/userinfo", oidcUserInfo(db, sessions))
+
+	// 管理者API
+	admin := e.Group("/admin", adminAuth(db), auditAdminAction(db))
+	anyAdmin := requireAdminRole(adminRoleViewer, adminRoleOperator)
+	operator := requireAdminRole(adminRoleOperator)
+	admin.GET("/users", adminSearchUsers(db), anyAdmin)
+	admin.GET("/users/:id", adminGetUser(db), anyAdmin)
+	admin.GET("/users/:id/login_history", adminListAuthEvents(db, authEventLogin), anyAdmin)
+	admin.GET("/users/:id/events", adminListAuthEvents(db), anyAdmin)
+	admin.POST("/users/:id/disable", adminUpdateUserStatus(db, sessions, userStatusDisabled), operator)
+	admin.POST("/users/:id/enable", adminUpdateUserStatus(db, sessions, userStatusActive), operator)
+	admin.POST("/users/:id/schedule_deletion", adminUpdateUserStatus(db, sessions, userStatusPendingDeletion), operator)
+	admin.POST("/users/:id/logout", adminForceLogout(db, sessions), operator)
+	admin.DELETE("/users/:user_id/public_keys/:public_key_id", adminRevokePublicKey(db), operator)
+	admin.POST("/users/:user_id/public_keys/:public_key_id/disable", adminSetPublicKeyDisabled(db, true), operator)
+	admin.POST("/users/:user_id/public_keys/:public_key_id/enable", adminSetPublicKeyDisabled(db, false), operator)
+	// Webhook
+	admin.GET("/webhooks", adminListWebhookEndpoints(db), anyAdmin)
+	admin.POST("/webhooks", adminCreateWebhookEndpoint(db), operator)
+	admin.DELETE("/webhooks/:webhook_id", adminDeleteWebhookEndpoint(db), operator)
+	admin.GET("/webhooks/deliveries", adminListWebhookDeliveries(db), anyAdmin)
+	admin.POST("/webhooks/deliveries/:delivery_id/retry", adminRetryWebhookDelivery(db), operator)
+	// テナント
+	admin.GET("/tenants", adminListTenants(tenants), anyAdmin)
+	admin.POST("/tenants", adminCreateTenant(db, tenants), operator)
+	// OpenID Connectのクライアント
+	admin.GET("/oidc/clients", adminListOIDCClients(db), anyAdmin)
+	admin.POST("/oidc/clients", adminCreateOIDCClient(db), operator)
+	admin.DELETE("/oidc/clients/:client_id", adminDeleteOIDCClient(db), operator)
+
+	return e
+}
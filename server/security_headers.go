@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// HSTSの有効期間(2年)
+const hstsMaxAge = 2 * 365 * 24 * 60 * 60
+
+// セキュリティ関連のレスポンスヘッダーを付ける。
+//
+// APIはJSONしか返さないので、CSPではすべてのリソースの読み込みとフレームへの埋め込みを禁止する。
+// HSTSはHTTPSでのリクエスト(またはプロキシが X-Forwarded-Proto: https を付けたリクエスト)にのみ付く。
+func securityHeaders(allowedOrigins []string) echo.MiddlewareFunc {
+	secure := middleware.SecureWithConfig(middleware.SecureConfig{
+		// 古いブラウザのXSSフィルターはかえって脆弱性の原因になるので、無効化を指示する
+		XSSProtection:         "0",
+		ContentTypeNosniff:    "nosniff",
+		XFrameOptions:         "DENY",
+		HSTSMaxAge:            hstsMaxAge,
+		ContentSecurityPolicy: "default-src 'none'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'",
+		ReferrerPolicy:        "no-referrer",
+	})
+	permissionsPolicy := newPermissionsPolicy(allowedOrigins)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := secure(next)
+		return func(ctx echo.Context) error {
+			ctx.Response().Header().Set("Permissions-Policy", permissionsPolicy)
+			return h(ctx)
+		}
+	}
+}
+
+// WebAuthnのAPI(navigator.credentials.get/create)は、自身と許可したオリジンでのみ使えるようにする。
+//
+// SEE: https://w3c.github.io/webauthn/#sctn-permissions-policy
+func newPermissionsPolicy(allowedOrigins []string) string {
+	allowlist := []string{"self"}
+	for _, origin := range allowedOrigins {
+		allowlist = append(allowlist, fmt.Sprintf("%q", origin))
+	}
+
+	return fmt.Sprintf(
+		"publickey-credentials-get=(%[1]s), publickey-credentials-create=(%[1]s)",
+		strings.Join(allowlist, " "),
+	)
+}
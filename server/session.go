@@ -5,50 +5,61 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
-	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/daikideal/go-passkey-demo/passkey"
 	"github.com/redis/go-redis/v9"
 )
 
-const duration time.Duration = 5 * time.Minute
+const (
+	// ログイン後のセッションの有効期間
+	loginSessionDuration time.Duration = 24 * time.Hour
 
-var sessionStore *redis.Client
+	loginSessionKeyPrefix = "login_session:"
+	// ユーザーごとのログインセッションIDの集合。全セッションの強制ログアウトに使用する。
+	userSessionsKeyPrefix = "user_sessions:"
+)
 
-func init() {
-	sessionStore = redis.NewClient(&redis.Options{
-		Addr:     "redis:6379",
-		Password: "",
-		DB:       0,
-	})
+// 認証器登録・認証のセッションや、ログインセッションなどを保存するストア(Redis)。
+type sessionStore struct {
+	client *redis.Client
 }
 
-func CreateSession(ctx context.Context, data *webauthn.SessionData) (string, error) {
-	// REVEIW: user/:id 配下に作成した方がいいか？
-	sessionId, _ := random(32)
+func newSessionStore(client *redis.Client) *sessionStore {
+	return &sessionStore{client: client}
+}
+
+// 認証器登録・認証のセッションを保存する。 passkey.SessionStore の実装。
+func (s *sessionStore) CreateSession(ctx context.Context, session *passkey.Session, ttl time.Duration) (string, error) {
+	sessionId, err := random(32)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate session id: %w", err)
+	}
 
 	// redisに直接structを保存することはできない。
 	// 試したところ、byte列にすれば保存できた。
-	value, err := json.Marshal(data)
+	value, err := json.Marshal(session)
 	if err != nil {
 		return "", fmt.Errorf("Failed to encoding data to redis value: %w", err)
 	}
 
-	if err := sessionStore.Set(ctx, sessionId, value, duration).Err(); err != nil {
+	if err := s.client.Set(ctx, sessionId, value, ttl).Err(); err != nil {
 		return "", fmt.Errorf("Failed to create session: %w", err)
 	}
 
 	return sessionId, nil
 }
 
-func GetSession(ctx context.Context, sessionID string) (*webauthn.SessionData, error) {
-	val, err := sessionStore.Get(ctx, sessionID).Bytes()
+func (s *sessionStore) GetSession(ctx context.Context, sessionID string) (*passkey.Session, error) {
+	val, err := s.client.Get(ctx, sessionID).Bytes()
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get session: %w", err)
 	}
 
-	var session *webauthn.SessionData
+	var session *passkey.Session
 	if err = json.Unmarshal(val, &session); err != nil {
 		return nil, fmt.Errorf("Failed to decode session: %w", err)
 	}
@@ -56,8 +67,180 @@ func GetSession(ctx context.Context, sessionID string) (*webauthn.SessionData, e
 	return session, nil
 }
 
-func DeleteSession(ctx context.Context, sessionID string) {
-	sessionStore.Del(ctx, sessionID)
+func (s *sessionStore) DeleteSession(ctx context.Context, sessionID string) {
+	s.client.Del(ctx, sessionID)
+}
+
+// ログインに成功したユーザーのセッション。
+// 認証器登録・認証のセッション(passkey.Session)とは別に、ログイン状態を保持するために使用する。
+type LoginSession struct {
+	UserID string `json:"user_id"`
+	// ログインしたテナント。トークンモードの場合も設定する。
+	TenantID  string    `json:"tenant_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// ログイン時の認証器でユーザー検証(生体認証やPIN)が行われたかどうか。OIDCの amr や acr の判定に使う。
+	UserVerified bool `json:"user_verified"`
+	// ログインに使った認証器(webauthn_credentials.id)
+	CredentialID string `json:"credential_id,omitempty"`
+	// 最後にアクセスした日時と、その時のIPアドレス・User-Agent
+	LastSeenAt time.Time `json:"last_seen_at"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+}
+
+func (s *sessionStore) CreateLoginSession(ctx context.Context, session *LoginSession) (string, error) {
+	sessionId, err := random(32)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate session id: %w", err)
+	}
+
+	session.CreatedAt = time.Now()
+	session.LastSeenAt = session.CreatedAt
+	value, err := json.Marshal(session)
+	if err != nil {
+		return "", fmt.Errorf("Failed to encoding data to redis value: %w", err)
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, loginSessionKeyPrefix+sessionId, value, loginSessionDuration)
+		pipe.SAdd(ctx, userSessionsKeyPrefix+session.UserID, sessionId)
+		// 集合はセッションより先に消えないように、最後に作成したセッションに合わせて期限を延ばす
+		pipe.Expire(ctx, userSessionsKeyPrefix+session.UserID, loginSessionDuration)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create login session: %w", err)
+	}
+
+	return sessionId, nil
+}
+
+func (s *sessionStore) GetLoginSession(ctx context.Context, sessionID string) (*LoginSession, error) {
+	val, err := s.client.Get(ctx, loginSessionKeyPrefix+sessionID).Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get login session: %w", err)
+	}
+
+	var session *LoginSession
+	if err = json.Unmarshal(val, &session); err != nil {
+		return nil, fmt.Errorf("Failed to decode login session: %w", err)
+	}
+
+	return session, nil
+}
+
+// 最後にアクセスした日時などを更新する。セッションの有効期限は延ばさない。
+func (s *sessionStore) TouchLoginSession(ctx context.Context, sessionID string, session *LoginSession) error {
+	value, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("Failed to encoding data to redis value: %w", err)
+	}
+
+	// 更新する間にセッションが削除された場合に、作り直さないように XX を指定する
+	err = s.client.SetArgs(ctx, loginSessionKeyPrefix+sessionID, value, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("Failed to update login session: %w", err)
+	}
+
+	return nil
+}
+
+func (s *sessionStore) DeleteLoginSession(ctx context.Context, sessionID string) {
+	s.client.Del(ctx, loginSessionKeyPrefix+sessionID)
+}
+
+// セッションIDと、そのセッションの内容
+type UserLoginSession struct {
+	ID string
+	*LoginSession
+}
+
+// ユーザーの有効なログインセッションを、作成日時の新しい順に返す。
+// 集合に残っている期限切れのセッションIDは、ついでに集合から取り除く。
+func (s *sessionStore) ListUserLoginSessions(ctx context.Context, userID string) ([]UserLoginSession, error) {
+	sessionIDs, err := s.client.SMembers(ctx, userSessionsKeyPrefix+userID).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get user sessions: %w", err)
+	}
+	if len(sessionIDs) == 0 {
+		return []UserLoginSession{}, nil
+	}
+
+	keys := make([]string, 0, len(sessionIDs))
+	for _, id := range sessionIDs {
+		keys = append(keys, loginSessionKeyPrefix+id)
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get login sessions: %w", err)
+	}
+
+	sessions := make([]UserLoginSession, 0, len(sessionIDs))
+	var expired []interface{}
+	for i, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			expired = append(expired, sessionIDs[i])
+			continue
+		}
+
+		var session *LoginSession
+		if err := json.Unmarshal([]byte(s), &session); err != nil {
+			return nil, fmt.Errorf("Failed to decode login session: %w", err)
+		}
+		sessions = append(sessions, UserLoginSession{ID: sessionIDs[i], LoginSession: session})
+	}
+	if len(expired) > 0 {
+		if err := s.client.SRem(ctx, userSessionsKeyPrefix+userID, expired...).Err(); err != nil {
+			return nil, fmt.Errorf("Failed to remove expired sessions: %w", err)
+		}
+	}
+
+	slices.SortFunc(sessions, func(a, b UserLoginSession) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return sessions, nil
+}
+
+// ユーザーのログインセッションを1つ削除する。削除できなかった場合は false を返す。
+func (s *sessionStore) DeleteUserLoginSession(ctx context.Context, userID, sessionID string) (bool, error) {
+	var deleted *redis.IntCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, loginSessionKeyPrefix+sessionID)
+		pipe.SRem(ctx, userSessionsKeyPrefix+userID, sessionID)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("Failed to delete login session: %w", err)
+	}
+
+	return deleted.Val() > 0, nil
+}
+
+// ユーザーのログインセッションをすべて削除し、削除したセッションの数を返す。
+func (s *sessionStore) DeleteUserLoginSessions(ctx context.Context, userID string) (int, error) {
+	sessionIDs, err := s.client.SMembers(ctx, userSessionsKeyPrefix+userID).Result()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get user sessions: %w", err)
+	}
+
+	keys := make([]string, 0, len(sessionIDs)+1)
+	for _, id := range sessionIDs {
+		keys = append(keys, loginSessionKeyPrefix+id)
+	}
+	keys = append(keys, userSessionsKeyPrefix+userID)
+
+	deleted, err := s.client.Del(ctx, keys...).Result()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to delete user sessions: %w", err)
+	}
+	// 集合には期限切れのセッションIDも残っているので、実際に削除できた数から集合自体の分を除く
+	if len(sessionIDs) > 0 {
+		deleted--
+	}
+
+	return int(deleted), nil
 }
 
 func random(length int) (string, error) {
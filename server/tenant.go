@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/uptrace/bun"
+)
+
+// 複数のブランド(ドメイン)を1つのサーバーで扱うためのテナント。
+//
+// テナントごとにRP IDや許可するオリジンが異なるので、 webauthn.WebAuthn もテナントごとに作成する。
+// リクエストのテナントは、パスの /t/:tenant プレフィックスか Host ヘッダーから特定する。
+// ユーザーと認証器はテナントごとに分かれており、同じ名前のユーザーも別のテナントであれば登録できる。
+
+const (
+	defaultTenantID  = "default"
+	tenantContextKey = "tenant"
+	tenantPathPrefix = "/t/"
+)
+
+type Tenant struct {
+	bun.BaseModel `bun:"table:tenants,alias:t"`
+
+	ID            string   `json:"id" bun:"id,pk"`
+	RPID          string   `json:"rp_id" bun:"rp_id"`
+	RPDisplayName string   `json:"rp_display_name" bun:"rp_display_name"`
+	RPOrigins     []string `json:"rp_origins" bun:"rp_origins,array"`
+	Hosts         []string `json:"hosts" bun:"hosts,array"`
+	// RP IDとは別のドメインで、このRPを使ってよいオリジン。 /.well-known/webauthn で公開する。
+	RelatedOrigins []string `json:"related_origins" bun:"related_origins,array"`
+	// 同じパスキーを使うネイティブアプリ
+	AndroidApps []androidApp `json:"android_apps" bun:"android_apps,type:jsonb"`
+	AppleAppIDs []string     `json:"apple_app_ids" bun:"apple_app_ids,array"`
+	// 認証器の登録・認証で求めるユーザー検証(required, preferred, discouraged)
+	UserVerification protocol.UserVerificationRequirement `json:"user_verification" bun:"user_verification"`
+	// 認証器の登録で求めるResident Key(required, preferred, discouraged)
+	ResidentKey protocol.ResidentKeyRequirement `json:"resident_key" bun:"resident_key"`
+	CreatedAt   time.Time                       `json:"created_at" bun:"created_at,nullzero,default:current_timestamp"`
+	UpdatedAt   time.Time                       `json:"updated_at" bun:"updated_at,nullzero,default:current_timestamp"`
+}
+
+// 認証器の登録・認証を受け付けるオリジン。関連オリジンやAndroidアプリからのリクエストも受け付ける。
+func (t *Tenant) origins() []string {
+	origins := slices.Clone(t.RPOrigins)
+	for _, origin := range slices.Concat(t.RelatedOrigins, t.androidOrigins()) {
+		if !slices.Contains(origins, origin) {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// テナントの設定を確認する。警告は、誤りではないが意図した通りに動かない可能性があるもの。
+func (t *Tenant) validate() ([]string, error) {
+	warnings, err := t.validateRelatedOrigins()
+	return warnings, errors.Join(err, t.validateNativeApps())
+}
+
+// テナントの設定から webauthn.WebAuthn を作成する。
+func (t *Tenant) newWebAuthn() (*webauthn.WebAuthn, error) {
+	if _, err := t.validate(); err != nil {
+		return nil, err
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPDisplayName: t.RPDisplayName,
+		RPID:          t.RPID,
+		RPOrigins:     t.origins(),
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			UserVerification: t.UserVerification,
+		},
+	})
+}
+
+// 認証器の登録時のオプション
+func (t *Tenant) registrationOptions() []webauthn.RegistrationOption {
+	// WithAuthenticatorSelection は選択条件を丸ごと置き換えるので、Resident Keyの指定より先に適用する
+	return []webauthn.RegistrationOption{
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{UserVerification: t.UserVerification}),
+		webauthn.WithResidentKeyRequirement(t.ResidentKey),
+	}
+}
+
+// Host ヘッダーがテナントのホストに一致するか。ポートを含めて登録した場合はポートまで比較する。
+func (t *Tenant) matchHost(host string) bool {
+	host = strings.ToLower(host)
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+
+	for _, h := range t.Hosts {
+		h = strings.ToLower(h)
+		if h == host || h == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+type tenantEntry struct {
+	tenant   *Tenant
+	webAuthn *webauthn.WebAuthn
+}
+
+// テナントと、テナントごとの webauthn.WebAuthn のキャッシュ。
+//
+// テナントの数は多くないので、一定時間ごとにすべて読み込み直す。
+// 設定が正しくないテナントは、ログに出力して読み込まない。
+type tenantRegistry struct {
+	db     *bun.DB
+	ttl    time.Duration
+	logger echo.Logger
+
+	mu       sync.RWMutex
+	entries  map[string]*tenantEntry
+	loadedAt time.Time
+}
+
+func newTenantRegistry(db *bun.DB, ttl time.Duration, logger echo.Logger) *tenantRegistry {
+	return &tenantRegistry{db: db, ttl: ttl, logger: logger}
+}
+
+// キャッシュが古い場合は読み込み直す。
+func (r *tenantRegistry) snapshot(ctx context.Context) (map[string]*tenantEntry, error) {
+	r.mu.RLock()
+	entries, loadedAt := r.entries, r.loadedAt
+	r.mu.RUnlock()
+	if entries != nil && time.Since(loadedAt) < r.ttl {
+		return entries, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// 待っている間に他のリクエストが読み込んだ場合
+	if r.entries != nil && time.Since(r.loadedAt) < r.ttl {
+		return r.entries, nil
+	}
+
+	var tenants []*Tenant
+	if err := r.db.NewSelect().Model(&tenants).Scan(ctx); err != nil {
+		// 読み込みに失敗した場合は、古いキャッシュがあればそれを使い続ける
+		if r.entries != nil {
+			r.logger.Errorf("Failed to reload tenants: %v\n", err)
+			return r.entries, nil
+		}
+		return nil, fmt.Errorf("Failed to load tenants: %w", err)
+	}
+
+	entries = make(map[string]*tenantEntry, len(tenants))
+	for _, t := range tenants {
+		w, err := t.newWebAuthn()
+		if err != nil {
+			r.logger.Errorf("Invalid tenant %s: %v\n", t.ID, err)
+			continue
+		}
+		entries[t.ID] = &tenantEntry{tenant: t, webAuthn: w}
+	}
+	r.entries = entries
+	r.loadedAt = time.Now()
+
+	return entries, nil
+}
+
+// 次のリクエストで読み込み直すようにする。テナントを追加・変更した場合に呼ぶ。
+func (r *tenantRegistry) invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.loadedAt = time.Time{}
+}
+
+func (r *tenantRegistry) byID(ctx context.Context, id string) (*tenantEntry, bool, error) {
+	entries, err := r.snapshot(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	entry, ok := entries[id]
+	return entry, ok, nil
+}
+
+func (r *tenantRegistry) byHost(ctx context.Context, host string) (*tenantEntry, bool, error) {
+	entries, err := r.snapshot(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, entry := range entries {
+		if entry.tenant.matchHost(host) {
+			return entry, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// すべてのテナントを、IDの順に返す。
+func (r *tenantRegistry) list(ctx context.Context) ([]*Tenant, error) {
+	entries, err := r.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make([]*Tenant, 0, len(entries))
+	for _, entry := range entries {
+		tenants = append(tenants, entry.tenant)
+	}
+	slices.SortFunc(tenants, func(a, b *Tenant) int { return strings.Compare(a.ID, b.ID) })
+
+	return tenants, nil
+}
+
+// いずれかのテナントで許可しているオリジンか。CORSの判定に使う。
+func (r *tenantRegistry) allowsOrigin(ctx context.Context, origin string) (bool, error) {
+	entries, err := r.snapshot(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range entries {
+		if slices.Contains(entry.tenant.origins(), origin) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// パスの /t/:tenant プレフィックスからテナントIDを取り出し、プレフィックスを除いたパスを返す。
+func splitTenantPath(path string) (string, string, bool) {
+	if !strings.HasPrefix(path, tenantPathPrefix) {
+		return "", path, false
+	}
+
+	id, rest, _ := strings.Cut(strings.TrimPrefix(path, tenantPathPrefix), "/")
+	if id == "" {
+		return "", path, false
+	}
+	return id, "/" + rest, true
+}
+
+// リクエストのテナントを特定する。ルーティングの前に実行する(e.Pre)。
+//
+// /t/:tenant で始まるパスの場合はそのテナントにし、プレフィックスを除いたパスでルーティングする。
+// それ以外は Host ヘッダーで特定し、一致するテナントがない場合は fallbackID のテナントにする。
+// fallbackID が空の場合や、テナントが見つからない場合は 404 を返す。
+func resolveTenant(registry *tenantRegistry, fallbackID string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			req := ctx.Request()
+			// ヘルスチェックなどは、どのテナントにも属さない
+			if isProbePath(req.URL.Path) {
+				return next(ctx)
+			}
+
+			var (
+				entry *tenantEntry
+				ok    bool
+				err   error
+			)
+			if id, rest, found := splitTenantPath(req.URL.Path); found {
+				entry, ok, err = registry.byID(req.Context(), id)
+				req.URL.Path = rest
+				req.URL.RawPath = ""
+			} else {
+				entry, ok, err = registry.byHost(req.Context(), req.Host)
+				if err == nil && !ok && fallbackID != "" {
+					entry, ok, err = registry.byID(req.Context(), fallbackID)
+				}
+			}
+			if err != nil {
+				ctx.Logger().Errorf("Failed to resolve tenant: %v\n", err)
+				return ctx.JSON(http.StatusInternalServerError, nil)
+			}
+			if !ok {
+				ctx.Logger().Warnf("Tenant is not found: %s %s\n", req.Host, req.URL.Path)
+				return ctx.JSON(http.StatusNotFound, "Tenant is not found")
+			}
+
+			ctx.Set(tenantContextKey, entry)
+			return next(ctx)
+		}
+	}
+}
+
+// リクエストのテナントを返す。ヘルスチェックなど、テナントを特定しないリクエストの場合は false を返す。
+func tenantFromContext(ctx echo.Context) (*Tenant, bool) {
+	entry, ok := ctx.Get(tenantContextKey).(*tenantEntry)
+	if !ok {
+		return nil, false
+	}
+	return entry.tenant, true
+}
+
+// リクエストのテナント。 resolveTenant を通ったリクエストでのみ使用できる。
+func currentTenant(ctx echo.Context) *Tenant {
+	return ctx.Get(tenantContextKey).(*tenantEntry).tenant
+}
+
+// リクエストのテナントの webauthn.WebAuthn
+func tenantWebAuthn(ctx echo.Context) *webauthn.WebAuthn {
+	return ctx.Get(tenantContextKey).(*tenantEntry).webAuthn
+}
+
+func adminListTenants(registry *tenantRegistry) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		tenants, err := registry.list(ctx.Request().Context())
+		if err != nil {
+			ctx.Logger().Errorf("Failed to list tenants: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		return ctx.JSON(http.StatusOK, tenants)
+	}
+}
+
+type adminCreateTenantRequest struct {
+	ID               string                               `json:"id"`
+	RPID             string                               `json:"rp_id"`
+	RPDisplayName    string                               `json:"rp_display_name"`
+	RPOrigins        []string                             `json:"rp_origins"`
+	Hosts            []string                             `json:"hosts"`
+	RelatedOrigins   []string                             `json:"related_origins"`
+	AndroidApps      []androidApp                         `json:"android_apps"`
+	AppleAppIDs      []string                             `json:"apple_app_ids"`
+	UserVerification protocol.UserVerificationRequirement `json:"user_verification"`
+	ResidentKey      protocol.ResidentKeyRequirement      `json:"resident_key"`
+}
+
+// テナントを追加する。保存する前に webauthn.WebAuthn を作成できるか確認する。
+func adminCreateTenant(db *bun.DB, registry *tenantRegistry) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var req adminCreateTenantRequest
+		if err := ctx.Bind(&req); err != nil {
+			ctx.Logger().Errorf("Failed to process request: %v\n", err)
+			return ctx.JSON(http.StatusBadRequest, nil)
+		}
+
+		tenant := &Tenant{
+			ID:               req.ID,
+			RPID:             req.RPID,
+			RPDisplayName:    req.RPDisplayName,
+			RPOrigins:        req.RPOrigins,
+			Hosts:            req.Hosts,
+			RelatedOrigins:   req.RelatedOrigins,
+			AndroidApps:      req.AndroidApps,
+			AppleAppIDs:      req.AppleAppIDs,
+			UserVerification: req.UserVerification,
+			ResidentKey:      req.ResidentKey,
+		}
+		if tenant.Hosts == nil {
+			tenant.Hosts = []string{}
+		}
+		if tenant.RelatedOrigins == nil {
+			tenant.RelatedOrigins = []string{}
+		}
+		if tenant.AndroidApps == nil {
+			tenant.AndroidApps = []androidApp{}
+		}
+		if tenant.AppleAppIDs == nil {
+			tenant.AppleAppIDs = []string{}
+		}
+		if tenant.UserVerification == "" {
+			tenant.UserVerification = protocol.VerificationPreferred
+		}
+		if tenant.ResidentKey == "" {
+			tenant.ResidentKey = protocol.ResidentKeyRequirementRequired
+		}
+
+		if tenant.ID == "" || strings.Contains(tenant.ID, "/") {
+			return ctx.JSON(http.StatusBadRequest, "id is required and must not contain '/'")
+		}
+		if _, err := tenant.newWebAuthn(); err != nil {
+			return ctx.JSON(http.StatusBadRequest, err.Error())
+		}
+
+		if _, err := db.NewInsert().Model(tenant).Returning("*").Exec(ctx.Request().Context()); err != nil {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+				return ctx.JSON(http.StatusConflict, "Tenant already exists")
+			}
+			ctx.Logger().Errorf("Failed to insert tenant: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		registry.invalidate()
+
+		return ctx.JSON(http.StatusCreated, tenant)
+	}
+}
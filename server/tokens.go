@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+)
+
+// Cookieを扱えないクライアント(モバイルアプリやCLI)向けの、トークンモードのログイン。
+//
+// POST /authentication/verifications?mode=token でログインすると、ログインセッションのCookieの代わりに
+// 有効期限の短いJWTのアクセストークンと、リフレッシュトークンを返す。
+// アクセストークンは Authorization: Bearer ヘッダーで送ると、ログインセッションと同じように扱われる。
+//
+// アクセストークンには、同時に発行したリフレッシュトークンのファミリーのIDを sid として含める。
+// ログアウトや管理者による無効化・強制ログアウトをすぐに反映するように、リクエストのたびにファミリーが失効していないことと、
+// ユーザーの状態を確認する。
+
+const (
+	accessTokenDuration  = 15 * time.Minute
+	refreshTokenDuration = 30 * 24 * time.Hour
+
+	// アクセストークンであることを示すJWTの typ ヘッダー。IDトークンをアクセストークンとして使えないようにする。
+	//
+	// SEE: https://www.rfc-editor.org/rfc/rfc9068#section-2.1
+	accessTokenType = "at+jwt"
+
+	accessTokenContextKey = "access_token"
+)
+
+type accessTokenClaims struct {
+	jwt.RegisteredClaims
+
+	AuthTime int64    `json:"auth_time"`
+	AMR      []string `json:"amr"`
+	ACR      string   `json:"acr"`
+	// ログインしたテナント。他のテナントではアクセストークンを使えないようにする。
+	TenantID string `json:"tenant_id"`
+	// 同時に発行したリフレッシュトークンのファミリーのID
+	SessionID string `json:"sid"`
+}
+
+// アクセストークンのログイン情報を、ログインセッションと同じ形にする。
+func (c *accessTokenClaims) loginSession() *LoginSession {
+	return &LoginSession{
+		UserID:       c.Subject,
+		TenantID:     c.TenantID,
+		CreatedAt:    time.Unix(c.AuthTime, 0),
+		UserVerified: slices.Contains(c.AMR, "user"),
+	}
+}
+
+func issueAccessToken(ctx context.Context, db bun.IDB, cfg oidcConfig, rt *RefreshToken) (string, error) {
+	now := time.Now()
+	amr, acr := oidcAuthenticationMethods(rt.UserVerified)
+	issuer := cfg.tenantIssuer(rt.TenantID)
+
+	return signJWT(ctx, db, cfg, accessTokenType, &accessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   rt.UserID,
+			Audience:  jwt.ClaimStrings{issuer},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenDuration)),
+			ID:        uuid.NewString(),
+		},
+		AuthTime:  rt.AuthTime.Unix(),
+		AMR:       amr,
+		ACR:       acr,
+		TenantID:  rt.TenantID,
+		SessionID: rt.FamilyID,
+	})
+}
+
+// アクセストークンを検証する。 tenantID 以外のテナントで発行されたトークンはエラーにする。
+func verifyAccessToken(ctx context.Context, keys *signingKeyCache, cfg oidcConfig, tenantID, token string) (*accessTokenClaims, error) {
+	issuer := cfg.tenantIssuer(tenantID)
+	claims := &accessTokenClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if typ, _ := t.Header["typ"].(string); typ != accessTokenType {
+			return nil, fmt.Errorf("unexpected token type: %v", t.Header["typ"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return keys.publicKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{oidcSigningAlgorithm}),
+		jwt.WithIssuer(issuer),
+		jwt.WithAudience(issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.TenantID != tenantID {
+		return nil, fmt.Errorf("access token was issued for another tenant: %s", claims.TenantID)
+	}
+
+	return claims, nil
+}
+
+// Authorization: Bearer ヘッダーのアクセストークンを検証し、コンテキストに保存する。
+//
+// 管理者APIやUserInfoエンドポイントのBearerトークンはJWTではないので、JWTの形をしていないトークンは無視する。
+// 検証に失敗した場合や、他のテナントで発行されたトークン、失効したトークンの場合もエラーにはせず、未ログインとして扱う。
+func accessTokenAuth(db *bun.DB, keys *signingKeyCache, cfg oidcConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			token, ok := strings.CutPrefix(ctx.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if !ok || strings.Count(token, ".") != 2 {
+				return next(ctx)
+			}
+			tenant, ok := tenantFromContext(ctx)
+			if !ok {
+				return next(ctx)
+			}
+
+			claims, err := verifyAccessToken(ctx.Request().Context(), keys, cfg, tenant.ID, token)
+			if err != nil {
+				ctx.Logger().Warnf("Invalid access token: %v\n", err)
+				return next(ctx)
+			}
+			if err := checkAccessTokenSession(ctx.Request().Context(), db, claims); err != nil {
+				if errors.Is(err, errAccessTokenRevoked) {
+					ctx.Logger().Warnf("Revoked access token: %v\n", err)
+					return next(ctx)
+				}
+				ctx.Logger().Errorf("Failed to check access token: %v\n", err)
+				return ctx.JSON(http.StatusInternalServerError, nil)
+			}
+			ctx.Set(accessTokenContextKey, claims)
+
+			return next(ctx)
+		}
+	}
+}
+
+var errAccessTokenRevoked = errors.New("access token is revoked")
+
+// アクセストークンのリフレッシュトークンのファミリーが失効しておらず、ユーザーがログインできる状態であることを確認する。
+// 確認できない場合は errAccessTokenRevoked を返す。
+func checkAccessTokenSession(ctx context.Context, db bun.IDB, claims *accessTokenClaims) error {
+	var user User
+	err := db.NewSelect().
+		Model(&user).
+		Where("id = ?", claims.Subject).
+		Where("tenant_id = ?", claims.TenantID).
+		Where("EXISTS (SELECT 1 FROM refresh_tokens AS rt WHERE rt.family_id::text = ? AND rt.revoked_at IS NULL)", claims.SessionID).
+		Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: token family %s of user %s", errAccessTokenRevoked, claims.SessionID, claims.Subject)
+		}
+		return err
+	}
+	if err := user.checkActive(time.Now()); err != nil {
+		return fmt.Errorf("%w: %w", errAccessTokenRevoked, err)
+	}
+
+	return nil
+}
+
+// リフレッシュトークン。DBにはトークンのハッシュのみ保存する。
+type RefreshToken struct {
+	bun.BaseModel `bun:"table:refresh_tokens,alias:rt"`
+
+	ID           string    `bun:"id,pk"`
+	TenantID     string    `bun:"tenant_id"`
+	FamilyID     string    `bun:"family_id"`
+	ParentID     string    `bun:"parent_id,nullzero"`
+	UserID       string    `bun:"user_id"`
+	TokenHash    string    `bun:"token_hash"`
+	UserVerified bool      `bun:"user_verified"`
+	AuthTime     time.Time `bun:"auth_time"`
+	ExpiresAt    time.Time `bun:"expires_at"`
+	UsedAt       time.Time `bun:"used_at,nullzero"`
+	RevokedAt    time.Time `bun:"revoked_at,nullzero"`
+	CreatedAt    time.Time `bun:"created_at"`
+}
+
+// リフレッシュトークンを発行する。 parent が nil の場合は、新しいファミリーを作成する。
+func insertRefreshToken(ctx context.Context, db bun.IDB, tenantID, userID string, authTime time.Time, userVerified bool, parent *RefreshToken) (*RefreshToken, string, error) {
+	token, err := random(32)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to generate refresh token: %w", err)
+	}
+
+	rt := &RefreshToken{
+		ID:           uuid.NewString(),
+		TenantID:     tenantID,
+		UserID:       userID,
+		TokenHash:    hashToken(token),
+		UserVerified: userVerified,
+		AuthTime:     authTime,
+		ExpiresAt:    time.Now().Add(refreshTokenDuration),
+	}
+	rt.FamilyID = rt.ID
+	if parent != nil {
+		rt.FamilyID = parent.FamilyID
+		rt.ParentID = parent.ID
+	}
+
+	_, err = db.NewInsert().
+		Model(rt).
+		Column("id", "tenant_id", "family_id", "parent_id", "user_id", "token_hash", "user_verified", "auth_time", "expires_at").
+		Exec(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return rt, token, nil
+}
+
+// リフレッシュトークンのファミリーを失効させ、失効させたトークンの数を返す。
+func revokeRefreshTokenFamily(ctx context.Context, db bun.IDB, familyID string) (int64, error) {
+	res, err := db.NewUpdate().
+		Model((*RefreshToken)(nil)).
+		Set("revoked_at = NOW()").
+		Where("family_id = ?", familyID).
+		Where("revoked_at IS NULL").
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// ユーザーのリフレッシュトークンのファミリーを失効させ、失効させたトークンの数を返す。
+// 他のユーザーのファミリーの場合は何もしない。
+func revokeUserRefreshTokenFamily(ctx context.Context, db bun.IDB, userID, familyID string) (int64, error) {
+	res, err := db.NewUpdate().
+		Model((*RefreshToken)(nil)).
+		Set("revoked_at = NOW()").
+		Where("user_id = ?", userID).
+		Where("family_id::text = ?", familyID).
+		Where("revoked_at IS NULL").
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// ユーザーのリフレッシュトークンをすべて失効させ、失効させたファミリーの数を返す。
+// keepFamilyID を指定した場合は、そのファミリーは失効させない。
+func revokeUserRefreshTokens(ctx context.Context, db bun.IDB, userID, keepFamilyID string) (int, error) {
+	query := db.NewUpdate().
+		Model((*RefreshToken)(nil)).
+		Set("revoked_at = NOW()").
+		Where("user_id = ?", userID).
+		Where("revoked_at IS NULL").
+		Returning("family_id")
+	if keepFamilyID != "" {
+		query = query.Where("family_id::text <> ?", keepFamilyID)
+	}
+
+	var familyIDs []string
+	if err := query.Scan(ctx, &familyIDs); err != nil {
+		return 0, err
+	}
+
+	slices.Sort(familyIDs)
+	return len(slices.Compact(familyIDs)), nil
+}
+
+// トークンモードのログイン。リフレッシュトークンのファミリーごとに、1つのログインとして扱う。
+type tokenSession struct {
+	FamilyID     string    `bun:"family_id"`
+	UserVerified bool      `bun:"user_verified"`
+	AuthTime     time.Time `bun:"auth_time"`
+	// 最後にリフレッシュした日時
+	LastRefreshedAt time.Time `bun:"last_refreshed_at"`
+}
+
+// ユーザーの有効なトークンモードのログインを、ログイン日時の新しい順に返す。
+func listUserTokenSessions(ctx context.Context, db bun.IDB, userID string) ([]tokenSession, error) {
+	sessions := []tokenSession{}
+	err := db.NewSelect().
+		Model((*RefreshToken)(nil)).
+		ColumnExpr("family_id").
+		ColumnExpr("bool_and(user_verified) AS user_verified").
+		ColumnExpr("MIN(auth_time) AS auth_time").
+		ColumnExpr("MAX(created_at) AS last_refreshed_at").
+		Where("user_id = ?", userID).
+		Where("revoked_at IS NULL").
+		Where("expires_at > NOW()").
+		Group("family_id").
+		OrderExpr("MIN(auth_time) DESC").
+		Scan(ctx, &sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// 有効期限を過ぎたリフレッシュトークンを削除する。
+func pruneRefreshTokens(ctx context.Context, db bun.IDB, before time.Time) (int64, error) {
+	res, err := db.NewDelete().
+		Model((*RefreshToken)(nil)).
+		Where("expires_at < ?", before).
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+var (
+	errRefreshTokenInvalid = errors.New("refresh token is invalid")
+	errRefreshTokenReused  = errors.New("refresh token is reused")
+)
+
+// リフレッシュトークンを使用済みにして、同じファミリーの新しいリフレッシュトークンを発行する。
+//
+// tenantID 以外のテナントで発行されたトークンは、存在しないトークンとして扱う。
+// 使用済みのトークンが再度使われた場合は、トークンが盗まれた可能性があるのでファミリーごと失効させて errRefreshTokenReused を返す。
+//
+// SEE: https://datatracker.ietf.org/doc/html/draft-ietf-oauth-security-topics#section-4.14.2
+func rotateRefreshToken(ctx context.Context, db bun.IDB, tenantID, token string) (*RefreshToken, string, error) {
+	var current RefreshToken
+	var newToken string
+	var reused bool
+	err := db.RunInTx(ctx, nil, func(c context.Context, tx bun.Tx) error {
+		err := tx.NewSelect().
+			Model(&current).
+			Where("token_hash = ?", hashToken(token)).
+			Where("tenant_id = ?", tenantID).
+			For("UPDATE").
+			Scan(c)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return errRefreshTokenInvalid
+			}
+			return err
+		}
+
+		if !current.RevokedAt.IsZero() || time.Now().After(current.ExpiresAt) {
+			return errRefreshTokenInvalid
+		}
+		if !current.UsedAt.IsZero() {
+			// 失効させた結果はコミットしたいので、エラーにはせずに終える
+			reused = true
+			_, err := revokeRefreshTokenFamily(c, tx, current.FamilyID)
+			return err
+		}
+
+		_, err = tx.NewUpdate().
+			Model(&current).
+			Set("used_at = NOW()").
+			WherePK().
+			Exec(c)
+		if err != nil {
+			return err
+		}
+
+		_, newToken, err = insertRefreshToken(c, tx, current.TenantID, current.UserID, current.AuthTime, current.UserVerified, &current)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if reused {
+		return &current, "", errRefreshTokenReused
+	}
+
+	return &current, newToken, nil
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func newTokenResponse(accessToken, refreshToken string) *tokenResponse {
+	return &tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenDuration.Seconds()),
+		RefreshToken: refreshToken,
+	}
+}
+
+// ログインに成功したユーザーに、新しいファミリーのトークンを発行する。
+func issueLoginTokens(ctx context.Context, db bun.IDB, cfg oidcConfig, tenantID, userID string, userVerified bool) (*tokenResponse, error) {
+	// アクセストークンにファミリーのIDを含めるので、リフレッシュトークンを先に発行する
+	rt, refreshToken, err := insertRefreshToken(ctx, db, tenantID, userID, time.Now(), userVerified, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to issue refresh token: %w", err)
+	}
+
+	accessToken, err := issueAccessToken(ctx, db, cfg, rt)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to issue access token: %w", err)
+	}
+
+	return newTokenResponse(accessToken, refreshToken), nil
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" form:"refresh_token"`
+}
+
+// リフレッシュトークンを使って、新しいアクセストークンとリフレッシュトークンを発行する。
+func refreshTokens(db *bun.DB, cfg oidcConfig) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		ctx.Response().Header().Set("Cache-Control", "no-store")
+
+		var req refreshTokenRequest
+		if err := ctx.Bind(&req); err != nil || req.RefreshToken == "" {
+			return ctx.JSON(http.StatusBadRequest, oauthErrorResponse{Error: "invalid_request", ErrorDescription: "refresh_token is required"})
+		}
+
+		current, refreshToken, err := rotateRefreshToken(ctx.Request().Context(), db, currentTenant(ctx).ID, req.RefreshToken)
+		if err != nil {
+			if errors.Is(err, errRefreshTokenReused) {
+				ctx.Logger().Warnf("Refresh token is reused, revoked token family %s\n", current.FamilyID)
+				recordAuthEvent(ctx, db, &AuthEvent{UserID: current.UserID, EventType: authEventTokenReuse, Result: authEventFailure, Reason: "refresh token is reused"})
+				return ctx.JSON(http.StatusBadRequest, oauthErrorResponse{Error: "invalid_grant", ErrorDescription: "refresh token is reused"})
+			}
+			if errors.Is(err, errRefreshTokenInvalid) {
+				return ctx.JSON(http.StatusBadRequest, oauthErrorResponse{Error: "invalid_grant", ErrorDescription: "refresh token is invalid or expired"})
+			}
+			ctx.Logger().Errorf("Failed to rotate refresh token: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, oauthErrorResponse{Error: "server_error"})
+		}
+
+		// リフレッシュの間にアカウントが無効化されているかもしれない
+		user, err := findUserByID(ctx.Request().Context(), db, current.UserID)
+		if err != nil || user.checkActive(time.Now()) != nil {
+			if _, err := revokeRefreshTokenFamily(ctx.Request().Context(), db, current.FamilyID); err != nil {
+				ctx.Logger().Errorf("Failed to revoke refresh tokens: %v\n", err)
+			}
+			return ctx.JSON(http.StatusBadRequest, oauthErrorResponse{Error: "invalid_grant", ErrorDescription: "account is not active"})
+		}
+
+		accessToken, err := issueAccessToken(ctx.Request().Context(), db, cfg, current)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to issue access token: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, oauthErrorResponse{Error: "server_error"})
+		}
+
+		return ctx.JSON(http.StatusOK, newTokenResponse(accessToken, refreshToken))
+	}
+}
+
+type revokeTokenRequest struct {
+	Token string `json:"token" form:"token"`
+}
+
+// リフレッシュトークンを失効させる。同じファミリーのトークンもすべて失効させる。
+//
+// 存在しないトークンや失効済みのトークン、他のテナントで発行されたトークンでも成功を返す。
+//
+// SEE: https://www.rfc-editor.org/rfc/rfc7009#section-2.2
+func revokeToken(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var req revokeTokenRequest
+		if err := ctx.Bind(&req); err != nil || req.Token == "" {
+			return ctx.JSON(http.StatusBadRequest, oauthErrorResponse{Error: "invalid_request", ErrorDescription: "token is required"})
+		}
+
+		var rt RefreshToken
+		err := db.NewSelect().
+			Model(&rt).
+			Where("token_hash = ?", hashToken(req.Token)).
+			Where("tenant_id = ?", currentTenant(ctx).ID).
+			Scan(ctx.Request().Context())
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ctx.NoContent(http.StatusOK)
+			}
+			ctx.Logger().Errorf("Failed to select refresh token: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, oauthErrorResponse{Error: "server_error"})
+		}
+
+		if _, err := revokeRefreshTokenFamily(ctx.Request().Context(), db, rt.FamilyID); err != nil {
+			ctx.Logger().Errorf("Failed to revoke refresh tokens: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, oauthErrorResponse{Error: "server_error"})
+		}
+
+		return ctx.NoContent(http.StatusOK)
+	}
+}
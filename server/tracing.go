@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"github.com/uptrace/bun"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenTelemetryによる分散トレーシング。
+//
+// HTTPリクエスト(Echo)、DBのクエリ(bun)、セッションストアのコマンド(go-redis)、go-webauthn の検証(passkey パッケージ)をスパンとして記録する。
+// エクスポーターは OTEL_TRACES_EXPORTER で選ぶ。
+//
+//   - otlp: OTLP/HTTPで送信する。送信先は OTEL_EXPORTER_OTLP_ENDPOINT などの標準の環境変数で指定する
+//   - stdout: 標準出力に出力する(ローカルでの確認用)
+//   - none: 記録しない(デフォルト)
+
+const (
+	tracerName = "github.com/daikideal/go-passkey-demo"
+	// エラーの問い合わせの際に、トレースを特定できるようにするためのヘッダー
+	traceIDHeader = "X-Trace-Id"
+)
+
+var tracer = otel.Tracer(tracerName)
+
+// トレーサーを初期化し、終了時に残りのスパンを送信するための関数を返す。
+func initTracer(ctx context.Context, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch v := getEnv("OTEL_TRACES_EXPORTER", "none"); v {
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout", "console":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER: %s", v)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// HTTPリクエストのスパンを開始する。ヘルスチェックやメトリクスの取得はトレースしない。
+func httpTracing(serviceName string) echo.MiddlewareFunc {
+	return otelecho.Middleware(serviceName, otelecho.WithSkipper(func(ctx echo.Context) bool {
+		return isProbePath(ctx.Request().URL.Path)
+	}))
+}
+
+// トレースIDを、エラーレスポンスのヘッダーに含める。 httpTracing の後に実行する。
+// ログへのトレースIDの追加は requestLogging で行う。
+func traceIDPropagation() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			sc := trace.SpanContextFromContext(ctx.Request().Context())
+			if !sc.HasTraceID() {
+				return next(ctx)
+			}
+			traceID := sc.TraceID().String()
+
+			ctx.Response().Before(func() {
+				if ctx.Response().Status >= http.StatusBadRequest {
+					ctx.Response().Header().Set(traceIDHeader, traceID)
+				}
+			})
+
+			return next(ctx)
+		}
+	}
+}
+
+// セッションストアのコマンドをスパンとして記録する。
+// コマンドの引数にはセッションの内容が含まれるので、記録しない。
+func instrumentSessionStore(client *redis.Client) error {
+	return redisotel.InstrumentTracing(client, redisotel.WithDBStatement(false))
+}
+
+// DBのクエリをスパンとして記録する。
+//
+// bun のSQL(event.Query)は値を埋め込んだ後のものなので、秘密鍵やトークンのハッシュ、ユーザー名などが含まれる。
+// トレースの送信先に値を送らないように、SQLは記録せずに操作の種類とテーブル名だけを記録する。
+type dbTracingHook struct{}
+
+var _ bun.QueryHook = dbTracingHook{}
+
+type dbSpanKey struct{}
+
+func (dbTracingHook) BeforeQuery(ctx context.Context, event *bun.QueryEvent) context.Context {
+	ctx, span := tracer.Start(ctx, "db."+event.Operation(), trace.WithSpanKind(trace.SpanKindClient))
+	if event.Stash == nil {
+		event.Stash = make(map[interface{}]interface{})
+	}
+	event.Stash[dbSpanKey{}] = span
+	return ctx
+}
+
+func (dbTracingHook) AfterQuery(ctx context.Context, event *bun.QueryEvent) {
+	span, ok := event.Stash[dbSpanKey{}].(trace.Span)
+	if !ok {
+		return
+	}
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation", event.Operation()),
+	)
+	// 生のSQL(NewRaw)の場合は、テーブル名がわからない
+	if event.IQuery != nil {
+		if table := event.IQuery.GetTableName(); table != "" {
+			span.SetAttributes(attribute.String("db.sql.table", table))
+		}
+	}
+	if event.Err != nil {
+		span.RecordError(event.Err)
+		span.SetStatus(codes.Error, event.Err.Error())
+	}
+}
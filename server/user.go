@@ -3,19 +3,15 @@ package main
 import (
 	"bytes"
 	"context"
-	"database/sql"
-	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
 	"net/http"
 	"time"
 
-	"github.com/daikideal/go-passkey-demo/db"
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
-	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/uptrace/bun"
 )
 
 // この構造体を User に紐づけて保存するための構造体
@@ -27,19 +23,65 @@ import (
 type WebauthnCredentials struct {
 	ID              string                            `json:"id" bun:"id,pk"`
 	UserID          string                            `json:"user_id" bun:"user_id"`
+	TenantID        string                            `json:"tenant_id" bun:"tenant_id"`
 	CredentialID    []byte                            `json:"credential_id" bun:"credential_id"`
 	PublicKey       []byte                            `json:"public_key" bun:"public_key"`
 	AttestationType string                            `json:"attestation_type" bun:"attestation_type"`
 	Transport       []protocol.AuthenticatorTransport `json:"transport" bun:"transport,array"`
 	Flags           webauthn.CredentialFlags          `json:"flags" bun:"flags"`
 	Authenticator   webauthn.Authenticator            `json:"authenticator" bun:"authenticator"`
-	CreatedAt       time.Time                         `json:"created_at" bun:"created_at"`
-	UpdatedAt       time.Time                         `json:"updated_at" bun:"updated_at"`
+	// 紛失の疑いがある場合などに、削除せずに一時的に使えなくするための項目
+	DisabledAt    time.Time `json:"disabled_at" bun:"disabled_at,nullzero"`
+	DisabledBy    string    `json:"disabled_by" bun:"disabled_by,nullzero"`
+	RevokedReason string    `json:"revoked_reason" bun:"revoked_reason,nullzero"`
+	CreatedAt     time.Time `json:"created_at" bun:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at" bun:"updated_at"`
 }
 
+// 認証器の状態
+const (
+	credentialStatusActive   = "active"
+	credentialStatusDisabled = "disabled"
+)
+
+// 認証器を無効化したのが誰か。管理者が無効化した認証器は、ユーザー本人は有効化できない。
+const (
+	credentialDisabledByUser  = "user"
+	credentialDisabledByAdmin = "admin"
+)
+
+func (cred *WebauthnCredentials) Status() string {
+	if cred.DisabledAt.IsZero() {
+		return credentialStatusActive
+	}
+	return credentialStatusDisabled
+}
+
+// ユーザーの状態
+//
+// - active: 通常の状態
+// - locked: ログインの失敗が続いたため、 LockedUntil まで一時的にロックされている
+// - disabled: 管理者によって無効化されている
+// - pending_deletion: 削除予定
+const (
+	userStatusActive          = "active"
+	userStatusLocked          = "locked"
+	userStatusDisabled        = "disabled"
+	userStatusPendingDeletion = "pending_deletion"
+)
+
 type User struct {
-	ID                  string                `json:"id" bun:"id,pk"`
-	Name                string                `json:"name" bun:"name"`
+	ID                string    `json:"id" bun:"id,pk"`
+	TenantID          string    `json:"tenant_id" bun:"tenant_id"`
+	Name              string    `json:"name" bun:"name"`
+	Status            string    `json:"status" bun:"status"`
+	StatusReason      string    `json:"status_reason" bun:"status_reason,nullzero"`
+	StatusChangedAt   time.Time `json:"status_changed_at" bun:"status_changed_at,nullzero"`
+	LockedUntil       time.Time `json:"locked_until" bun:"locked_until,nullzero"`
+	FailedLoginCount  int       `json:"failed_login_count" bun:"failed_login_count"`
+	LastFailedLoginAt time.Time `json:"last_failed_login_at" bun:"last_failed_login_at,nullzero"`
+	// 認証器の登録を最初に完了した日時。登録を完了していないユーザーはゼロ値
+	RegisteredAt        time.Time             `json:"registered_at" bun:"registered_at,nullzero"`
 	WebauthnCredentials []WebauthnCredentials `json:"webauthn_credentials" bun:"rel:has-many,join:id=user_id"`
 	CreatedAt           time.Time             `json:"created_at" bun:"created_at"`
 	UpdatedAt           time.Time             `json:"updated_at" bun:"updated_at"`
@@ -62,18 +104,23 @@ func (user *User) WebAuthnDisplayName() string {
 	return user.Name
 }
 
+// ログインに使用できる認証器の一覧。無効化されている認証器は含めない。
 func (user *User) WebAuthnCredentials() []webauthn.Credential {
-	res := make([]webauthn.Credential, len(user.WebauthnCredentials))
+	res := make([]webauthn.Credential, 0, len(user.WebauthnCredentials))
 
-	for i, v := range user.WebauthnCredentials {
-		res[i] = webauthn.Credential{
+	for _, v := range user.WebauthnCredentials {
+		if !v.DisabledAt.IsZero() {
+			continue
+		}
+
+		res = append(res, webauthn.Credential{
 			ID:              v.CredentialID,
 			PublicKey:       v.PublicKey,
 			AttestationType: v.AttestationType,
 			Transport:       v.Transport,
 			Flags:           v.Flags,
 			Authenticator:   v.Authenticator,
-		}
+		})
 	}
 
 	return res
@@ -81,6 +128,8 @@ func (user *User) WebAuthnCredentials() []webauthn.Credential {
 
 // このユーザーがすでに登録している認証器の情報を生成するためのメソッド。
 // webauthn.BeginRegistration に、同じ認証器が複数登録されるのを防ぐオプションを設定するために使用する。
+//
+// 無効化している認証器も、再度有効化できるので除外リストに含める。
 func (user *User) CredentialExcludeList() []protocol.CredentialDescriptor {
 
 	credentialExcludeList := []protocol.CredentialDescriptor{}
@@ -95,49 +144,52 @@ func (user *User) CredentialExcludeList() []protocol.CredentialDescriptor {
 	return credentialExcludeList
 }
 
+// 認証に使用された認証器を、クレデンシャルIDから特定する。
+func (user *User) findCredential(credentialID []byte) *WebauthnCredentials {
+	for i := range user.WebauthnCredentials {
+		if bytes.Equal(user.WebauthnCredentials[i].CredentialID, credentialID) {
+			return &user.WebauthnCredentials[i]
+		}
+	}
+
+	return nil
+}
+
 // 非推奨らしいので空文字を返す
 func (user *User) WebAuthnIcon() string {
 	return ""
 }
 
-func getUsers() echo.HandlerFunc {
-	db := db.GetDB()
-
-	return func(ctx echo.Context) error {
-		ctx.Logger().Info("GET /user")
-
-		var res []*User
-		if err := db.NewSelect().
-			Model(&res).
-			Relation("WebauthnCredentials").
-			Column("*").
-			Scan(ctx.Request().Context()); err != nil {
-			ctx.Logger().Errorf("Failed to select user: %v\n", err)
-		}
+// passkey.User の実装
+func (user *User) UserID() string {
+	return user.ID
+}
 
-		return ctx.JSON(200, res)
-	}
+func (user *User) CheckActive() error {
+	return user.checkActive(time.Now())
 }
 
-func getUser() echo.HandlerFunc {
+func getUser(db *bun.DB) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		ctx.Logger().Info("GET /user/:id")
 
 		userID := ctx.Param("id")
 
-		user, err := findUserByID(ctx.Request().Context(), userID)
+		user, err := findUserByID(ctx.Request().Context(), db, userID)
 		if err != nil {
 			ctx.Logger().Errorf("Failed to find user: %v\n", err)
 			return ctx.JSON(404, nil)
 		}
+		// 他のテナントのユーザーは存在しないものとして扱う
+		if user.TenantID != currentTenant(ctx).ID {
+			return ctx.JSON(404, nil)
+		}
 
-		return ctx.JSON(http.StatusOK, user)
+		return ctx.JSON(http.StatusOK, newUserResponse(user, resolveVisibility(ctx, user.ID)))
 	}
 }
 
-func createUser() echo.HandlerFunc {
-	db := db.GetDB()
-
+func createUser(db *bun.DB, sessions *sessionStore) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		ctx.Logger().Info("POST /user")
 
@@ -147,10 +199,11 @@ func createUser() echo.HandlerFunc {
 			ctx.Logger().Errorf("Failed to insert user: %v\n", err)
 			return ctx.JSON(400, err)
 		}
+		user.TenantID = currentTenant(ctx).ID
 
 		res, err := db.NewInsert().
 			Model(&user).
-			Column("name", "email", "password").
+			Column("tenant_id", "name", "email", "password").
 			Returning("*").
 			Exec(ctx.Request().Context())
 		if err != nil {
@@ -164,9 +217,7 @@ func createUser() echo.HandlerFunc {
 	}
 }
 
-func findUserByID(ctx context.Context, id string) (*User, error) {
-	db := db.GetDB()
-
+func findUserByID(ctx context.Context, db bun.IDB, id string) (*User, error) {
 	var user User
 	err := db.NewSelect().
 		Model(&user).
@@ -181,15 +232,14 @@ func findUserByID(ctx context.Context, id string) (*User, error) {
 	return &user, nil
 }
 
-func findUserByName(ctx context.Context, name string) (*User, error) {
-	db := db.GetDB()
-
+// テナント内で、名前からユーザーを特定する。
+func findUserByName(ctx context.Context, db bun.IDB, tenantID, name string) (*User, error) {
 	var user User
 	err := db.NewSelect().
 		Model(&user).
 		Relation("WebauthnCredentials").
 		Column("*").
-		Where("name = ?", name).
+		Where("tenant_id = ? AND name = ?", tenantID, name).
 		Scan(ctx)
 	if err != nil {
 		return nil, err
@@ -198,215 +248,145 @@ func findUserByName(ctx context.Context, name string) (*User, error) {
 	return &user, nil
 }
 
-func createNewUser(ctx context.Context, name string) (*User, error) {
-	db := db.GetDB()
-
-	user := &User{
-		Name: name,
-	}
+// ユーザーを保存する。同じテナントに同じ名前のユーザーがすでに存在する場合は errUserNameTaken を返す。
+func insertUser(ctx context.Context, db bun.IDB, user *User) error {
 	_, err := db.NewInsert().
 		Model(user).
-		Column("name").
+		Column("id", "tenant_id", "name", "registered_at").
 		Returning("*").
-		Exec(ctx, user)
+		Exec(ctx)
 	if err != nil {
-		return nil, err
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return errUserNameTaken
+		}
+		return err
 	}
 
-	return user, nil
-}
-
-type beginRegistrationReqest struct {
-	Username string `json:"username"`
+	return nil
 }
 
-func beginRegistration(w *webauthn.WebAuthn) echo.HandlerFunc {
-	return func(ctx echo.Context) error {
-		var req beginRegistrationReqest
-		if err := ctx.Bind(&req); err != nil {
-			ctx.Logger().Errorf("Failed to process request: %v\n", err)
-			return ctx.JSON(400, nil)
-		}
-
-		// 認証機を登録するユーザーを特定。存在しない場合は新規作成する。
-		user, err := findUserByName(context.Background(), req.Username)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				user, err = createNewUser(context.Background(), req.Username)
-				if err != nil {
-					ctx.Logger().Errorf("Failed to create user: %v\n", err)
-					return ctx.JSON(500, nil)
-				}
-			} else {
-				ctx.Logger().Errorf("Failed to find user: %v\n", err)
-				return ctx.JSON(400, nil)
-			}
-		}
-
-		options, session, err := w.BeginRegistration(
-			user,
-			// パスキー認証が試したいので、 Resident Key しかサポートしなくする。
-			webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
-			webauthn.WithExclusions(user.CredentialExcludeList()),
-		)
+// 認証器を削除し、削除した認証器を返す。対象の認証器が見つからない場合は nil を返す。
+// 削除と同じトランザクションで、Webhookの送信キューに追加する。
+func removePublicKey(ctx context.Context, db *bun.DB, userID, publicKeyID, reason string) (*WebauthnCredentials, error) {
+	var deleted []WebauthnCredentials
+	err := db.RunInTx(ctx, nil, func(c context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().
+			Model(&deleted).
+			Where("user_id = ? AND id = ?", userID, publicKeyID).
+			Returning("*").
+			Exec(c)
 		if err != nil {
-			ctx.Logger().Errorf("Failed to begin registration: %v\n", err)
-			return ctx.JSON(500, nil)
+			return err
 		}
 
-		// 認証機登録セッションを開始
-		// cookieを使用してはいけない場合、レスポンスで返してやるのがよいか。
-		sessionId, err := CreateSession(ctx.Request().Context(), session)
-		if err != nil {
-			ctx.Logger().Errorf("Failed to start session: %v\n", err)
-			return ctx.JSON(500, nil)
+		for i := range deleted {
+			if err := enqueueWebhookEvent(c, tx, webhookEventPasskeyRemoved, newWebhookPasskeyData(&deleted[i], reason)); err != nil {
+				return err
+			}
 		}
-		ctx.SetCookie(&http.Cookie{
-			Name:     "registration",
-			Value:    sessionId,
-			Path:     "/",
-			HttpOnly: true,
-		})
-
-		return ctx.JSON(200, options)
+		return nil
+	})
+	if err != nil || len(deleted) == 0 {
+		return nil, err
 	}
-}
 
-type finishRegistrationReqest struct {
-	protocol.CredentialCreationResponse
+	return &deleted[0], nil
 }
 
-func finishRegistration(w *webauthn.WebAuthn) echo.HandlerFunc {
-	return func(ctx echo.Context) error {
-		body, err := io.ReadAll(ctx.Request().Body)
-		if err != nil {
-			ctx.Logger().Errorf("Failed to read request: %v\n", err)
-			return ctx.JSON(500, nil)
-		}
-
-		fmt.Printf("Request body: %s\n", body)
-
-		req := &finishRegistrationReqest{}
-		err = json.Unmarshal(body, req)
-		if err != nil {
-			ctx.Logger().Errorf("Failed to parse request: %v\n", err)
-			return ctx.JSON(400, nil)
-		}
-
-		// リクエストボディを元に戻す。そうしないと、FinishRegistration に ctx.Request() を渡した後、
-		// ParseCredentialCreationResponseBody でエラーになる。
-		// ref. https://syossan.hateblo.jp/entry/2019/01/11/175932
-		ctx.Request().Body = io.NopCloser(bytes.NewBuffer(body))
-
-		// 認証機登録セッションを特定
-		cookie, err := ctx.Cookie("registration")
-		if err != nil {
-			ctx.Logger().Errorf("Cookie is not set: %v\n", err)
-			return ctx.JSON(400, nil)
-		}
-
-		session, err := GetSession(ctx.Request().Context(), cookie.Value)
-		if err != nil {
-			ctx.Logger().Errorf("Session is not found: %v\n", err)
-			return ctx.JSON(400, nil)
+// 認証器を無効化、または有効化し、更新後の認証器を返す。 by は操作したのが誰か(credentialDisabledByUser など)。
+// 対象の認証器が見つからない場合は nil を返す。
+// ユーザー本人は、管理者が無効化した認証器を有効化できない。その場合は errCredentialLocked を返す。
+func setPublicKeyDisabled(ctx context.Context, db bun.IDB, userID, publicKeyID string, disabled bool, reason, by string) (*WebauthnCredentials, error) {
+	var updated []WebauthnCredentials
+	query := db.NewUpdate().
+		Model(&updated).
+		Set("updated_at = NOW()").
+		Where("user_id = ? AND id = ?", userID, publicKeyID).
+		Returning("*")
+	if disabled {
+		query = query.
+			// 無効化済みの場合は、最初に無効化した日時を残す
+			Set("disabled_at = COALESCE(disabled_at, NOW())").
+			// ユーザーが無効化した認証器を管理者が無効化した場合は、管理者の無効化にする
+			Set("disabled_by = CASE WHEN disabled_by = ? THEN disabled_by ELSE ? END", credentialDisabledByAdmin, by).
+			Set("revoked_reason = NULLIF(?, '')", reason)
+	} else {
+		query = query.
+			Set("disabled_at = NULL").
+			Set("disabled_by = NULL").
+			Set("revoked_reason = NULL")
+		if by != credentialDisabledByAdmin {
+			query = query.Where("disabled_by IS DISTINCT FROM ?", credentialDisabledByAdmin)
 		}
+	}
 
-		// セッションからユーザーを特定
-		user, err := findUserByID(ctx.Request().Context(), string(session.UserID))
-		if err != nil {
-			ctx.Logger().Errorf("User is not found: %v\n", err)
-			return ctx.JSON(404, nil)
+	if _, err := query.Exec(ctx); err != nil {
+		return nil, err
+	}
+	if len(updated) == 0 {
+		if disabled || by == credentialDisabledByAdmin {
+			return nil, nil
 		}
 
-		res := ctx.Request()
-		credential, err := w.FinishRegistration(user, *session, res)
+		// 見つからなかったのか、管理者が無効化しているのかを区別する
+		exists, err := db.NewSelect().
+			Model((*WebauthnCredentials)(nil)).
+			Where("user_id = ? AND id = ?", userID, publicKeyID).
+			Exists(ctx)
 		if err != nil {
-			ctx.Logger().Errorf("Failed to finish registration: %v\n", err)
-			return ctx.JSON(500, nil)
+			return nil, err
 		}
-
-		newWebautnCredential := &WebauthnCredentials{
-			UserID:          user.ID,
-			CredentialID:    credential.ID,
-			PublicKey:       credential.PublicKey,
-			AttestationType: credential.AttestationType,
-			Transport:       credential.Transport,
-			Flags:           credential.Flags,
-			Authenticator:   credential.Authenticator,
-		}
-
-		db := db.GetDB()
-		_, err = db.NewInsert().
-			Model(newWebautnCredential).
-			Column("user_id", "credential_id", "public_key", "attestation_type", "transport", "flags", "authenticator").
-			Exec(ctx.Request().Context())
-		if err != nil {
-			ctx.Logger().Errorf("Failed to insert webauthn credential: %v\n", err)
-			return ctx.JSON(500, nil)
+		if exists {
+			return nil, errCredentialLocked
 		}
-
-		return ctx.JSON(201, "Registration success!")
+		return nil, nil
 	}
-}
 
-type listPublicKeysByUserResponse struct {
-	ID        string    `json:"id"`
-	AAGUID    string    `json:"AAGUID"`
-	CreatedAt time.Time `json:"created_at"`
+	return &updated[0], nil
 }
 
-func listPublicKeysByUser() echo.HandlerFunc {
-	db := db.GetDB()
-
-	return func(ctx echo.Context) error {
-		userID := ctx.Param("id")
-
-		var credentials []*WebauthnCredentials
-		if err := db.NewSelect().
-			Model(&credentials).
-			Column("*").
-			Where("user_id = ?", userID).
-			Scan(ctx.Request().Context()); err != nil {
-			ctx.Logger().Errorf("Failed to select webauthn credentials: %v\n", err)
-			return ctx.JSON(500, nil)
-		}
-
-		res := make([]listPublicKeysByUserResponse, len(credentials))
-		for i, v := range credentials {
-			// 参考: https://github.com/go-webauthn/webauthn/blob/debcfe78a7c30c1d9115c889115fe583042c81a4/webauthn/login.go#L346
-			aaguid, err := uuid.FromBytes(v.Authenticator.AAGUID)
-			if err != nil {
-				ctx.Logger().Errorf("AAGUID is wrong: %w\n", err)
-				continue
-			}
+// 認証器の無効化・有効化を行う。
+// 更新と同じトランザクションで、Webhookの送信キューに追加する。
+func changePublicKeyDisabled(ctx context.Context, db bun.IDB, userID, publicKeyID string, disabled bool, reason, by string) (*WebauthnCredentials, error) {
+	webhookEventType := webhookEventPasskeyEnabled
+	if disabled {
+		webhookEventType = webhookEventPasskeyDisabled
+	}
 
-			res[i] = listPublicKeysByUserResponse{
-				ID:        v.ID,
-				AAGUID:    aaguid.String(),
-				CreatedAt: v.CreatedAt,
-			}
+	var cred *WebauthnCredentials
+	err := db.RunInTx(ctx, nil, func(c context.Context, tx bun.Tx) error {
+		var err error
+		cred, err = setPublicKeyDisabled(c, tx, userID, publicKeyID, disabled, reason, by)
+		if err != nil || cred == nil {
+			return err
 		}
 
-		return ctx.JSON(http.StatusOK, res)
+		return enqueueWebhookEvent(c, tx, webhookEventType, newWebhookPasskeyData(cred, reason))
+	})
+	if err != nil {
+		return nil, err
 	}
-}
 
-func deletePublicKey() echo.HandlerFunc {
-	db := db.GetDB()
-
-	return func(ctx echo.Context) error {
-		userID := ctx.Param("user_id")
-		publicKeyID := ctx.Param("public_key_id")
+	return cred, nil
+}
 
-		_, err := db.NewDelete().
-			Model(&WebauthnCredentials{}).
-			Where("user_id = ? AND id = ?", userID, publicKeyID).
-			Exec(ctx.Request().Context())
-		if err != nil {
-			ctx.Logger().Errorf("Failed to delete webauthn credential: %v\n", err)
-			return ctx.JSON(http.StatusInternalServerError, nil)
-		}
+// 認証器の無効化・有効化を行い、監査ログに記録する。
+// 管理者から使用する。ユーザー本人の操作は passkey パッケージのハンドラーで行う。
+func updatePublicKeyDisabled(ctx echo.Context, db bun.IDB, userID, publicKeyID string, disabled bool, reason string) (*WebauthnCredentials, error) {
+	eventType := authEventCredentialEnable
+	if disabled {
+		eventType = authEventCredentialDisable
+	}
 
-		return ctx.JSON(http.StatusNoContent, nil)
+	cred, err := changePublicKeyDisabled(ctx.Request().Context(), db, userID, publicKeyID, disabled, reason, credentialDisabledByAdmin)
+	if err != nil {
+		recordAuthEvent(ctx, db, &AuthEvent{UserID: userID, CredentialID: publicKeyID, EventType: eventType, Result: authEventFailure, Reason: "failed to update credential"})
+		return nil, err
+	}
+	if cred != nil {
+		recordAuthEvent(ctx, db, (&AuthEvent{UserID: userID, EventType: eventType, Result: authEventSuccess, Reason: reason}).withCredential(cred))
 	}
+
+	return cred, nil
 }
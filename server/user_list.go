@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+)
+
+const (
+	defaultUserListLimit = 20
+	maxUserListLimit     = 100
+)
+
+// ユーザー一覧の構造体。管理者APIのユーザー検索で返す。
+// 一覧では公開鍵などの認証器の情報は不要なので、登録数だけを返す。
+type userListItem struct {
+	bun.BaseModel `bun:"table:users,alias:u"`
+
+	ID              string    `json:"id" bun:"id"`
+	TenantID        string    `json:"tenant_id" bun:"tenant_id"`
+	Name            string    `json:"name" bun:"name"`
+	Status          string    `json:"status" bun:"status"`
+	CredentialCount int       `json:"credential_count" bun:"credential_count"`
+	CreatedAt       time.Time `json:"created_at" bun:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at" bun:"updated_at"`
+}
+
+type listUsersResponse struct {
+	Users      []userListItem `json:"users"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+	Total      *int           `json:"total,omitempty"`
+}
+
+// GET /users で返す一覧用の構造体。
+// 誰でも取得できるので、アカウントの状態やテナントなど管理者向けの情報は含めない。
+type publicUserListItem struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type publicListUsersResponse struct {
+	Users      []publicUserListItem `json:"users"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+	Total      *int                 `json:"total,omitempty"`
+}
+
+func newPublicListUsersResponse(res *listUsersResponse) publicListUsersResponse {
+	users := make([]publicUserListItem, len(res.Users))
+	for i, u := range res.Users {
+		users[i] = publicUserListItem{ID: u.ID, Name: u.Name, CreatedAt: u.CreatedAt}
+	}
+
+	return publicListUsersResponse{Users: users, NextCursor: res.NextCursor, Total: res.Total}
+}
+
+// 並び替えに使用できるカラム。
+// カーソルは (カラムの値, id) の組で表現するので、id を第二キーにして順序を一意にする。
+type userListSort struct {
+	Column string
+	Desc   bool
+}
+
+func (s userListSort) String() string {
+	if s.Desc {
+		return "-" + s.Column
+	}
+	return s.Column
+}
+
+func parseUserListSort(v string) (userListSort, error) {
+	if v == "" {
+		return userListSort{Column: "created_at", Desc: true}, nil
+	}
+
+	sort := userListSort{Column: strings.TrimPrefix(v, "-"), Desc: strings.HasPrefix(v, "-")}
+	switch sort.Column {
+	case "created_at", "name":
+		return sort, nil
+	default:
+		return userListSort{}, fmt.Errorf("unsupported sort: %s", v)
+	}
+}
+
+// 次のページを取得するためのカーソル。
+// クライアントには中身を意識させたくないので、JSONをbase64エンコードした文字列として返す。
+type userListCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+func encodeUserListCursor(sort userListSort, item userListItem) string {
+	cursor := userListCursor{Sort: sort.String(), ID: item.ID}
+	switch sort.Column {
+	case "created_at":
+		cursor.Value = item.CreatedAt.Format(time.RFC3339Nano)
+	case "name":
+		cursor.Value = item.Name
+	}
+
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeUserListCursor(v string, sort userListSort) (*userListCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	var cursor userListCursor
+	if err := json.Unmarshal(b, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	// 並び順が変わるとカーソルの意味も変わってしまうので、一致しない場合はエラーにする
+	if cursor.Sort != sort.String() {
+		return nil, errors.New("cursor does not match sort")
+	}
+	if sort.Column == "created_at" {
+		if _, err := time.Parse(time.RFC3339Nano, cursor.Value); err != nil {
+			return nil, fmt.Errorf("invalid cursor: %w", err)
+		}
+	}
+
+	return &cursor, nil
+}
+
+// GET /users のクエリパラメータ。
+type userListQuery struct {
+	// 空の場合はすべてのテナントのユーザーを対象にする(管理者APIのみ)
+	TenantID       string
+	Limit          int
+	Cursor         *userListCursor
+	Sort           userListSort
+	NamePrefix     string
+	CreatedAfter   *time.Time
+	CreatedBefore  *time.Time
+	HasCredentials *bool
+	IncludeTotal   bool
+
+	// 以下は管理者APIでのみ使用する
+	Search string
+	Status string
+}
+
+func parseUserListQuery(ctx echo.Context) (*userListQuery, error) {
+	q := &userListQuery{Limit: defaultUserListLimit}
+
+	if v := ctx.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxUserListLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxUserListLimit)
+		}
+		q.Limit = limit
+	}
+
+	sort, err := parseUserListSort(ctx.QueryParam("sort"))
+	if err != nil {
+		return nil, err
+	}
+	q.Sort = sort
+
+	if v := ctx.QueryParam("cursor"); v != "" {
+		cursor, err := decodeUserListCursor(v, q.Sort)
+		if err != nil {
+			return nil, err
+		}
+		q.Cursor = cursor
+	}
+
+	q.NamePrefix = ctx.QueryParam("name_prefix")
+
+	for param, dest := range map[string]**time.Time{
+		"created_after":  &q.CreatedAfter,
+		"created_before": &q.CreatedBefore,
+	} {
+		v := ctx.QueryParam(param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be RFC3339: %w", param, err)
+		}
+		*dest = &t
+	}
+
+	if v := ctx.QueryParam("has_credentials"); v != "" {
+		hasCredentials, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("has_credentials must be boolean: %w", err)
+		}
+		q.HasCredentials = &hasCredentials
+	}
+
+	if v := ctx.QueryParam("include_total"); v != "" {
+		includeTotal, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("include_total must be boolean: %w", err)
+		}
+		q.IncludeTotal = includeTotal
+	}
+
+	return q, nil
+}
+
+// 絞り込み条件をクエリに適用する。件数の取得にも使うので、カーソルや並び順はここでは扱わない。
+func (q *userListQuery) applyFilters(query *bun.SelectQuery) *bun.SelectQuery {
+	if q.TenantID != "" {
+		query = query.Where("u.tenant_id = ?", q.TenantID)
+	}
+	if q.NamePrefix != "" {
+		query = query.Where("u.name LIKE ? ESCAPE '\\'", escapeLike(q.NamePrefix)+"%")
+	}
+	if q.CreatedAfter != nil {
+		query = query.Where("u.created_at >= ?", *q.CreatedAfter)
+	}
+	if q.CreatedBefore != nil {
+		query = query.Where("u.created_at < ?", *q.CreatedBefore)
+	}
+	if q.Search != "" {
+		// 名前の部分一致か、IDの完全一致で検索する
+		query = query.WhereGroup(" AND ", func(sq *bun.SelectQuery) *bun.SelectQuery {
+			return sq.
+				Where("u.name ILIKE ? ESCAPE '\\'", "%"+escapeLike(q.Search)+"%").
+				WhereOr("u.id::text = ?", q.Search)
+		})
+	}
+	if q.Status != "" {
+		query = query.Where("u.status = ?", q.Status)
+	}
+	if q.HasCredentials != nil {
+		exists := "EXISTS (SELECT 1 FROM webauthn_credentials AS wc WHERE wc.user_id = u.id)"
+		if *q.HasCredentials {
+			query = query.Where(exists)
+		} else {
+			query = query.Where("NOT " + exists)
+		}
+	}
+
+	return query
+}
+
+// (カラムの値, id) の行値比較で、カーソルより後ろのレコードに絞り込む。
+func (q *userListQuery) applyCursor(query *bun.SelectQuery) *bun.SelectQuery {
+	if q.Cursor == nil {
+		return query
+	}
+
+	op := ">"
+	if q.Sort.Desc {
+		op = "<"
+	}
+
+	var value interface{} = q.Cursor.Value
+	if q.Sort.Column == "created_at" {
+		// decodeUserListCursor で検証済み
+		value, _ = time.Parse(time.RFC3339Nano, q.Cursor.Value)
+	}
+
+	// カラム名は parseUserListSort で検証済みなので、そのまま埋め込んで問題ない
+	return query.Where(
+		fmt.Sprintf("(u.%s, u.id) %s (?, ?)", q.Sort.Column, op),
+		value, q.Cursor.ID,
+	)
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ユーザー一覧を取得する。GET /users と管理者APIのユーザー検索で共通して使用する。
+func listUsers(ctx context.Context, db bun.IDB, q *userListQuery) (*listUsersResponse, error) {
+	direction := "ASC"
+	if q.Sort.Desc {
+		direction = "DESC"
+	}
+
+	items := []userListItem{}
+	query := db.NewSelect().
+		Model(&items).
+		Column("u.id", "u.tenant_id", "u.name", "u.status", "u.created_at", "u.updated_at").
+		ColumnExpr("(SELECT COUNT(*) FROM webauthn_credentials AS wc WHERE wc.user_id = u.id) AS credential_count").
+		OrderExpr(fmt.Sprintf("u.%s %s, u.id %s", q.Sort.Column, direction, direction)).
+		// 次のページがあるかどうかを判定するために1件多く取得する
+		Limit(q.Limit + 1)
+	query = q.applyCursor(q.applyFilters(query))
+
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("Failed to select users: %w", err)
+	}
+
+	res := &listUsersResponse{Users: items}
+	if len(items) > q.Limit {
+		res.Users = items[:q.Limit]
+		res.NextCursor = encodeUserListCursor(q.Sort, res.Users[q.Limit-1])
+	}
+
+	if q.IncludeTotal {
+		total, err := q.applyFilters(db.NewSelect().Model((*userListItem)(nil))).Count(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to count users: %w", err)
+		}
+		res.Total = &total
+	}
+
+	return res, nil
+}
+
+func getUsers(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		ctx.Logger().Info("GET /users")
+
+		q, err := parseUserListQuery(ctx)
+		if err != nil {
+			ctx.Logger().Errorf("Invalid query: %v\n", err)
+			return ctx.JSON(http.StatusBadRequest, err.Error())
+		}
+		q.TenantID = currentTenant(ctx).ID
+
+		res, err := listUsers(ctx.Request().Context(), db, q)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to list users: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		return ctx.JSON(http.StatusOK, newPublicListUsersResponse(res))
+	}
+}
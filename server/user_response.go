@@ -0,0 +1,128 @@
+package main
+
+import (
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/google/uuid"
+)
+
+// レスポンスに含めるフィールドを決めるための、閲覧者とユーザーの関係。
+//
+// - visibilityPublic: 誰でも見られる情報のみ
+// - visibilitySelf: 本人が自分のアカウントを見る場合。登録している認証器の概要を含める
+// - visibilityAdmin: 管理者が見る場合。認証器の内部情報(フラグ、署名カウンタなど)も含める
+//
+// 公開鍵そのものはどの場合でも返さない。
+type visibility int
+
+const (
+	visibilityPublic visibility = iota
+	visibilitySelf
+	visibilityAdmin
+)
+
+type userResponse struct {
+	ID          string               `json:"id"`
+	Name        string               `json:"name"`
+	Credentials []credentialResponse `json:"credentials,omitempty"`
+	CreatedAt   *time.Time           `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time           `json:"updated_at,omitempty"`
+
+	// 以下は管理者にのみ返す
+	TenantID        string     `json:"tenant_id,omitempty"`
+	Status          string     `json:"status,omitempty"`
+	StatusReason    string     `json:"status_reason,omitempty"`
+	StatusChangedAt *time.Time `json:"status_changed_at,omitempty"`
+}
+
+type credentialFlagsResponse struct {
+	UserPresent    bool `json:"user_present"`
+	UserVerified   bool `json:"user_verified"`
+	BackupEligible bool `json:"backup_eligible"`
+	BackupState    bool `json:"backup_state"`
+}
+
+type credentialResponse struct {
+	ID        string                            `json:"id"`
+	AAGUID    string                            `json:"aaguid"`
+	Transport []protocol.AuthenticatorTransport `json:"transport,omitempty"`
+	// 同期パスキーかどうかを表示するために本人にも返す
+	BackupState   bool       `json:"backup_state"`
+	Status        string     `json:"status"`
+	DisabledAt    *time.Time `json:"disabled_at,omitempty"`
+	DisabledBy    string     `json:"disabled_by,omitempty"`
+	RevokedReason string     `json:"revoked_reason,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+
+	// 以下は管理者にのみ返す
+	AttestationType string                           `json:"attestation_type,omitempty"`
+	Flags           *credentialFlagsResponse         `json:"flags,omitempty"`
+	SignCount       *uint32                          `json:"sign_count,omitempty"`
+	CloneWarning    *bool                            `json:"clone_warning,omitempty"`
+	Attachment      protocol.AuthenticatorAttachment `json:"attachment,omitempty"`
+	UpdatedAt       *time.Time                       `json:"updated_at,omitempty"`
+}
+
+func newUserResponse(user *User, v visibility) userResponse {
+	res := userResponse{
+		ID:   user.ID,
+		Name: user.Name,
+	}
+	if v == visibilityPublic {
+		return res
+	}
+
+	res.CreatedAt = &user.CreatedAt
+	res.Credentials = make([]credentialResponse, len(user.WebauthnCredentials))
+	for i := range user.WebauthnCredentials {
+		res.Credentials[i] = newCredentialResponse(&user.WebauthnCredentials[i], v)
+	}
+	if v == visibilityAdmin {
+		res.UpdatedAt = &user.UpdatedAt
+		res.TenantID = user.TenantID
+		res.Status = user.Status
+		res.StatusReason = user.StatusReason
+		if !user.StatusChangedAt.IsZero() {
+			res.StatusChangedAt = &user.StatusChangedAt
+		}
+	}
+
+	return res
+}
+
+func newCredentialResponse(cred *WebauthnCredentials, v visibility) credentialResponse {
+	res := credentialResponse{
+		ID:            cred.ID,
+		Transport:     cred.Transport,
+		BackupState:   cred.Flags.BackupState,
+		Status:        cred.Status(),
+		DisabledBy:    cred.DisabledBy,
+		RevokedReason: cred.RevokedReason,
+		CreatedAt:     cred.CreatedAt,
+	}
+	if !cred.DisabledAt.IsZero() {
+		res.DisabledAt = &cred.DisabledAt
+	}
+	// AAGUIDが壊れていても他の情報は返したいので、エラーの場合は空文字にする
+	if aaguid, err := uuid.FromBytes(cred.Authenticator.AAGUID); err == nil {
+		res.AAGUID = aaguid.String()
+	}
+	if v != visibilityAdmin {
+		return res
+	}
+
+	res.AttestationType = cred.AttestationType
+	res.Flags = &credentialFlagsResponse{
+		UserPresent:    cred.Flags.UserPresent,
+		UserVerified:   cred.Flags.UserVerified,
+		BackupEligible: cred.Flags.BackupEligible,
+		BackupState:    cred.Flags.BackupState,
+	}
+	res.SignCount = &cred.Authenticator.SignCount
+	res.CloneWarning = &cred.Authenticator.CloneWarning
+	res.Attachment = cred.Authenticator.Attachment
+	res.UpdatedAt = &cred.UpdatedAt
+
+	return res
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+)
+
+// ログインセッションの一覧と削除。
+//
+// セッションIDはCookieの値そのものなので、レスポンスにはハッシュ化した値をIDとして返し、削除する際もハッシュで指定してもらう。
+// トークンモードのログインは、リフレッシュトークンのファミリーのIDをIDとして返す。
+
+// ログインの種類
+const (
+	sessionTypeCookie = "cookie"
+	sessionTypeToken  = "token"
+)
+
+type sessionResponse struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"`
+	Device       string    `json:"device"`
+	IP           string    `json:"ip"`
+	UserAgent    string    `json:"user_agent"`
+	CredentialID string    `json:"credential_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastSeenAt   time.Time `json:"last_seen_at"`
+	// リクエストしたセッション自身かどうか
+	Current bool `json:"current"`
+}
+
+func publicSessionID(sessionID string) string {
+	return hashToken(sessionID)
+}
+
+// リクエストのCookieのログインセッションIDを返す。トークンモードの場合は空になる。
+func currentLoginSessionID(ctx echo.Context) string {
+	id, _ := ctx.Get(loginSessionIDContextKey).(string)
+	return id
+}
+
+// リクエストのアクセストークンの、リフレッシュトークンのファミリーのIDを返す。Cookieの場合は空になる。
+func currentTokenSessionID(ctx echo.Context) string {
+	if claims, ok := ctx.Get(accessTokenContextKey).(*accessTokenClaims); ok {
+		return claims.SessionID
+	}
+
+	return ""
+}
+
+// User-Agentから、一覧に表示するためのおおまかな端末名を決める。
+func describeDevice(userAgent string) string {
+	devices := []struct{ keyword, name string }{
+		// AndroidはLinux、iPhoneやiPadはMac OS Xの文字列も含むので先に判定する
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"Macintosh", "Mac"},
+		{"Windows", "Windows"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	}
+	for _, d := range devices {
+		if strings.Contains(userAgent, d.keyword) {
+			return d.name
+		}
+	}
+
+	return "Unknown"
+}
+
+// Cookieのログインセッションと、トークンモードのログインの一覧を返す。
+// トークンモードのログインは、IPアドレスやUser-Agentを記録していないので空になる。
+func listUserSessions(db *bun.DB, sessions *sessionStore) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		userID := ctx.Param("id")
+
+		loginSessions, err := sessions.ListUserLoginSessions(ctx.Request().Context(), userID)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to list login sessions: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		tokenSessions, err := listUserTokenSessions(ctx.Request().Context(), db, userID)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to list token sessions: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		current := currentLoginSessionID(ctx)
+		res := make([]sessionResponse, 0, len(loginSessions)+len(tokenSessions))
+		for _, s := range loginSessions {
+			res = append(res, sessionResponse{
+				ID:           publicSessionID(s.ID),
+				Type:         sessionTypeCookie,
+				Device:       describeDevice(s.UserAgent),
+				IP:           s.IP,
+				UserAgent:    s.UserAgent,
+				CredentialID: s.CredentialID,
+				CreatedAt:    s.CreatedAt,
+				LastSeenAt:   s.LastSeenAt,
+				Current:      s.ID == current,
+			})
+		}
+		currentToken := currentTokenSessionID(ctx)
+		for _, s := range tokenSessions {
+			res = append(res, sessionResponse{
+				ID:         s.FamilyID,
+				Type:       sessionTypeToken,
+				Device:     describeDevice(""),
+				CreatedAt:  s.AuthTime,
+				LastSeenAt: s.LastRefreshedAt,
+				Current:    s.FamilyID == currentToken,
+			})
+		}
+
+		return ctx.JSON(http.StatusOK, res)
+	}
+}
+
+func deleteUserSession(db *bun.DB, sessions *sessionStore) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		userID := ctx.Param("id")
+
+		loginSessions, err := sessions.ListUserLoginSessions(ctx.Request().Context(), userID)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to list login sessions: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		for _, s := range loginSessions {
+			if publicSessionID(s.ID) != ctx.Param("session_id") {
+				continue
+			}
+
+			deleted, err := sessions.DeleteUserLoginSession(ctx.Request().Context(), userID, s.ID)
+			if err != nil {
+				ctx.Logger().Errorf("Failed to delete login session: %v\n", err)
+				return ctx.JSON(http.StatusInternalServerError, nil)
+			}
+			if !deleted {
+				break
+			}
+			recordAuthEvent(ctx, db, &AuthEvent{UserID: userID, CredentialID: s.CredentialID, EventType: authEventSessionRevoke, Result: authEventSuccess})
+
+			return ctx.NoContent(http.StatusNoContent)
+		}
+
+		// トークンモードのログインの場合は、リフレッシュトークンのファミリーを失効させる
+		n, err := revokeUserRefreshTokenFamily(ctx.Request().Context(), db, userID, ctx.Param("session_id"))
+		if err != nil {
+			ctx.Logger().Errorf("Failed to revoke refresh tokens: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		if n > 0 {
+			recordAuthEvent(ctx, db, &AuthEvent{UserID: userID, EventType: authEventSessionRevoke, Result: authEventSuccess})
+			return ctx.NoContent(http.StatusNoContent)
+		}
+
+		return ctx.JSON(http.StatusNotFound, nil)
+	}
+}
+
+type deleteUserSessionsResponse struct {
+	RevokedSessions      int `json:"revoked_sessions"`
+	RevokedTokenFamilies int `json:"revoked_token_families"`
+}
+
+// すべての端末からログアウトする。トークンモードのリフレッシュトークンも失効させる。
+//
+// keep_current=true を指定した場合は、リクエストしたセッション(トークンモードの場合はリフレッシュトークンのファミリー)以外からログアウトする。
+func deleteUserSessions(db *bun.DB, sessions *sessionStore) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		userID := ctx.Param("id")
+		keep, keepFamily := "", ""
+		if ctx.QueryParam("keep_current") == "true" {
+			keep = currentLoginSessionID(ctx)
+			keepFamily = currentTokenSessionID(ctx)
+		}
+
+		loginSessions, err := sessions.ListUserLoginSessions(ctx.Request().Context(), userID)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to list login sessions: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		var res deleteUserSessionsResponse
+		for _, s := range loginSessions {
+			if s.ID == keep {
+				continue
+			}
+
+			deleted, err := sessions.DeleteUserLoginSession(ctx.Request().Context(), userID, s.ID)
+			if err != nil {
+				ctx.Logger().Errorf("Failed to delete login session: %v\n", err)
+				return ctx.JSON(http.StatusInternalServerError, nil)
+			}
+			if deleted {
+				res.RevokedSessions++
+			}
+		}
+
+		res.RevokedTokenFamilies, err = revokeUserRefreshTokens(ctx.Request().Context(), db, userID, keepFamily)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to revoke refresh tokens: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		recordAuthEvent(ctx, db, &AuthEvent{UserID: userID, EventType: authEventSessionRevoke, Result: authEventSuccess, Reason: "signed out everywhere"})
+
+		return ctx.JSON(http.StatusOK, res)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/daikideal/go-passkey-demo/passkey"
+	"github.com/uptrace/bun"
+)
+
+// ログインの失敗が続いた場合に、一時的にアカウントをロックするための設定
+const (
+	// この回数だけ続けて失敗したらロックする
+	maxFailedLogins = 5
+	// 最後の失敗からこの時間が経過していれば、失敗回数を数え直す
+	failedLoginWindow = 15 * time.Minute
+	// ロックしている時間
+	loginLockDuration = 15 * time.Minute
+)
+
+var (
+	errUserLocked          = errors.New("user is locked")
+	errUserDisabled        = errors.New("user is disabled")
+	errUserPendingDeletion = errors.New("user is pending deletion")
+
+	errUserNameTaken = passkey.ErrUserNameTaken
+	// 管理者が無効化した認証器を、ユーザー本人が有効化しようとした場合
+	errCredentialLocked = passkey.ErrCredentialLocked
+)
+
+// ユーザーがログインや認証器の登録をしてよい状態かを確認する。
+// ロックは期限が過ぎていれば解除されたものとして扱い、次にログインに成功したときに状態を戻す。
+func (user *User) checkActive(now time.Time) error {
+	switch user.Status {
+	case userStatusActive:
+		return nil
+	case userStatusLocked:
+		if !user.LockedUntil.IsZero() && now.After(user.LockedUntil) {
+			return nil
+		}
+		return errUserLocked
+	case userStatusDisabled:
+		return errUserDisabled
+	case userStatusPendingDeletion:
+		return errUserPendingDeletion
+	default:
+		return errors.New("unknown user status: " + user.Status)
+	}
+}
+
+// ログインの失敗を記録し、失敗回数が上限に達した場合はアカウントを一時的にロックする。
+// ロックした場合は true を返す。
+func recordFailedLogin(ctx context.Context, db bun.IDB, userID string) (bool, error) {
+	var count int
+	err := db.NewUpdate().
+		Model((*User)(nil)).
+		Set("failed_login_count = CASE WHEN last_failed_login_at > NOW() - ? * INTERVAL '1 second' THEN failed_login_count + 1 ELSE 1 END", int(failedLoginWindow.Seconds())).
+		Set("last_failed_login_at = NOW()").
+		Where("id = ?", userID).
+		Returning("failed_login_count").
+		Scan(ctx, &count)
+	if err != nil {
+		return false, err
+	}
+	if count < maxFailedLogins {
+		return false, nil
+	}
+
+	res, err := db.NewUpdate().
+		Model((*User)(nil)).
+		Set("status = ?", userStatusLocked).
+		Set("status_reason = ?", "too many failed login attempts").
+		Set("status_changed_at = NOW()").
+		Set("locked_until = NOW() + ? * INTERVAL '1 second'", int(loginLockDuration.Seconds())).
+		Set("updated_at = NOW()").
+		Where("id = ?", userID).
+		// 管理者が無効化したアカウントなどを、ロックで上書きしないようにする。
+		// 期限の過ぎたロックはログインに成功するまで locked のままなので、ロックし直せるようにする
+		Where("(status = ? OR (status = ? AND locked_until <= NOW()))", userStatusActive, userStatusLocked).
+		Exec(ctx)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+
+	return n > 0, nil
+}
+
+// ログインに成功したら失敗回数をリセットし、期限切れのロックを解除する。
+func resetFailedLogins(ctx context.Context, db bun.IDB, user *User) error {
+	if user.FailedLoginCount == 0 && user.Status != userStatusLocked {
+		return nil
+	}
+
+	_, err := db.NewUpdate().
+		Model((*User)(nil)).
+		Set("failed_login_count = 0").
+		Set("last_failed_login_at = NULL").
+		Set("status = CASE WHEN status = ? THEN ? ELSE status END", userStatusLocked, userStatusActive).
+		Set("status_reason = CASE WHEN status = ? THEN NULL ELSE status_reason END", userStatusLocked).
+		Set("status_changed_at = CASE WHEN status = ? THEN NOW() ELSE status_changed_at END", userStatusLocked).
+		Set("locked_until = NULL").
+		Set("updated_at = NOW()").
+		Where("id = ?", user.ID).
+		Exec(ctx)
+
+	return err
+}
@@ -0,0 +1,69 @@
+// Package webhook は、サーバーが送信するWebhookの署名と検証を行う。
+//
+// 受信側でも同じ方法で検証できるように、サーバー本体(package main)とは分けている。
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhookのリクエストに付与するヘッダー
+const (
+	HeaderID        = "Webhook-Id"
+	HeaderTimestamp = "Webhook-Timestamp"
+	HeaderSignature = "Webhook-Signature"
+)
+
+// 署名のバージョン。署名方法を変えたときに、受信側が判別できるようにする。
+const signatureVersion = "v1"
+
+var (
+	ErrMissingHeader    = errors.New("webhook: missing signature header")
+	ErrInvalidSignature = errors.New("webhook: invalid signature")
+	ErrTimestampExpired = errors.New("webhook: timestamp is out of tolerance")
+)
+
+// "{timestamp}.{body}" をシークレットでHMAC-SHA256した値を、 "v1=<hex>" の形式で返す。
+//
+// タイムスタンプも署名に含めることで、古いリクエストを再送するリプレイ攻撃を防ぐ。
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp.Unix())
+	mac.Write(body)
+
+	return signatureVersion + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ヘッダーの署名とタイムスタンプを検証する。
+// タイムスタンプが現在時刻から tolerance 以上ずれている場合はエラーにする。
+func Verify(secret, timestampHeader, signatureHeader string, body []byte, tolerance time.Duration) error {
+	if timestampHeader == "" || signatureHeader == "" {
+		return ErrMissingHeader
+	}
+
+	unix, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return fmt.Errorf("webhook: invalid timestamp: %w", err)
+	}
+	timestamp := time.Unix(unix, 0)
+	if d := time.Since(timestamp); d > tolerance || d < -tolerance {
+		return ErrTimestampExpired
+	}
+
+	expected := Sign(secret, timestamp, body)
+	// シークレットのローテーション中は複数の署名がスペース区切りで送られることを想定する
+	for _, sig := range strings.Fields(signatureHeader) {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			return nil
+		}
+	}
+
+	return ErrInvalidSignature
+}
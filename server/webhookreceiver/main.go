@@ -0,0 +1,77 @@
+// ローカル開発用のWebhook受信サーバー。
+//
+// 署名を検証し、受け取ったイベントを標準出力に表示する。
+// WEBHOOK_SECRET には、管理者APIでWebhookを登録したときに発行されたシークレットを設定する。
+//
+//	WEBHOOK_SECRET=whsec_xxx go run ./webhookreceiver
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/daikideal/go-passkey-demo/webhook"
+)
+
+func main() {
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if secret == "" {
+		log.Println("WEBHOOK_SECRET is not set. Signatures will not be verified.")
+	}
+
+	addr := os.Getenv("WEBHOOK_RECEIVER_ADDR")
+	if addr == "" {
+		addr = ":9090"
+	}
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if secret != "" {
+			err := webhook.Verify(
+				secret,
+				r.Header.Get(webhook.HeaderTimestamp),
+				r.Header.Get(webhook.HeaderSignature),
+				body,
+				5*time.Minute,
+			)
+			if err != nil {
+				log.Printf("Rejected %s: %v\n", r.Header.Get(webhook.HeaderID), err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, body, "", "  "); err != nil {
+			pretty.Write(body)
+		}
+		log.Printf("Received %s\n%s\n", r.Header.Get(webhook.HeaderID), pretty.String())
+
+		// 再送の動作確認ができるように、パスに "fail" を含む場合はエラーを返す
+		if strings.Contains(r.URL.Path, "fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	log.Printf("Listening on %s\n", addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/daikideal/go-passkey-demo/webhook"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+)
+
+// Webhookで通知するイベントの種類
+const (
+	webhookEventPasskeyAdded        = "passkey.added"
+	webhookEventPasskeyRemoved      = "passkey.removed"
+	webhookEventPasskeyDisabled     = "passkey.disabled"
+	webhookEventPasskeyEnabled      = "passkey.enabled"
+	webhookEventPasskeyCloneWarning = "passkey.clone_warning"
+)
+
+var webhookEventTypes = []string{
+	webhookEventPasskeyAdded,
+	webhookEventPasskeyRemoved,
+	webhookEventPasskeyDisabled,
+	webhookEventPasskeyEnabled,
+	webhookEventPasskeyCloneWarning,
+}
+
+// 送信キューの状態
+//
+// - pending: 送信待ち。失敗した場合も、再送の上限に達するまではこの状態のまま next_attempt_at を延ばす
+// - delivered: 送信済み
+// - dead: 再送の上限に達した。管理者APIから手動で再送できる
+const (
+	webhookDeliveryPending   = "pending"
+	webhookDeliveryDelivered = "delivered"
+	webhookDeliveryDead      = "dead"
+)
+
+// 再送の設定
+const (
+	webhookMaxAttempts    = 10
+	webhookBaseBackoff    = 30 * time.Second
+	webhookMaxBackoff     = 1 * time.Hour
+	webhookRequestTimeout = 10 * time.Second
+	// 送信中のレコードを他のレプリカが取得しないように、この時間だけ next_attempt_at を先に進めておく
+	webhookClaimLease = 1 * time.Minute
+	webhookBatchSize  = 10
+)
+
+type WebhookEndpoint struct {
+	bun.BaseModel `bun:"table:webhook_endpoints,alias:we"`
+
+	ID  string `json:"id" bun:"id,pk"`
+	URL string `json:"url" bun:"url"`
+	// 送信時の署名に使用するので、ハッシュ化せずに保存している。
+	// 登録時のレスポンス以外では返さない。
+	Secret     string    `json:"-" bun:"secret"`
+	EventTypes []string  `json:"event_types" bun:"event_types,array"`
+	Enabled    bool      `json:"enabled" bun:"enabled"`
+	CreatedAt  time.Time `json:"created_at" bun:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at" bun:"updated_at"`
+}
+
+// 送信キュー(outbox)のレコード。
+// 認証器の変更と同じトランザクションで書き込むことで、変更があったのに通知されない、ということを防ぐ。
+type WebhookDelivery struct {
+	bun.BaseModel `bun:"table:webhook_outbox,alias:wo"`
+
+	ID             string          `json:"id" bun:"id,pk"`
+	EventID        string          `json:"event_id" bun:"event_id"`
+	EndpointID     string          `json:"endpoint_id" bun:"endpoint_id"`
+	EventType      string          `json:"event_type" bun:"event_type"`
+	Payload        json.RawMessage `json:"payload" bun:"payload,type:jsonb"`
+	Status         string          `json:"status" bun:"status"`
+	Attempts       int             `json:"attempts" bun:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at" bun:"next_attempt_at"`
+	LastError      string          `json:"last_error,omitempty" bun:"last_error,nullzero"`
+	LastStatusCode int             `json:"last_status_code,omitempty" bun:"last_status_code,nullzero"`
+	CreatedAt      time.Time       `json:"created_at" bun:"created_at"`
+	DeliveredAt    time.Time       `json:"delivered_at,omitempty" bun:"delivered_at,nullzero"`
+
+	Endpoint *WebhookEndpoint `json:"-" bun:"rel:belongs-to,join:endpoint_id=id"`
+}
+
+// 受信側に送るJSON
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// 認証器に関するイベントのデータ
+type webhookPasskeyData struct {
+	TenantID     string `json:"tenant_id"`
+	UserID       string `json:"user_id"`
+	CredentialID string `json:"credential_id"`
+	AAGUID       string `json:"aaguid,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+func newWebhookPasskeyData(cred *WebauthnCredentials, reason string) webhookPasskeyData {
+	data := webhookPasskeyData{
+		TenantID:     cred.TenantID,
+		UserID:       cred.UserID,
+		CredentialID: cred.ID,
+		Reason:       reason,
+	}
+	if aaguid, err := uuid.FromBytes(cred.Authenticator.AAGUID); err == nil {
+		data.AAGUID = aaguid.String()
+	}
+
+	return data
+}
+
+// イベントを購読しているエンドポイントごとに、送信キューへ追加する。
+// 呼び出し元のトランザクションを渡すことで、認証器の変更と同時にコミットされるようにする。
+func enqueueWebhookEvent(ctx context.Context, tx bun.IDB, eventType string, data interface{}) error {
+	// 受信側で重複を除けるように、同じイベントはどのエンドポイントにも同じIDで送る
+	eventID := uuid.NewString()
+	payload, err := json.Marshal(&webhookPayload{
+		ID:        eventID,
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to encode webhook payload: %w", err)
+	}
+
+	// event_types が空のエンドポイントは、すべてのイベントを購読しているものとして扱う
+	_, err = tx.NewRaw(`
+		INSERT INTO webhook_outbox (event_id, endpoint_id, event_type, payload)
+		SELECT ?, id, ?, ? FROM webhook_endpoints
+		WHERE enabled AND (cardinality(event_types) = 0 OR ? = ANY(event_types))`,
+		eventID, eventType, string(payload), eventType,
+	).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to enqueue webhook event: %w", err)
+	}
+
+	return nil
+}
+
+// n回目の失敗の後、次に送信するまでの時間。指数関数的に伸ばし、同時に再送が集中しないように揺らぎを加える。
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookBaseBackoff << (attempts - 1)
+	if d <= 0 || d > webhookMaxBackoff {
+		d = webhookMaxBackoff
+	}
+
+	return d/2 + rand.N(d/2)
+}
+
+// 送信キューを定期的に確認し、Webhookを送信する。
+// 複数のレプリカで動かしても同じレコードを二重に送らないように、 SKIP LOCKED で取得したレコードに期限付きの印をつけてから送信する。
+func startWebhookDispatcher(ctx context.Context, wg *sync.WaitGroup, logger echo.Logger, db *bun.DB, interval time.Duration) {
+	client := &http.Client{Timeout: webhookRequestTimeout}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := dispatchWebhooks(ctx, db, logger, client); err != nil {
+					logger.Errorf("Failed to dispatch webhooks: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+func dispatchWebhooks(ctx context.Context, db bun.IDB, logger echo.Logger, client *http.Client) error {
+	var ids []string
+	err := db.NewRaw(`
+		UPDATE webhook_outbox SET next_attempt_at = NOW() + ? * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id FROM webhook_outbox
+			WHERE status = ? AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id`,
+		int(webhookClaimLease.Seconds()), webhookDeliveryPending, webhookBatchSize,
+	).Scan(ctx, &ids)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var deliveries []WebhookDelivery
+	err = db.NewSelect().
+		Model(&deliveries).
+		Relation("Endpoint").
+		Where("wo.id IN (?)", bun.In(ids)).
+		Scan(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := range deliveries {
+		deliverWebhook(ctx, db, logger, client, &deliveries[i])
+	}
+
+	return nil
+}
+
+// Webhookを1件送信し、結果を送信キューに記録する。
+func deliverWebhook(ctx context.Context, db bun.IDB, logger echo.Logger, client *http.Client, d *WebhookDelivery) {
+	statusCode, err := postWebhook(ctx, client, d)
+
+	d.Attempts++
+	query := db.NewUpdate().
+		Model(d).
+		Set("attempts = ?", d.Attempts).
+		Set("last_status_code = NULLIF(?, 0)", statusCode).
+		WherePK()
+	switch {
+	case err == nil:
+		query = query.
+			Set("status = ?", webhookDeliveryDelivered).
+			Set("delivered_at = NOW()").
+			Set("last_error = NULL")
+	case d.Attempts >= webhookMaxAttempts:
+		logger.Warnf("Webhook %s to endpoint %s is dead-lettered: %v\n", d.ID, d.EndpointID, err)
+		query = query.
+			Set("status = ?", webhookDeliveryDead).
+			Set("last_error = ?", err.Error())
+	default:
+		logger.Infof("Webhook %s to endpoint %s failed (attempt %d): %v\n", d.ID, d.EndpointID, d.Attempts, err)
+		query = query.
+			Set("next_attempt_at = ?", time.Now().Add(webhookBackoff(d.Attempts))).
+			Set("last_error = ?", err.Error())
+	}
+
+	if _, err := query.Exec(ctx); err != nil {
+		logger.Errorf("Failed to update webhook delivery %s: %v\n", d.ID, err)
+	}
+}
+
+func postWebhook(ctx context.Context, client *http.Client, d *WebhookDelivery) (int, error) {
+	if d.Endpoint == nil {
+		return 0, fmt.Errorf("endpoint %s is not found", d.EndpointID)
+	}
+	if !d.Endpoint.Enabled {
+		return 0, fmt.Errorf("endpoint %s is disabled", d.EndpointID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Endpoint.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(webhook.HeaderID, d.EventID)
+	req.Header.Set(webhook.HeaderTimestamp, fmt.Sprint(now.Unix()))
+	req.Header.Set(webhook.HeaderSignature, webhook.Sign(d.Endpoint.Secret, now, d.Payload))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	// コネクションを再利用できるように読み捨てる
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	return res.StatusCode, nil
+}
+
+type createWebhookEndpointRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+}
+
+// 登録時のみシークレットを返す
+type createWebhookEndpointResponse struct {
+	WebhookEndpoint
+	Secret string `json:"secret"`
+}
+
+func adminCreateWebhookEndpoint(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		var req createWebhookEndpointRequest
+		if err := ctx.Bind(&req); err != nil {
+			ctx.Logger().Errorf("Failed to process request: %v\n", err)
+			return ctx.JSON(http.StatusBadRequest, nil)
+		}
+
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return ctx.JSON(http.StatusBadRequest, "Invalid url")
+		}
+		for _, t := range req.EventTypes {
+			if !slices.Contains(webhookEventTypes, t) {
+				return ctx.JSON(http.StatusBadRequest, "Unknown event type: "+t)
+			}
+		}
+		if req.EventTypes == nil {
+			req.EventTypes = []string{}
+		}
+
+		secret, err := random(32)
+		if err != nil {
+			ctx.Logger().Errorf("Failed to generate secret: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		endpoint := &WebhookEndpoint{
+			URL:        req.URL,
+			Secret:     "whsec_" + secret,
+			EventTypes: req.EventTypes,
+			Enabled:    true,
+		}
+		_, err = db.NewInsert().
+			Model(endpoint).
+			Column("url", "secret", "event_types", "enabled").
+			Returning("*").
+			Exec(ctx.Request().Context())
+		if err != nil {
+			ctx.Logger().Errorf("Failed to insert webhook endpoint: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		setAdminAuditDetail(ctx, map[string]interface{}{"webhook_id": endpoint.ID, "url": endpoint.URL})
+
+		return ctx.JSON(http.StatusCreated, createWebhookEndpointResponse{
+			WebhookEndpoint: *endpoint,
+			Secret:          endpoint.Secret,
+		})
+	}
+}
+
+func adminListWebhookEndpoints(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		endpoints := []WebhookEndpoint{}
+		err := db.NewSelect().
+			Model(&endpoints).
+			Order("created_at").
+			Scan(ctx.Request().Context())
+		if err != nil {
+			ctx.Logger().Errorf("Failed to select webhook endpoints: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		return ctx.JSON(http.StatusOK, endpoints)
+	}
+}
+
+func adminDeleteWebhookEndpoint(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		webhookID := ctx.Param("webhook_id")
+		setAdminAuditDetail(ctx, map[string]interface{}{"webhook_id": webhookID})
+
+		res, err := db.NewDelete().
+			Model((*WebhookEndpoint)(nil)).
+			Where("id = ?", webhookID).
+			Exec(ctx.Request().Context())
+		if err != nil {
+			ctx.Logger().Errorf("Failed to delete webhook endpoint: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ctx.JSON(http.StatusNotFound, nil)
+		}
+
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
+
+// 送信キューのレコードを取得する。デフォルトでは再送の上限に達したものを返す。
+func adminListWebhookDeliveries(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		status := ctx.QueryParam("status")
+		if status == "" {
+			status = webhookDeliveryDead
+		}
+
+		deliveries := []WebhookDelivery{}
+		err := db.NewSelect().
+			Model(&deliveries).
+			Where("wo.status = ?", status).
+			Order("wo.created_at DESC").
+			Limit(100).
+			Scan(ctx.Request().Context())
+		if err != nil {
+			ctx.Logger().Errorf("Failed to select webhook deliveries: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+
+		return ctx.JSON(http.StatusOK, deliveries)
+	}
+}
+
+// 再送の上限に達したレコードを、送信待ちに戻す。
+func adminRetryWebhookDelivery(db *bun.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		deliveryID := ctx.Param("delivery_id")
+		setAdminAuditDetail(ctx, map[string]interface{}{"delivery_id": deliveryID})
+
+		res, err := db.NewUpdate().
+			Model((*WebhookDelivery)(nil)).
+			Set("status = ?", webhookDeliveryPending).
+			Set("attempts = 0").
+			Set("next_attempt_at = NOW()").
+			Where("id = ?", deliveryID).
+			Where("status = ?", webhookDeliveryDead).
+			Exec(ctx.Request().Context())
+		if err != nil {
+			ctx.Logger().Errorf("Failed to update webhook delivery: %v\n", err)
+			return ctx.JSON(http.StatusInternalServerError, nil)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ctx.JSON(http.StatusNotFound, nil)
+		}
+
+		return ctx.NoContent(http.StatusAccepted)
+	}
+}
@@ -8,6 +8,7 @@ import {
 
 import "./App.css";
 import { useNavigate } from "react-router";
+import { fetchCsrfToken } from "./csrf";
 
 const App: React.FC = () => {
   const navigate = useNavigate();
@@ -46,6 +47,7 @@ const App: React.FC = () => {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
+          "X-CSRF-Token": await fetchCsrfToken(),
         },
         credentials: "include",
         body: JSON.stringify({
@@ -71,6 +73,7 @@ const App: React.FC = () => {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
+          "X-CSRF-Token": await fetchCsrfToken(),
         },
         credentials: "include",
         body: JSON.stringify(publicKeyCredential),
@@ -118,6 +121,9 @@ const App: React.FC = () => {
       "http://localhost:8080/authentication/options",
       {
         method: "POST",
+        headers: {
+          "X-CSRF-Token": await fetchCsrfToken(),
+        },
         credentials: "include",
       }
     );
@@ -139,6 +145,7 @@ const App: React.FC = () => {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
+          "X-CSRF-Token": await fetchCsrfToken(),
         },
         credentials: "include",
         body: JSON.stringify(assertion),
@@ -159,6 +166,18 @@ const App: React.FC = () => {
 
     alert("Successfully logged in!");
 
+    // OpenID Connectの認可リクエストから来た場合は、認可エンドポイントに戻る
+    //
+    // オープンリダイレクトにならないように、戻り先はAPIサーバーの認可エンドポイントに限る
+    const returnTo = new URLSearchParams(window.location.search).get(
+      "return_to"
+    );
+    if (returnTo?.startsWith("http://localhost:8080/oauth2/authorize?")) {
+      window.location.assign(returnTo);
+
+      return;
+    }
+
     navigate(`/users/${userID}/public_keys`);
   }, [navigate]);
 
@@ -2,6 +2,7 @@ import React, { useCallback, useEffect, useState } from "react";
 import { useParams } from "react-router";
 
 import "./List.css";
+import { fetchCsrfToken } from "./csrf";
 
 type UserInfo = {
   id: string;
@@ -11,6 +12,9 @@ type UserInfo = {
 type PasskeyInfo = {
   id: string;
   AAGUID: string;
+  status: "active" | "disabled";
+  disabled_at?: string;
+  revoked_reason?: string;
   created_at: string;
 };
 
@@ -76,6 +80,7 @@ const PasskeyInfoList: React.FC = () => {
           method: "DELETE",
           headers: {
             "Content-Type": "application/json",
+            "X-CSRF-Token": await fetchCsrfToken(),
           },
           credentials: "include",
         }
@@ -93,6 +98,41 @@ const PasskeyInfoList: React.FC = () => {
     [userID]
   );
 
+  const togglePasskeyInfo = useCallback(
+    async (passkeyInfo: PasskeyInfo) => {
+      const action = passkeyInfo.status === "active" ? "disable" : "enable";
+      const toggleAPIRes = await fetch(
+        `http://localhost:8080/users/${userID}/public_keys/${passkeyInfo.id}/${action}`,
+        {
+          method: "POST",
+          headers: {
+            "Content-Type": "application/json",
+            "X-CSRF-Token": await fetchCsrfToken(),
+          },
+          credentials: "include",
+          body: JSON.stringify({}),
+        }
+      );
+      if (!toggleAPIRes.ok) {
+        alert(`Failed to ${action} public key: ${passkeyInfo.id}`);
+
+        return;
+      }
+
+      setPasskeyInfos((prevPasskeyInfos) =>
+        prevPasskeyInfos.map((prev) =>
+          prev.id === passkeyInfo.id
+            ? {
+                ...prev,
+                status: action === "disable" ? "disabled" : "active",
+              }
+            : prev
+        )
+      );
+    },
+    [userID]
+  );
+
   return (
     <div>
       <h1>{userInfo?.name}'s passkeys</h1>
@@ -103,6 +143,8 @@ const PasskeyInfoList: React.FC = () => {
             <th key="icon">アイコン</th>
             <th key="name">名前</th>
             <th key="created-at">作成日時</th>
+            <th key="status">状態</th>
+            <th>無効化する</th>
             <th>削除する</th>
           </tr>
         </thead>
@@ -130,6 +172,16 @@ const PasskeyInfoList: React.FC = () => {
                   })}
                 </span>
               </td>
+              <td key="status">
+                <span>
+                  {PasskeyInfo.status === "active" ? "有効" : "無効"}
+                </span>
+              </td>
+              <td>
+                <button onClick={() => togglePasskeyInfo(PasskeyInfo)}>
+                  {PasskeyInfo.status === "active" ? "無効化" : "有効化"}
+                </button>
+              </td>
               <td>
                 <button onClick={() => deletePasskeyInfo(PasskeyInfo.id)}>
                   削除
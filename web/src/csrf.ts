@@ -0,0 +1,16 @@
+/**
+ * CSRF対策のトークンを取得する。
+ *
+ * Cookieを使って状態を変更するリクエスト(POST・DELETEなど)には、このトークンを `X-CSRF-Token` ヘッダーに付けて送る。
+ */
+export const fetchCsrfToken = async (): Promise<string> => {
+  const res = await fetch("http://localhost:8080/csrf", {
+    credentials: "include",
+  });
+  if (!res.ok) {
+    throw new Error("Failed to get CSRF token");
+  }
+  const json = await res.json();
+
+  return json.csrf_token;
+};
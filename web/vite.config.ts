@@ -4,4 +4,14 @@ import react from '@vitejs/plugin-react-swc'
 // https://vite.dev/config/
 export default defineConfig({
   plugins: [react()],
+  server: {
+    // パスキーの作成・認証は自身のオリジンでのみ許可し、他のサイトのフレームに埋め込まれないようにする
+    headers: {
+      'Permissions-Policy':
+        'publickey-credentials-get=(self), publickey-credentials-create=(self)',
+      'Content-Security-Policy': "frame-ancestors 'none'",
+      'Referrer-Policy': 'strict-origin-when-cross-origin',
+      'X-Content-Type-Options': 'nosniff',
+    },
+  },
 })